@@ -1,158 +1,5452 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/cors"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/skip2/go-qrcode"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
 func main() {
-	err := godotenv.Load()
+	envFromFile, missingEnv, err := loadEnvFile()
 	if err != nil {
-		fmt.Println("Failed to load .env file")
+		fmt.Println("Failed to load .env file:", err)
 		os.Exit(1)
 	}
 
+	slog.SetDefault(newLogger(os.Getenv("LOG_FORMAT")))
+	if missingEnv {
+		slog.Info("no .env file, using the process environment")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		slog.Error("failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+
+	svc, err := newS3Client(config)
+	if err != nil {
+		slog.Error("failed to create S3 client", "error", err)
+		os.Exit(1)
+	}
+	clock := SystemClock{}
+	storage, err := newStorageBackend(config, svc, clock)
+	if err != nil {
+		slog.Error("failed to create storage backend", "error", err)
+		os.Exit(1)
+	}
+	regions := NewRegionClients(config, svc)
+	buckets, err := newBucketTargets(config, regions, storage)
+	if err != nil {
+		slog.Error("failed to create bucket alias clients", "error", err)
+		os.Exit(1)
+	}
+	server := &Server{Config: config, S3: svc, Storage: storage, Buckets: buckets, Regions: regions, Clock: clock, EnvFromFile: envFromFile}
+	server.Idempotency = NewMemoryIdempotencyStore(clock)
+	server.Keys = newKeyStrategy(config)
+	server.setUploadsEnabled(config.UploadsEnabled)
+	if config.WebhookURL != "" {
+		server.Webhook = NewWebhook(config.WebhookURL)
+	}
+	if config.CredentialsCheckInterval > 0 && config.StorageBackend == STORAGE_BACKEND_S3 {
+		server.Credentials = &CredentialsCheck{Client: newIdentityClient(svc), MaxRetries: config.MaxRetries}
+		go server.Credentials.Run(context.Background(), config.CredentialsCheckInterval)
+	}
+	go server.reloadOnSIGHUP()
+
+	httpServer := &http.Server{
+		Addr: config.ListenAddr,
+		Handler: otelhttp.NewHandler(newRouter(server, config), "http.server", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + r.URL.Path
+		})),
+	}
+	err = run(httpServer)
+	if server.Webhook != nil {
+		server.Webhook.Wait()
+	}
+
+	// Flush the spans still buffered
+	flushCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	if flushErr := shutdownTracing(flushCtx); flushErr != nil {
+		slog.Error("failed to flush traces", "error", flushErr)
+	}
+	cancel()
+	if err != nil {
+		slog.Error("server stopped", "error", err)
+		os.Exit(1)
+	}
+}
+
+// loadEnvFile loads a .env file into the process environment, variables already set win as with godotenv.Load.
+// fromFile names the variables the file set, missing reports that there was none. The file is optional,
+// deployments usually set the process environment instead.
+func loadEnvFile(filenames ...string) (fromFile map[string]bool, missing bool, err error) {
+	values, err := godotenv.Read(filenames...)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	fromFile = map[string]bool{}
+	for name, value := range values {
+		if _, set := os.LookupEnv(name); set {
+			continue
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return nil, false, err
+		}
+		fromFile[name] = true
+	}
+	return fromFile, false, nil
+}
+
+// newRouter builds the routes and middleware served by main
+func newRouter(server *Server, config Config) http.Handler {
 	r := chi.NewRouter()
+	// Registered before any middleware, chi would otherwise run the middleware twice for them
+	r.NotFound(NotFoundHandler)
+	r.MethodNotAllowed(MethodNotAllowedHandler)
+	r.Use(middleware.RequestID)
+	r.Use(RequestIDHeader)
+	r.Use(requestLogger(os.Getenv("LOG_FORMAT")))
+	r.Use(Compress(COMPRESSION_LEVEL, COMPRESSION_MIN_SIZE))
+	if len(config.AllowedOrigins) > 0 {
+		r.Use(cors.Handler(cors.Options{
+			AllowedOrigins: config.AllowedOrigins,
+			AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodOptions},
+			AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "X-API-Key", "X-Request-Id", IDEMPOTENCY_KEY_HEADER},
+			ExposedHeaders: []string{REQUEST_ID_HEADER, IDEMPOTENT_REPLAYED_HEADER, REQUEST_DEADLINE_HEADER},
+			MaxAge:         300,
+		}))
+	}
+	r.Use(JSONFieldStyle(config.JSONFieldStyle))
+	// Inside JSONFieldStyle so panics are reported in the negotiated style
+	r.Use(Recoverer)
+
+	// Every router gets its own registry so building one per test doesn't register twice
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	metrics := NewMetrics(registry)
+
+	r.Group(func(r chi.Router) {
+		r.Use(metrics.Middleware)
+		r.Use(requestTimeout(config.RequestTimeout))
+		r.Use(NewIPRateLimiter(config.RateLimit, config.RateLimitBurst, config.TrustProxyHeaders).Middleware)
+		if config.GlobalRateLimit > 0 {
+			r.Use(NewGlobalRateLimiter(config.GlobalRateLimit, config.GlobalRateLimitBurst).Middleware)
+		}
+		if len(config.APIKeys) > 0 {
+			r.Use(APIKeyAuth(config.APIKeys))
+		} else {
+			slog.Warn("API_KEYS is empty, presign endpoints are unauthenticated")
+		}
+
+		r.With(server.RequireUploads).Post("/get-upload-url", server.GetUploadURLHandler)
+		r.With(server.RequireUploads).Post("/get-upload-urls", server.GetUploadURLsHandler)
+		r.With(server.RequireUploads, server.RequireS3).Post("/get-upload-post", server.GetUploadPostHandler)
+		r.With(server.RequireUploads).Get("/upload-redirect", server.UploadRedirectHandler)
+		r.With(server.RequireUploads).Post("/refresh-upload-url", server.RefreshUploadURLHandler)
+		r.With(server.RequireS3).Post("/get-download-url", server.GetDownloadURLHandler)
+		r.With(server.RequireS3).Post("/get-delete-url", server.GetDeleteURLHandler)
+		r.With(server.RequireS3).Post("/get-head-url", server.GetHeadURLHandler)
+		r.With(server.RequireUploads, server.RequireS3).Post("/get-copy-url", server.GetCopyURLHandler)
+		r.With(server.RequireS3).Post("/confirm-upload", server.ConfirmUploadHandler)
+		r.With(server.RequireS3).Get("/objects", server.ListObjectsHandler)
+		r.With(server.RequireUploads, server.RequireS3).Post("/multipart/create", server.CreateMultipartUploadHandler)
+		r.With(server.RequireS3).Post("/multipart/part-url", server.MultipartPartURLHandler)
+		r.With(server.RequireS3).Post("/multipart/complete", server.CompleteMultipartUploadHandler)
+		if local, ok := server.Storage.(*LocalBackend); ok {
+			// Downloads from the local backend are not signed, so they take the API key instead
+			r.Get(LOCAL_UPLOAD_PATH+"/*", local.DownloadHandler)
+		}
+	})
+	r.Get("/healthz", server.HealthzHandler)
+	r.Get("/livez", LivezHandler)
+	r.Get("/version", VersionHandler)
+	if local, ok := server.Storage.(*LocalBackend); ok {
+		// Uploads to the local backend carry their own signature, like S3 URLs
+		slog.Warn("STORAGE_BACKEND is local, uploads are stored on this machine", "dir", local.Dir)
+		r.Put(LOCAL_UPLOAD_PATH+"/*", local.UploadHandler)
+	}
+	r.Handle("/metrics", promhttp.InstrumentMetricHandler(registry, promhttp.HandlerFor(registry, promhttp.HandlerOpts{})))
+	return r
+}
+
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+const COMPRESSION_LEVEL = 5
+
+// COMPRESSION_MIN_SIZE is the smallest JSON body worth compressing, gzip grows tiny bodies
+const COMPRESSION_MIN_SIZE = 1024
+
+// Compress gzips JSON responses with middleware.Compress once they reach minSize bytes,
+// smaller responses are sent as they are
+func Compress(level int, minSize int) func(http.Handler) http.Handler {
+	compress := middleware.Compress(level, "application/json")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			compress(http.HandlerFunc(func(compressed http.ResponseWriter, r *http.Request) {
+				tw := &thresholdWriter{ResponseWriter: w, compressed: compressed, minSize: minSize}
+				next.ServeHTTP(tw, r)
+				tw.finish()
+			})).ServeHTTP(w, r)
+		})
+	}
+}
+
+// thresholdWriter holds the status and body back until the body reaches minSize,
+// then sends everything through the compressing writer, or uncompressed when the handler ends first
+type thresholdWriter struct {
+	http.ResponseWriter
+	compressed http.ResponseWriter
+	minSize    int
+	status     int
+	buf        []byte
+	// target is the writer chosen, nil while the body is held back
+	target http.ResponseWriter
+}
+
+func (w *thresholdWriter) WriteHeader(status int) {
+	if w.target != nil {
+		w.target.WriteHeader(status)
+		return
+	}
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *thresholdWriter) Write(p []byte) (int, error) {
+	if w.target != nil {
+		return w.target.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) < w.minSize {
+		return len(p), nil
+	}
+	if _, err := w.send(w.compressed); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// finish sends a body that stayed under minSize as it is
+func (w *thresholdWriter) finish() {
+	if w.target == nil {
+		w.send(w.ResponseWriter)
+	}
+}
+
+func (w *thresholdWriter) send(target http.ResponseWriter) (int, error) {
+	w.target = target
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	target.WriteHeader(w.status)
+	if len(w.buf) == 0 {
+		return 0, nil
+	}
+	n, err := target.Write(w.buf)
+	w.buf = nil
+	return n, err
+}
+
+// run serves until SIGINT or SIGTERM, then lets in-flight requests finish
+func run(httpServer *http.Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("server listening", "addr", httpServer.Addr)
+		serveErr <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("server failed: %w", err)
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down gracefully: %w", err)
+	}
+	return nil
+}
+
+// Logging
+
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// RequestIDHeader echoes the request ID, taken from X-Request-ID or generated by middleware.RequestID
+func RequestIDHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := middleware.GetReqID(r.Context()); id != "" {
+			w.Header().Set(REQUEST_ID_HEADER, id)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// JSON field style
+
+const (
+	JSON_FIELD_STYLE_SNAKE = "snake"
+	JSON_FIELD_STYLE_CAMEL = "camel"
+	// JSON_FIELD_STYLE_PARAM is the Accept parameter that picks the style, as in application/json; field-style=camel
+	JSON_FIELD_STYLE_PARAM = "field-style"
+)
+
+// camelInitialisms are the key words written in capitals, so pre_assigned_url becomes preAssignedURL
+var camelInitialisms = map[string]string{"id": "ID", "url": "URL"}
+
+// styledWriter carries the negotiated field style to SendResponse
+type styledWriter struct {
+	http.ResponseWriter
+	style string
+}
+
+func (w *styledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// JSONFieldStyle picks the key style of JSON responses, the Accept field-style parameter overrides the default
+func JSONFieldStyle(defaultStyle string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			style := defaultStyle
+			for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+				_, params, err := mime.ParseMediaType(accepted)
+				if err != nil {
+					continue
+				}
+				if requested := params[JSON_FIELD_STYLE_PARAM]; requested == JSON_FIELD_STYLE_SNAKE || requested == JSON_FIELD_STYLE_CAMEL {
+					style = requested
+					break
+				}
+			}
+			w.Header().Add("Vary", "Accept")
+			next.ServeHTTP(&styledWriter{ResponseWriter: w, style: style}, r)
+		})
+	}
+}
+
+// responseFieldStyle finds the style JSONFieldStyle chose through the writers wrapping it, snake when there is none
+func responseFieldStyle(w http.ResponseWriter) string {
+	for {
+		switch writer := w.(type) {
+		case *styledWriter:
+			return writer.style
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = writer.Unwrap()
+		default:
+			return JSON_FIELD_STYLE_SNAKE
+		}
+	}
+}
+
+// camelCaseKey turns a snake_case key into camelCase
+func camelCaseKey(key string) string {
+	words := strings.Split(key, "_")
+	for i := 1; i < len(words); i++ {
+		if initialism, ok := camelInitialisms[words[i]]; ok {
+			words[i] = initialism
+		} else if words[i] != "" {
+			words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+		}
+	}
+	return strings.Join(words, "")
+}
+
+// camelCaseKeys rewrites every object key of a decoded JSON value, values are left alone
+func camelCaseKeys(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			converted[camelCaseKey(key)] = camelCaseKeys(item)
+		}
+		return converted
+	case []interface{}:
+		for i, item := range value {
+			value[i] = camelCaseKeys(item)
+		}
+	}
+	return value
+}
+
+// newLogger builds the application logger for LOG_FORMAT "text" (default) or "json"
+func newLogger(format string) *slog.Logger {
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	}
+	return slog.New(slog.NewTextHandler(os.Stdout, nil))
+}
+
+// requestLogger logs every request with chi's text logger or as structured JSON
+func requestLogger(format string) func(http.Handler) http.Handler {
+	if format == "json" {
+		return middleware.RequestLogger(&JSONLogFormatter{Logger: slog.Default()})
+	}
+	return middleware.Logger
+}
+
+// JSONLogFormatter is a chi LogFormatter that writes one slog record per request
+type JSONLogFormatter struct {
+	Logger *slog.Logger
+}
+
+func (f *JSONLogFormatter) NewLogEntry(r *http.Request) middleware.LogEntry {
+	return &jsonLogEntry{
+		logger: f.Logger.With(
+			"request_id", middleware.GetReqID(r.Context()),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr,
+		),
+	}
+}
+
+type jsonLogEntry struct {
+	logger *slog.Logger
+}
+
+func (e *jsonLogEntry) Write(status, bytes int, header http.Header, elapsed time.Duration, extra interface{}) {
+	e.logger.Info("request completed", "status", status, "bytes", bytes, "latency", elapsed.String())
+}
+
+func (e *jsonLogEntry) Panic(v interface{}, stack []byte) {
+	e.logger.Error("request panicked", "panic", fmt.Sprint(v), "stack", string(stack))
+}
+
+// Recoverer turns a handler panic into a JSON 500 and logs the panic with its stack
+func Recoverer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// net/http aborts the response on purpose with this panic
+				panic(v)
+			}
+			slog.Error("request panicked", "request_id", middleware.GetReqID(r.Context()), "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+			SendResponse(w, Error("internal server error", nil), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Server holds the dependencies shared by all handlers
+type Server struct {
+	Config Config
+	S3     S3Client
+	// Storage presigns uploads to the default bucket
+	Storage StorageBackend
+	// Buckets holds the targets selectable through bucket_alias
+	Buckets map[string]BucketTarget
+	// uploadsDisabled is flipped at runtime by a SIGHUP reload of UPLOADS_ENABLED
+	uploadsDisabled atomic.Bool
+	// Webhook is told about every issued upload, nil when WEBHOOK_URL is unset
+	Webhook *Webhook
+	// Clock dates generated keys and signatures
+	Clock Clock
+	// Credentials tracks whether AWS accepts the credentials, nil when the check is off
+	Credentials *CredentialsCheck
+	// Regions holds the one client of each region, shared by the bucket aliases and the region field
+	Regions *RegionClients
+	// Keys names uploads that don't set file_name, timestamps when nil
+	Keys KeyStrategy
+	// Idempotency replays uploads issued for a repeated Idempotency-Key, keys are ignored when nil
+	Idempotency IdempotencyStore
+	// EnvFromFile names the variables main copied from .env, a reload doesn't read their startup value back
+	EnvFromFile map[string]bool
+}
+
+// Clock
+
+// Clock tells the presign service the time, tests swap in a fixed one
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock backed by time.Now
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// clockNow reads the clock, a nil clock is the system clock
+func clockNow(clock Clock) time.Time {
+	if clock == nil {
+		return time.Now()
+	}
+	return clock.Now()
+}
+
+// Config
+
+const DEFAULT_MAX_UPLOAD_SIZE int64 = 1 * 1024 * 1024 // 1 MB
+
+const DEFAULT_MIN_UPLOAD_SIZE int64 = 1
+
+const DEFAULT_LISTEN_ADDR = ":3000"
+
+const DEFAULT_MIN_EXPIRATION_SECONDS = 60
+
+const DEFAULT_RATE_LIMIT = 5.0
+
+const DEFAULT_REQUEST_TIMEOUT_SECONDS = 30
+
+const DEFAULT_ROLE_SESSION_NAME = "signed-urls-go"
+
+const DEFAULT_RATE_LIMIT_BURST = 10
+
+// Config is read once at startup from the environment
+type Config struct {
+	ListenAddr string
+	// StorageBackend is "s3" or "local", local keeps uploads on disk for development
+	StorageBackend  string
+	LocalStorageDir string
+	LocalBaseURL    string
+	Region          string
+	Bucket          string
+	// RoleARN, when set, is assumed through STS for every presign
+	RoleARN         string
+	RoleSessionName string
+	// Profile selects a shared config profile, SharedConfigFiles replaces ~/.aws/config and ~/.aws/credentials
+	Profile           string
+	SharedConfigFiles []string
+	// CredentialsProvider is set in code rather than the environment, it replaces the role and the default chain
+	CredentialsProvider CredentialsProviderFactory
+	// SignatureVersion is v4 or v2 for legacy S3-compatible stores. SigV2 has no
+	// seven day cap of its own, MAX_EXPIRATION still bounds every URL
+	SignatureVersion string
+	// Endpoint and ForcePathStyle target S3-compatible stores instead of AWS
+	Endpoint       string
+	ForcePathStyle bool
+	KeyPrefix      string
+	// KeyStrategy names generated keys: timestamp, uuid or hash
+	KeyStrategy string
+	// KeyTimeLayout is the time.Format layout of names the timestamp strategy generates
+	KeyTimeLayout string
+	// MinUploadSize is the smallest upload accepted, POST policies enforce it through content-length-range
+	MinUploadSize int64
+	MaxUploadSize int64
+	// MaxUploadSizes overrides MaxUploadSize per lowercase content type
+	MaxUploadSizes map[string]int64
+	MinExpiration  time.Duration
+	MaxBatchSize   int
+	// MaxBatchBytes caps the summed content_length of a batch, no cap when zero
+	MaxBatchBytes int64
+	MaxBodySize   int64
+	// MaxURLLength is the URL length over which responses carry a warning, no warning when zero
+	MaxURLLength int
+	// MaxRetries bounds the retries of transient AWS failures
+	MaxRetries int
+	// RequestTimeout caps how long a presign request may spend, AWS calls included
+	RequestTimeout time.Duration
+	// CredentialsCheckInterval is how often STS validates the credentials, never when zero
+	CredentialsCheckInterval time.Duration
+	// RateLimit is the sustained presign requests per second allowed per client IP
+	RateLimit      float64
+	RateLimitBurst int
+	// GlobalRateLimit caps presign requests per second across all clients, off when zero
+	GlobalRateLimit      float64
+	GlobalRateLimitBurst int
+	TrustProxyHeaders    bool
+	// UploadsEnabled turns off new uploads while downloads keep working
+	UploadsEnabled bool
+	// AllowedContentTypes is the set of content types uploads may use
+	AllowedContentTypes map[string]bool
+	// AllowedExtensions restricts upload keys to these lowercase extensions such as .png, any extension when empty
+	AllowedExtensions map[string]bool
+	// StrictContentType rejects uploads whose content type differs from the one their extension implies
+	StrictContentType bool
+	// JSONFieldStyle is the key style of JSON responses, snake or camel, clients can ask for the other through Accept
+	JSONFieldStyle string
+	// AllowedOrigins lists the browser origins allowed to call the API, none when empty
+	AllowedOrigins []string
+	// APIKeys authenticate presign requests, authentication is off when empty
+	APIKeys []string
+	// ObjectBaseURL builds ObjectUrl for objects served through a CDN, S3 addresses them when empty
+	ObjectBaseURL string
+	// DefaultACL is the canned ACL applied to uploads that don't request one
+	DefaultACL string
+	// DefaultCacheControl is the Cache-Control stored on uploads that don't set one
+	DefaultCacheControl string
+	// DefaultStorageClass is the storage class of uploads that don't request one
+	DefaultStorageClass string
+	// IdempotencyTTL is how long an Idempotency-Key replays its upload, never past the URL expiry
+	IdempotencyTTL time.Duration
+	// DefaultObjectExpiry dates the Expires header of uploads that don't set expires_at, none when zero
+	DefaultObjectExpiry time.Duration
+	// Buckets maps the aliases requests may select to buckets other than the default
+	Buckets map[string]BucketConfig
+	// WebhookURL receives a POST for every issued upload, no notifications when empty
+	WebhookURL string
+	// AllowedRegions are the regions requests may presign in through the region field, none when empty,
+	// mapped to the bucket given as region=bucket
+	AllowedRegions map[string]string
+	// RegionBuckets is the bucket each allowed region presigns against, AWS_REGION is absent unless mapped
+	RegionBuckets map[string]BucketConfig
+	// AllowedBuckets is the set of buckets presigning may target, AWS_BUCKET and the BUCKETS entries when empty
+	AllowedBuckets map[string]bool
+}
+
+// BucketConfig is one entry of the BUCKETS JSON object, region and prefix are optional
+type BucketConfig struct {
+	Bucket        string `json:"bucket"`
+	Region        string `json:"region"`
+	Prefix        string `json:"prefix"`
+	ObjectBaseURL string `json:"object_base_url"`
+}
+
+// loadConfig reads the configuration and reports every problem at once
+func loadConfig() (Config, error) {
+	config := Config{
+		StorageBackend:           os.Getenv("STORAGE_BACKEND"),
+		LocalStorageDir:          os.Getenv("LOCAL_STORAGE_DIR"),
+		LocalBaseURL:             strings.TrimRight(os.Getenv("LOCAL_BASE_URL"), "/"),
+		Region:                   os.Getenv("AWS_REGION"),
+		Bucket:                   os.Getenv("AWS_BUCKET"),
+		RoleARN:                  os.Getenv("AWS_ROLE_ARN"),
+		RoleSessionName:          os.Getenv("AWS_ROLE_SESSION_NAME"),
+		Profile:                  os.Getenv("AWS_PROFILE"),
+		SharedConfigFiles:        parseList(os.Getenv("AWS_SHARED_CONFIG_FILES")),
+		SignatureVersion:         os.Getenv("AWS_SIGNATURE_VERSION"),
+		Endpoint:                 os.Getenv("AWS_ENDPOINT"),
+		ForcePathStyle:           os.Getenv("AWS_S3_FORCE_PATH_STYLE") == "true",
+		KeyPrefix:                normalizePrefix(os.Getenv("AWS_KEY_PREFIX")),
+		KeyStrategy:              os.Getenv("KEY_STRATEGY"),
+		KeyTimeLayout:            os.Getenv("KEY_TIME_LAYOUT"),
+		MinUploadSize:            loadPositiveInt("MIN_UPLOAD_SIZE_BYTES", DEFAULT_MIN_UPLOAD_SIZE),
+		MaxUploadSize:            loadPositiveInt("MAX_UPLOAD_SIZE_BYTES", DEFAULT_MAX_UPLOAD_SIZE),
+		MaxBatchSize:             int(loadPositiveInt("MAX_BATCH_SIZE", DEFAULT_MAX_BATCH_SIZE)),
+		MaxBatchBytes:            loadPositiveInt("MAX_BATCH_BYTES", 0),
+		MaxURLLength:             int(loadNonNegativeInt("MAX_URL_LENGTH", DEFAULT_MAX_URL_LENGTH)),
+		MaxBodySize:              loadPositiveInt("MAX_BODY_SIZE_BYTES", DEFAULT_MAX_BODY_SIZE),
+		MaxRetries:               int(loadNonNegativeInt("AWS_MAX_RETRIES", DEFAULT_MAX_RETRIES)),
+		RequestTimeout:           time.Duration(loadPositiveInt("REQUEST_TIMEOUT_SECONDS", DEFAULT_REQUEST_TIMEOUT_SECONDS)) * time.Second,
+		CredentialsCheckInterval: time.Duration(loadPositiveInt("CREDENTIALS_CHECK_INTERVAL_SECONDS", 0)) * time.Second,
+		RateLimit:                loadPositiveFloat("RATE_LIMIT_PER_SECOND", DEFAULT_RATE_LIMIT),
+		RateLimitBurst:           int(loadPositiveInt("RATE_LIMIT_BURST", DEFAULT_RATE_LIMIT_BURST)),
+		GlobalRateLimit:          loadPositiveFloat("GLOBAL_RATE_LIMIT_PER_SECOND", 0),
+		GlobalRateLimitBurst:     int(loadPositiveInt("GLOBAL_RATE_LIMIT_BURST", DEFAULT_RATE_LIMIT_BURST)),
+		TrustProxyHeaders:        os.Getenv("TRUST_PROXY_HEADERS") == "true",
+		MinExpiration:            time.Duration(loadPositiveInt("MIN_EXPIRES_IN_SECONDS", DEFAULT_MIN_EXPIRATION_SECONDS)) * time.Second,
+		AllowedContentTypes:      parseSet(os.Getenv("ALLOWED_CONTENT_TYPES"), DEFAULT_CONTENT_TYPE),
+		AllowedExtensions:        parseExtensions(os.Getenv("ALLOWED_EXTENSIONS")),
+		StrictContentType:        os.Getenv("STRICT_CONTENT_TYPE") == "true",
+		AllowedOrigins:           parseList(os.Getenv("ALLOWED_ORIGINS")),
+		JSONFieldStyle:           os.Getenv("JSON_FIELD_STYLE"),
+		APIKeys:                  parseList(os.Getenv("API_KEYS")),
+		DefaultACL:               os.Getenv("AWS_DEFAULT_ACL"),
+		DefaultCacheControl:      os.Getenv("AWS_DEFAULT_CACHE_CONTROL"),
+		DefaultStorageClass:      os.Getenv("AWS_DEFAULT_STORAGE_CLASS"),
+		IdempotencyTTL:           time.Duration(loadPositiveInt("IDEMPOTENCY_TTL_SECONDS", DEFAULT_IDEMPOTENCY_TTL_SECONDS)) * time.Second,
+		DefaultObjectExpiry:      time.Duration(loadPositiveInt("OBJECT_EXPIRES_AFTER_DAYS", 0)) * 24 * time.Hour,
+		ObjectBaseURL:            strings.TrimRight(os.Getenv("OBJECT_BASE_URL"), "/"),
+		WebhookURL:               os.Getenv("WEBHOOK_URL"),
+		AllowedRegions:           parseAllowedRegions(os.Getenv("ALLOWED_REGIONS")),
+	}
+
+	if config.KeyTimeLayout == "" {
+		config.KeyTimeLayout = DEFAULT_KEY_TIME_LAYOUT
+	}
+	if config.RoleSessionName == "" {
+		config.RoleSessionName = DEFAULT_ROLE_SESSION_NAME
+	}
+
+	var problems []string
+	switch config.StorageBackend {
+	case "":
+		config.StorageBackend = STORAGE_BACKEND_S3
+	case STORAGE_BACKEND_S3, STORAGE_BACKEND_LOCAL:
+	default:
+		problems = append(problems, fmt.Sprintf("invalid STORAGE_BACKEND %q, expected %q or %q", config.StorageBackend, STORAGE_BACKEND_S3, STORAGE_BACKEND_LOCAL))
+	}
+	switch config.SignatureVersion {
+	case "":
+		config.SignatureVersion = SIGNATURE_VERSION_4
+	case SIGNATURE_VERSION_4, SIGNATURE_VERSION_2:
+	default:
+		problems = append(problems, fmt.Sprintf("invalid AWS_SIGNATURE_VERSION %q, expected %q or %q", config.SignatureVersion, SIGNATURE_VERSION_4, SIGNATURE_VERSION_2))
+	}
+	if config.LocalStorageDir == "" {
+		config.LocalStorageDir = DEFAULT_LOCAL_STORAGE_DIR
+	}
+
+	regionVar := "AWS_REGION"
+	if config.Region == "" {
+		config.Region = os.Getenv("DEFAULT_AWS_REGION")
+		regionVar = "DEFAULT_AWS_REGION"
+	}
+	var missing []string
+	// The local backend is meant to run without an AWS account
+	if config.Region == "" && config.StorageBackend != STORAGE_BACKEND_LOCAL {
+		missing = append(missing, "AWS_REGION (or DEFAULT_AWS_REGION)")
+	}
+	if err := validateRegion(config.Region, config.Endpoint); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid %s: %s", regionVar, err))
+	}
+	for region := range config.AllowedRegions {
+		if err := validateRegion(region, config.Endpoint); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid ALLOWED_REGIONS entry: %s", err))
+		}
+	}
+	if config.Bucket == "" && config.StorageBackend != STORAGE_BACKEND_LOCAL {
+		missing = append(missing, "AWS_BUCKET")
+	}
+	if len(missing) > 0 {
+		problems = append(problems, fmt.Sprintf("missing required environment variables: %s", strings.Join(missing, ", ")))
+	}
+
+	uploadsEnabled, err := parseUploadsEnabled(os.Getenv("UPLOADS_ENABLED"))
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	config.UploadsEnabled = uploadsEnabled
+
+	switch config.JSONFieldStyle {
+	case "":
+		config.JSONFieldStyle = JSON_FIELD_STYLE_SNAKE
+	case JSON_FIELD_STYLE_SNAKE, JSON_FIELD_STYLE_CAMEL:
+	default:
+		problems = append(problems, fmt.Sprintf("invalid JSON_FIELD_STYLE %q, must be %s or %s", config.JSONFieldStyle, JSON_FIELD_STYLE_SNAKE, JSON_FIELD_STYLE_CAMEL))
+	}
+	if err := validateACL(config.DefaultACL); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid AWS_DEFAULT_ACL: %s", err))
+	}
+	if err := validateCacheControl(config.DefaultCacheControl); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid AWS_DEFAULT_CACHE_CONTROL: %s", err))
+	}
+	if err := validateStorageClass(config.DefaultStorageClass); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid AWS_DEFAULT_STORAGE_CLASS: %s", err))
+	}
+
+	switch config.KeyStrategy {
+	case "":
+		config.KeyStrategy = KEY_STRATEGY_TIMESTAMP
+	case KEY_STRATEGY_TIMESTAMP, KEY_STRATEGY_UUID, KEY_STRATEGY_HASH:
+	default:
+		problems = append(problems, fmt.Sprintf("invalid KEY_STRATEGY %q, must be %s, %s or %s", config.KeyStrategy, KEY_STRATEGY_TIMESTAMP, KEY_STRATEGY_UUID, KEY_STRATEGY_HASH))
+	}
+	if _, err := sanitizeKey(generateFileName(config.KeyTimeLayout, time.Now(), DEFAULT_CONTENT_TYPE)); err != nil && config.KeyStrategy == KEY_STRATEGY_TIMESTAMP {
+		problems = append(problems, fmt.Sprintf("invalid KEY_TIME_LAYOUT %q: %s", config.KeyTimeLayout, err))
+	}
+
+	maxUploadSizes, err := parseMaxUploadSizes(os.Getenv("MAX_UPLOAD_SIZES"))
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	config.MaxUploadSizes = maxUploadSizes
+	if config.MinUploadSize > config.MaxUploadSize {
+		problems = append(problems, fmt.Sprintf("MIN_UPLOAD_SIZE_BYTES %d is larger than MAX_UPLOAD_SIZE_BYTES %d", config.MinUploadSize, config.MaxUploadSize))
+	}
+	for contentType, size := range maxUploadSizes {
+		if config.MinUploadSize > size {
+			problems = append(problems, fmt.Sprintf("MIN_UPLOAD_SIZE_BYTES %d is larger than the MAX_UPLOAD_SIZES limit for %s", config.MinUploadSize, contentType))
+		}
+	}
+
+	if config.ObjectBaseURL != "" {
+		if u, err := url.Parse(config.ObjectBaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("invalid OBJECT_BASE_URL %q, expected an absolute URL", config.ObjectBaseURL))
+		}
+	}
+
+	if config.WebhookURL != "" {
+		if u, err := url.Parse(config.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("invalid WEBHOOK_URL %q, expected an http or https URL", config.WebhookURL))
+		}
+	}
+
+	buckets, err := parseBuckets(os.Getenv("BUCKETS"), config.Region)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	for alias, bucket := range buckets {
+		if err := validateRegion(bucket.Region, config.Endpoint); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid region for BUCKETS alias %q: %s", alias, err))
+		}
+	}
+	config.Buckets = buckets
+
+	regionBuckets, regionProblems := resolveRegionBuckets(config)
+	problems = append(problems, regionProblems...)
+	config.RegionBuckets = regionBuckets
+
+	config.AllowedBuckets = map[string]bool{}
+	for _, bucket := range parseList(os.Getenv("ALLOWED_BUCKETS")) {
+		config.AllowedBuckets[bucket] = true
+	}
+	if len(config.AllowedBuckets) == 0 {
+		config.AllowedBuckets[config.Bucket] = true
+		for _, bucket := range buckets {
+			config.AllowedBuckets[bucket.Bucket] = true
+		}
+		for _, bucket := range regionBuckets {
+			config.AllowedBuckets[bucket.Bucket] = true
+		}
+	}
+	for alias, bucket := range buckets {
+		if !config.AllowedBuckets[bucket.Bucket] {
+			problems = append(problems, fmt.Sprintf("BUCKETS alias %q targets bucket %q, which is not in ALLOWED_BUCKETS", alias, bucket.Bucket))
+		}
+	}
+	for region, bucket := range regionBuckets {
+		if !config.AllowedBuckets[bucket.Bucket] {
+			problems = append(problems, fmt.Sprintf("ALLOWED_REGIONS entry %q targets bucket %q, which is not in ALLOWED_BUCKETS", region, bucket.Bucket))
+		}
+	}
+
+	listenAddr, err := resolveListenAddr(os.Getenv("LISTEN_ADDR"), os.Getenv("PORT"))
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	config.ListenAddr = listenAddr
+	if config.LocalBaseURL == "" && err == nil {
+		config.LocalBaseURL = localBaseURL(listenAddr)
+	}
+
+	if len(problems) > 0 {
+		return config, errors.New(strings.Join(problems, "; "))
+	}
+	return config, nil
+}
+
+// parseMaxUploadSizes decodes the MAX_UPLOAD_SIZES JSON object of content type to bytes
+func parseMaxUploadSizes(value string) (map[string]int64, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var sizes map[string]int64
+	if err := json.Unmarshal([]byte(value), &sizes); err != nil {
+		return nil, fmt.Errorf("MAX_UPLOAD_SIZES must be a JSON object of content types to bytes: %w", err)
+	}
+	normalized := make(map[string]int64, len(sizes))
+	for contentType, size := range sizes {
+		if size <= 0 {
+			return nil, fmt.Errorf("MAX_UPLOAD_SIZES entry %q must be a positive number of bytes", contentType)
+		}
+		normalized[strings.ToLower(contentType)] = size
+	}
+	return normalized, nil
+}
+
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+
+// validateRegion checks the shape of an AWS region such as eu-central-1,
+// S3-compatible stores behind an endpoint name their regions freely
+func validateRegion(region string, endpoint string) error {
+	if endpoint != "" || region == "" || regionPattern.MatchString(region) {
+		return nil
+	}
+	return fmt.Errorf("%q is not an AWS region, expected a name like eu-central-1", region)
+}
+
+// parseBuckets decodes the BUCKETS alias map, filling in the default region
+func parseBuckets(value string, defaultRegion string) (map[string]BucketConfig, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var buckets map[string]BucketConfig
+	if err := json.Unmarshal([]byte(value), &buckets); err != nil {
+		return nil, fmt.Errorf("BUCKETS must be a JSON object of aliases: %w", err)
+	}
+	for alias, bucket := range buckets {
+		if alias == "" || bucket.Bucket == "" {
+			return nil, fmt.Errorf("BUCKETS entry %q needs an alias and a bucket", alias)
+		}
+		if bucket.Region == "" {
+			bucket.Region = defaultRegion
+		}
+		bucket.Prefix = normalizePrefix(bucket.Prefix)
+		bucket.ObjectBaseURL = strings.TrimRight(bucket.ObjectBaseURL, "/")
+		buckets[alias] = bucket
+	}
+	return buckets, nil
+}
+
+// parseAllowedRegions reads the ALLOWED_REGIONS entries, a region or region=bucket, into the bucket of each region
+func parseAllowedRegions(value string) map[string]string {
+	regions := map[string]string{}
+	for _, item := range parseList(value) {
+		region, bucket, _ := strings.Cut(item, "=")
+		regions[strings.ToLower(strings.TrimSpace(region))] = strings.TrimSpace(bucket)
+	}
+	return regions
+}
+
+// resolveRegionBuckets picks the bucket of each allowed region, the ALLOWED_REGIONS mapping or else the first
+// BUCKETS alias in that region. A bucket lives in one region, so the other regions' endpoints would not find AWS_BUCKET.
+func resolveRegionBuckets(config Config) (map[string]BucketConfig, []string) {
+	regions := make([]string, 0, len(config.AllowedRegions))
+	for region := range config.AllowedRegions {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	aliases := make([]string, 0, len(config.Buckets))
+	for alias := range config.Buckets {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+
+	buckets := map[string]BucketConfig{}
+	var problems []string
+	for _, region := range regions {
+		if bucket := config.AllowedRegions[region]; bucket != "" {
+			buckets[region] = BucketConfig{Bucket: bucket, Region: region, Prefix: config.KeyPrefix}
+			continue
+		}
+		if region == config.Region {
+			continue
+		}
+		found := false
+		for _, alias := range aliases {
+			if bucket := config.Buckets[alias]; bucket.Region == region {
+				buckets[region] = bucket
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("ALLOWED_REGIONS entry %q has no bucket, write it as %s=<bucket> or add a BUCKETS entry in that region", region, region))
+		}
+	}
+	return buckets, problems
+}
+
+// localBaseURL addresses this server from the same machine
+func localBaseURL(listenAddr string) string {
+	host, port, _ := net.SplitHostPort(listenAddr)
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// resolveListenAddr prefers LISTEN_ADDR, then PORT, then the default address
+func resolveListenAddr(listenAddr string, port string) (string, error) {
+	addr := DEFAULT_LISTEN_ADDR
+	if listenAddr != "" {
+		addr = listenAddr
+	} else if port != "" {
+		addr = ":" + port
+	}
+
+	_, portPart, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	portNumber, err := strconv.Atoi(portPart)
+	if err != nil || portNumber < 0 || portNumber > 65535 {
+		return "", fmt.Errorf("invalid listen port %q", portPart)
+	}
+	return addr, nil
+}
+
+// parseList splits a comma separated list, dropping empty items
+func parseList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseSet splits a comma separated list into a lowercase set, using fallback when it is empty
+func parseSet(value string, fallback ...string) map[string]bool {
+	set := map[string]bool{}
+	for _, item := range parseList(value) {
+		set[strings.ToLower(item)] = true
+	}
+	if len(set) == 0 {
+		for _, item := range fallback {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// parseExtensions reads a comma separated list of extensions into a set of lowercase extensions with their dot
+func parseExtensions(value string) map[string]bool {
+	set := map[string]bool{}
+	for extension := range parseSet(value) {
+		set["."+strings.TrimPrefix(extension, ".")] = true
+	}
+	return set
+}
+
+// loadPositiveInt reads a positive integer variable, falling back when it is unset or invalid
+func loadPositiveInt(name string, fallback int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number <= 0 {
+		slog.Warn("invalid "+name+", using default", "value", value, "default", fallback)
+		return fallback
+	}
+	return number
+}
+
+// loadNonNegativeInt reads an integer variable for which zero is meaningful, such as no retries
+func loadNonNegativeInt(name string, fallback int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number < 0 {
+		slog.Warn("invalid "+name+", using default", "value", value, "default", fallback)
+		return fallback
+	}
+	return number
+}
+
+// loadPositiveFloat reads a positive number variable, falling back when it is unset or invalid
+func loadPositiveFloat(name string, fallback float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number <= 0 {
+		slog.Warn("invalid "+name+", using default", "value", value, "default", fallback)
+		return fallback
+	}
+	return number
+}
+
+// Retries
+
+const DEFAULT_MAX_RETRIES = 3
+
+const RETRY_BASE_DELAY = 100 * time.Millisecond
+
+// isRetryable reports whether an AWS error is throttling or a transient failure worth another attempt
+func isRetryable(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	if request.IsErrorThrottle(aerr) || request.IsErrorRetryable(aerr) {
+		return true
+	}
+	var failure awserr.RequestFailure
+	return errors.As(err, &failure) && failure.StatusCode() >= http.StatusInternalServerError
+}
+
+// withRetry calls fn until it succeeds, fails permanently or runs out of retries,
+// doubling the delay after every attempt
+func withRetry(ctx context.Context, maxRetries int, fn func() error) error {
+	delay := RETRY_BASE_DELAY
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= maxRetries || !isRetryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// retryingProvider retries credential lookups such as the STS AssumeRole call
+type retryingProvider struct {
+	credentials.Provider
+	maxRetries int
+}
+
+func (p *retryingProvider) Retrieve() (credentials.Value, error) {
+	return p.RetrieveWithContext(context.Background())
+}
+
+func (p *retryingProvider) RetrieveWithContext(ctx credentials.Context) (credentials.Value, error) {
+	var value credentials.Value
+	err := withRetry(ctx, p.maxRetries, func() (err error) {
+		if provider, ok := p.Provider.(credentials.ProviderWithContext); ok {
+			value, err = provider.RetrieveWithContext(ctx)
+		} else {
+			value, err = p.Provider.Retrieve()
+		}
+		return err
+	})
+	return value, err
+}
+
+// Credentials check
+
+// IdentityClient is the part of STS the credentials check needs
+type IdentityClient interface {
+	GetCallerIdentityWithContext(aws.Context, *sts.GetCallerIdentityInput, ...request.Option) (*sts.GetCallerIdentityOutput, error)
+}
+
+// newIdentityClient builds an STS client that signs with the S3 client's credentials
+func newIdentityClient(svc *s3.S3) IdentityClient {
+	return sts.New(session.Must(session.NewSession()), &aws.Config{
+		Region:      svc.Config.Region,
+		Credentials: svc.Config.Credentials,
+		MaxRetries:  aws.Int(0),
+		// Stay in the region the S3 client signs for
+		STSRegionalEndpoint: endpoints.RegionalSTSEndpoint,
+	})
+}
+
+// CredentialsStatus is the outcome of the last credentials check
+type CredentialsStatus struct {
+	Valid     bool      `json:"valid"`
+	CheckedAt time.Time `json:"checked_at"`
+	Account   string    `json:"account,omitempty"`
+	// Error stays in the logs, AWS errors name the account and the principal
+	Error string `json:"-"`
+}
+
+// CredentialsCheck asks STS who the credentials belong to, presigning signs happily with expired ones
+type CredentialsCheck struct {
+	Client     IdentityClient
+	MaxRetries int
+
+	mu     sync.Mutex
+	status CredentialsStatus
+}
+
+// Run checks right away and then on every interval until ctx is done
+func (c *CredentialsCheck) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check validates the credentials once and records the outcome
+func (c *CredentialsCheck) Check(ctx context.Context) CredentialsStatus {
+	ctx, cancel := context.WithTimeout(ctx, HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+
+	var out *sts.GetCallerIdentityOutput
+	err := withRetry(ctx, c.MaxRetries, func() (err error) {
+		out, err = c.Client.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+		return err
+	})
+	status := CredentialsStatus{Valid: err == nil, CheckedAt: time.Now()}
+	if err != nil {
+		status.Error = err.Error()
+		slog.Warn("AWS credentials check failed, presigned URLs will be rejected by S3", "error", err)
+	} else {
+		status.Account = aws.StringValue(out.Account)
+	}
+
+	c.mu.Lock()
+	c.status = status
+	c.mu.Unlock()
+	return status
+}
+
+// Status is the last recorded outcome, invalid until the first check finishes
+func (c *CredentialsCheck) Status() CredentialsStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// Upload switch
+
+func (s *Server) setUploadsEnabled(enabled bool) {
+	s.uploadsDisabled.Store(!enabled)
+}
+
+// parseUploadsEnabled reads UPLOADS_ENABLED, on when unset. It is a maintenance kill switch,
+// so a value that isn't a boolean is an error rather than leaving uploads on.
+func parseUploadsEnabled(value string) (bool, error) {
+	if value == "" {
+		return true, nil
+	}
+	enabled, err := strconv.ParseBool(strings.ToLower(value))
+	if err != nil {
+		return true, fmt.Errorf("invalid UPLOADS_ENABLED %q, expected true or false", value)
+	}
+	return enabled, nil
+}
+
+// reloadOnSIGHUP re-reads UPLOADS_ENABLED from the .env file on every SIGHUP
+func (s *Server) reloadOnSIGHUP() {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	for range reload {
+		values, err := godotenv.Read()
+		if err != nil {
+			// The environment still applies without a readable .env file
+			slog.Warn("failed to reload .env file", "error", err)
+		}
+		s.reloadUploadsEnabled(values)
+	}
+}
+
+// reloadUploadsEnabled applies UPLOADS_ENABLED from the reloaded .env values, then from the
+// environment, and keeps the current setting when neither sets it
+func (s *Server) reloadUploadsEnabled(values map[string]string) {
+	value := values["UPLOADS_ENABLED"]
+	// A variable copied from .env at startup is only the file's old line, deleting it must not bring it back
+	if value == "" && !s.EnvFromFile["UPLOADS_ENABLED"] {
+		value = os.Getenv("UPLOADS_ENABLED")
+	}
+	if value == "" {
+		slog.Info("UPLOADS_ENABLED is unset, keeping the current setting", "uploads_enabled", !s.uploadsDisabled.Load())
+		return
+	}
+	enabled, err := parseUploadsEnabled(value)
+	if err != nil {
+		slog.Error("ignoring UPLOADS_ENABLED, keeping the current setting", "error", err, "uploads_enabled", !s.uploadsDisabled.Load())
+		return
+	}
+	s.setUploadsEnabled(enabled)
+	slog.Info("reloaded configuration", "uploads_enabled", enabled)
+}
+
+// RequireUploads answers 503 on upload routes while uploads are disabled
+func (s *Server) RequireUploads(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.uploadsDisabled.Load() {
+			SendResponse(w, Error("uploads are temporarily disabled for maintenance", nil), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireS3 answers 501 on routes only S3 can serve, such as downloads and listings, while STORAGE_BACKEND is local
+func (s *Server) RequireS3(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, local := s.Storage.(*LocalBackend); local {
+			SendRequestError(w, &RequestError{Status: http.StatusNotImplemented, Message: "this route requires STORAGE_BACKEND=s3, the local backend only serves uploads"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Tracing
+
+const TRACER_NAME = "signed-urls-go"
+
+var tracer = otel.Tracer(TRACER_NAME)
+
+// initTracing exports spans over OTLP once an OTEL_EXPORTER_OTLP endpoint is set,
+// the exporter reads the remaining standard OTEL_* variables itself
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the default service name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", TRACER_NAME)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// endSpan records the outcome of a traced operation and ends its span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, PresignErrorMessage(err))
+		span.SetAttributes(attribute.String("presign.outcome", "error"))
+	} else {
+		span.SetAttributes(attribute.String("presign.outcome", "success"))
+	}
+	span.End()
+}
+
+// Request timeout
+
+// REQUEST_DEADLINE_HEADER tells clients when the server gives up on the request
+const REQUEST_DEADLINE_HEADER = "X-Request-Deadline"
+
+// requestTimeout bounds the request context, canceling AWS calls that outlive it
+func requestTimeout(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			deadline, _ := ctx.Deadline()
+			w.Header().Set(REQUEST_DEADLINE_HEADER, deadline.UTC().Format(time.RFC3339Nano))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Idempotency
+
+const (
+	IDEMPOTENCY_KEY_HEADER          = "Idempotency-Key"
+	IDEMPOTENT_REPLAYED_HEADER      = "Idempotent-Replayed"
+	MAX_IDEMPOTENCY_KEY_LENGTH      = 255
+	DEFAULT_IDEMPOTENCY_TTL_SECONDS = 24 * 60 * 60
+	IDEMPOTENCY_CLEANUP_INTERVAL    = time.Minute
+)
+
+// IdempotentUpload is an issued upload kept for replay, Fingerprint identifies the request that issued it
+type IdempotentUpload struct {
+	Fingerprint string
+	Result      PresignResult
+	ExpiresAt   time.Time
+}
+
+// IdempotencyStore keeps issued uploads by idempotency key, a shared store lets several instances replay them
+type IdempotencyStore interface {
+	Get(key string) (IdempotentUpload, bool)
+	// Add stores the upload unless the key already holds one, and returns the upload the key holds
+	Add(key string, upload IdempotentUpload) IdempotentUpload
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore local to the process
+type MemoryIdempotencyStore struct {
+	// Clock must be the server's, upload expiry times come from it
+	Clock       Clock
+	mu          sync.Mutex
+	uploads     map[string]IdempotentUpload
+	lastCleanup time.Time
+}
+
+func NewMemoryIdempotencyStore(clock Clock) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{Clock: clock, uploads: map[string]IdempotentUpload{}, lastCleanup: clockNow(clock)}
+}
+
+func (m *MemoryIdempotencyStore) Get(key string) (IdempotentUpload, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := clockNow(m.Clock)
+	m.evictExpired(now)
+	upload, ok := m.uploads[key]
+	if !ok || !now.Before(upload.ExpiresAt) {
+		return IdempotentUpload{}, false
+	}
+	return upload, true
+}
+
+func (m *MemoryIdempotencyStore) Add(key string, upload IdempotentUpload) IdempotentUpload {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := clockNow(m.Clock)
+	m.evictExpired(now)
+	// A concurrent retry may have issued the upload first, every caller then gets that one
+	if existing, ok := m.uploads[key]; ok && now.Before(existing.ExpiresAt) {
+		return existing
+	}
+	m.uploads[key] = upload
+	return upload
+}
+
+// evictExpired drops expired uploads at most once per cleanup interval, Get skips the ones still kept
+func (m *MemoryIdempotencyStore) evictExpired(now time.Time) {
+	if now.Sub(m.lastCleanup) <= IDEMPOTENCY_CLEANUP_INTERVAL {
+		return
+	}
+	for key, upload := range m.uploads {
+		if !now.Before(upload.ExpiresAt) {
+			delete(m.uploads, key)
+		}
+	}
+	m.lastCleanup = now
+}
+
+// idempotencyKey scopes the Idempotency-Key of a request to the API key that sent it, empty when the header is absent
+func idempotencyKey(r *http.Request) (string, *RequestError) {
+	key := r.Header.Get(IDEMPOTENCY_KEY_HEADER)
+	if key == "" {
+		return "", nil
+	}
+	if len(key) > MAX_IDEMPOTENCY_KEY_LENGTH {
+		return "", BadRequest(fmt.Sprintf("%s is longer than %d bytes", IDEMPOTENCY_KEY_HEADER, MAX_IDEMPOTENCY_KEY_LENGTH), nil)
+	}
+	digest := sha256.Sum256([]byte(requestAPIKey(r) + "\x00" + key))
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// requestFingerprint tells apart requests that reuse an idempotency key with a different body
+func requestFingerprint(body interface{}, query url.Values) string {
+	encoded, _ := json.Marshal(body)
+	digest := sha256.Sum256(append(encoded, query.Encode()...))
+	return hex.EncodeToString(digest[:])
+}
+
+// replayUpload returns the upload issued earlier for the key, a 422 when the key came with another request
+func (s *Server) replayUpload(key string, fingerprint string) (PresignResult, bool, *RequestError) {
+	upload, ok := s.Idempotency.Get(key)
+	if !ok {
+		return PresignResult{}, false, nil
+	}
+	if upload.Fingerprint != fingerprint {
+		return PresignResult{}, false, &RequestError{
+			Status:  http.StatusUnprocessableEntity,
+			Message: fmt.Sprintf("%s was already used with a different request", IDEMPOTENCY_KEY_HEADER),
+			Code:    ERROR_CODE_IDEMPOTENCY_KEY_REUSED,
+		}
+	}
+	return upload.Result, true, nil
+}
+
+// rememberUpload keeps an issued upload for its key until the TTL or the URL expiry, whichever comes first
+func (s *Server) rememberUpload(key string, fingerprint string, result PresignResult) PresignResult {
+	expiresAt := clockNow(s.Clock).Add(s.Config.IdempotencyTTL)
+	if result.ExpirationTime.Before(expiresAt) {
+		expiresAt = result.ExpirationTime
+	}
+	upload := s.Idempotency.Add(key, IdempotentUpload{Fingerprint: fingerprint, Result: result, ExpiresAt: expiresAt})
+	return upload.Result
+}
+
+// Webhook
+
+const WEBHOOK_TIMEOUT = 5 * time.Second // per attempt
+
+const WEBHOOK_MAX_RETRIES = 2
+
+const EVENT_UPLOAD_ISSUED = "upload_issued"
+
+// UploadIssuedEvent is the payload posted to WEBHOOK_URL
+type UploadIssuedEvent struct {
+	Event          string    `json:"event"`
+	FileName       string    `json:"file_name"`
+	Bucket         string    `json:"bucket"`
+	ContentType    string    `json:"content_type"`
+	ExpirationTime time.Time `json:"expiration_time"`
+	RequestID      string    `json:"request_id"`
+}
+
+// Webhook posts events to an external service without holding up the response
+type Webhook struct {
+	URL    string
+	Client *http.Client
+	// pending lets shutdown wait for deliveries in flight
+	pending sync.WaitGroup
+}
+
+func NewWebhook(url string) *Webhook {
+	return &Webhook{URL: url, Client: &http.Client{Timeout: WEBHOOK_TIMEOUT}}
+}
+
+// Notify sends the event in the background, failures are only logged
+func (h *Webhook) Notify(event UploadIssuedEvent) {
+	h.pending.Add(1)
+	go func() {
+		defer h.pending.Done()
+		if err := h.send(event); err != nil {
+			slog.Error("webhook failed", "request_id", event.RequestID, "file_name", event.FileName, "error", err)
+		}
+	}()
+}
+
+// Wait blocks until every notification has been delivered or has failed
+func (h *Webhook) Wait() {
+	h.pending.Wait()
+}
+
+func (h *Webhook) send(event UploadIssuedEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	delay := RETRY_BASE_DELAY
+	for attempt := 0; ; attempt++ {
+		err = h.post(payload)
+		if err == nil || attempt >= WEBHOOK_MAX_RETRIES {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (h *Webhook) post(payload []byte) error {
+	res, err := h.Client.Post(h.URL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook answered %s", res.Status)
+	}
+	return nil
+}
+
+// notifyUploadIssued tells the webhook about an upload that can now be made
+func (s *Server) notifyUploadIssued(r *http.Request, param GeneratePresignedURLParam, expiration time.Time) {
+	if s.Webhook == nil || param.DryRun {
+		return
+	}
+	s.Webhook.Notify(UploadIssuedEvent{
+		Event:          EVENT_UPLOAD_ISSUED,
+		FileName:       param.FileName,
+		Bucket:         param.Bucket,
+		ContentType:    param.ContentType,
+		ExpirationTime: expiration,
+		RequestID:      middleware.GetReqID(r.Context()),
+	})
+}
+
+// Rate limiting
+
+const RATE_LIMIT_IDLE_TTL = 10 * time.Minute
+
+// IPRateLimiter keeps a token bucket per client IP
+type IPRateLimiter struct {
+	rate        rate.Limit
+	burst       int
+	trustProxy  bool
+	mu          sync.Mutex
+	clients     map[string]*rateLimitedClient
+	lastCleanup time.Time
+}
+
+type rateLimitedClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func NewIPRateLimiter(perSecond float64, burst int, trustProxy bool) *IPRateLimiter {
+	return &IPRateLimiter{
+		rate:        rate.Limit(perSecond),
+		burst:       burst,
+		trustProxy:  trustProxy,
+		clients:     map[string]*rateLimitedClient{},
+		lastCleanup: time.Now(),
+	}
+}
+
+func (l *IPRateLimiter) limiter(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	// Forget clients idle long enough for their bucket to have refilled anyway
+	if now.Sub(l.lastCleanup) > RATE_LIMIT_IDLE_TTL {
+		for key, client := range l.clients {
+			if now.Sub(client.lastSeen) > RATE_LIMIT_IDLE_TTL {
+				delete(l.clients, key)
+			}
+		}
+		l.lastCleanup = now
+	}
+
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &rateLimitedClient{limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.clients[ip] = client
+	}
+	client.lastSeen = now
+	return client.limiter
+}
+
+// Middleware rejects requests over the limit with 429 and a Retry-After header
+func (l *IPRateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reservation := l.limiter(clientIP(r, l.trustProxy)).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			SendResponse(w, Error("too many requests", nil), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GlobalRateLimiter is one token bucket shared by every client, it keeps the server under AWS throttling
+type GlobalRateLimiter struct {
+	limiter *rate.Limiter
+}
+
+func NewGlobalRateLimiter(perSecond float64, burst int) *GlobalRateLimiter {
+	return &GlobalRateLimiter{limiter: rate.NewLimiter(rate.Limit(perSecond), burst)}
+}
+
+// Middleware rejects requests over the server budget with 503 and a Retry-After header,
+// it runs after the per IP limit so a single noisy client cannot drain the budget
+func (l *GlobalRateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reservation := l.limiter.Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			SendResponse(w, Error("the server is busy, try again later", nil), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the caller address, trusting X-Forwarded-For only behind a proxy. The proxy
+// appends the address it saw, so only the last entry is trusted, the ones before it are sent by the client.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			forwarded := values[len(values)-1]
+			if last := strings.TrimSpace(forwarded[strings.LastIndex(forwarded, ",")+1:]); last != "" {
+				return last
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Metrics
+
+// Metrics holds the Prometheus collectors for the presign routes
+type Metrics struct {
+	requests *prometheus.CounterVec
+	failures *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+}
+
+// NewMetrics creates the collectors and registers them once
+func NewMetrics(registerer prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "presign_requests_total",
+			Help: "Total presign requests by route.",
+		}, []string{"route"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "presign_failures_total",
+			Help: "Failed presign requests by route and reason.",
+		}, []string{"route", "reason"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "presign_duration_seconds",
+			Help:    "Presign request latency by route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route"}),
+	}
+	registerer.MustRegister(m.requests, m.failures, m.latency)
+	return m
+}
+
+// Middleware records every request after it has been routed
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := chi.RouteContext(r.Context()).RoutePattern()
+		m.requests.WithLabelValues(route).Inc()
+		m.latency.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		if reason := failureReason(ww.Status()); reason != "" {
+			m.failures.WithLabelValues(route, reason).Inc()
+		}
+	})
+}
+
+// failureReason maps a response status to the failure label, "" for success
+func failureReason(status int) string {
+	switch {
+	case status < 400:
+		return ""
+	case status == http.StatusTooManyRequests:
+		return "rate_limited"
+	case status == http.StatusUnauthorized:
+		return "unauthorized"
+	case status == http.StatusServiceUnavailable:
+		// Uploads switched off or the global rate limit spent
+		return "unavailable"
+	case status == http.StatusGatewayTimeout:
+		return "timeout"
+	case status >= 500:
+		return "aws"
+	default:
+		return "validation"
+	}
+}
+
+// Authentication
+
+// requestAPIKey is the key sent as a bearer token or in X-API-Key
+func requestAPIKey(r *http.Request) string {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return bearer
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// APIKeyAuth requires a known key in "Authorization: Bearer <key>" or "X-API-Key"
+func APIKeyAuth(keys []string) func(http.Handler) http.Handler {
+	// Compare fixed-size digests so neither the key length nor its contents leak through timing
+	digests := make([][32]byte, len(keys))
+	for i, key := range keys {
+		digests[i] = sha256.Sum256([]byte(key))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := requestAPIKey(r)
+			if key == "" {
+				SendResponse(w, Error("missing API key", nil), http.StatusUnauthorized)
+				return
+			}
+
+			digest := sha256.Sum256([]byte(key))
+			valid := 0
+			for _, known := range digests {
+				valid |= subtle.ConstantTimeCompare(digest[:], known[:])
+			}
+			if valid != 1 {
+				SendResponse(w, Error("invalid API key", nil), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Buckets
+
+// BucketTarget is the bucket, key prefix and client a request presigns against
+type BucketTarget struct {
+	Bucket        string
+	KeyPrefix     string
+	ObjectBaseURL string
+	S3            S3Client
+	// Storage presigns the uploads of this bucket
+	Storage StorageBackend
+}
+
+// RegionClients keeps one S3 client per region, created on first use, for the bucket aliases and the region field
+type RegionClients struct {
+	config  Config
+	mu      sync.Mutex
+	clients map[string]S3Client
+}
+
+func NewRegionClients(config Config, defaultClient S3Client) *RegionClients {
+	return &RegionClients{config: config, clients: map[string]S3Client{config.Region: defaultClient}}
+}
+
+func (c *RegionClients) Client(region string) (S3Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if svc, ok := c.clients[region]; ok {
+		return svc, nil
+	}
+	regionConfig := c.config
+	regionConfig.Region = region
+	svc, err := newS3Client(regionConfig)
+	if err != nil {
+		return nil, err
+	}
+	c.clients[region] = svc
+	return svc, nil
+}
+
+// newBucketTargets builds the alias targets, presigning with the client regions keeps for the alias's region
+func newBucketTargets(config Config, regions *RegionClients, defaultStorage StorageBackend) (map[string]BucketTarget, error) {
+	targets := make(map[string]BucketTarget, len(config.Buckets))
+	for alias, bucket := range config.Buckets {
+		svc, err := regions.Client(bucket.Region)
+		if err != nil {
+			return nil, err
+		}
+		// Every alias shares the local backend, S3 aliases presign with their region's client
+		storage := defaultStorage
+		if _, local := defaultStorage.(*LocalBackend); !local {
+			storage = &S3Backend{S3: svc}
+		}
+		targets[alias] = BucketTarget{Bucket: bucket.Bucket, KeyPrefix: bucket.Prefix, ObjectBaseURL: bucket.ObjectBaseURL, S3: svc, Storage: storage}
+	}
+	return targets, nil
+}
+
+// resolveBucketRegion resolves the bucket alias and, when a region is requested, the bucket and client of that region.
+// Every object route takes the region field, one of ALLOWED_REGIONS, and the multipart routes need the region
+// the upload was created in.
+func (s *Server) resolveBucketRegion(alias string, region string) (BucketTarget, *RequestError) {
+	target, reqErr := s.resolveBucket(alias)
+	if reqErr != nil || region == "" {
+		return target, reqErr
+	}
+	if _, ok := s.Config.AllowedRegions[region]; !ok {
+		return target, BadRequest(fmt.Sprintf("region %q is not allowed", region), nil).forField("region")
+	}
+	if _, local := target.Storage.(*LocalBackend); local || s.Regions == nil {
+		return target, BadRequest("region is not supported by this storage backend", nil).forField("region")
+	}
+	if alias != "" {
+		// The alias already presigns with the client of its bucket's region
+		if bucketRegion := s.Config.Buckets[alias].Region; bucketRegion != region {
+			return target, BadRequest(fmt.Sprintf("bucket alias %q is in region %q, not %q", alias, bucketRegion, region), nil).forField("region")
+		}
+		return target, nil
+	}
+	bucket, ok := s.Config.RegionBuckets[region]
+	if !ok {
+		// AWS_REGION left unmapped presigns against AWS_BUCKET
+		return target, nil
+	}
+	svc, err := s.Regions.Client(region)
+	if err != nil {
+		return target, &RequestError{Status: http.StatusInternalServerError, Message: "failed to create S3 client", Err: err}
+	}
+	target = BucketTarget{Bucket: bucket.Bucket, KeyPrefix: bucket.Prefix, ObjectBaseURL: bucket.ObjectBaseURL, S3: svc, Storage: &S3Backend{S3: svc}}
+	return target, s.checkBucket(target.Bucket)
+}
+
+// resolveBucket returns the target for a bucket_alias, the default bucket when it is empty
+func (s *Server) resolveBucket(alias string) (BucketTarget, *RequestError) {
+	if alias == "" {
+		target := BucketTarget{Bucket: s.Config.Bucket, KeyPrefix: s.Config.KeyPrefix, ObjectBaseURL: s.Config.ObjectBaseURL, S3: s.S3, Storage: s.Storage}
+		return target, s.checkBucket(target.Bucket)
+	}
+	target, ok := s.Buckets[alias]
+	if !ok {
+		return target, BadRequest(fmt.Sprintf("unknown bucket alias %q", alias), nil)
+	}
+	return target, s.checkBucket(target.Bucket)
+}
+
+// checkBucket rejects buckets missing from ALLOWED_BUCKETS, every bucket name a request can reach goes through it
+func (s *Server) checkBucket(bucket string) *RequestError {
+	if s.Config.AllowedBuckets[bucket] {
+		return nil
+	}
+	return &RequestError{Status: http.StatusForbidden, Message: fmt.Sprintf("bucket %q is not allowed", bucket)}
+}
+
+// Expiration
+
+const DEFAULT_EXPIRATION = 10 * time.Minute
+
+const MAX_EXPIRATION = 7 * 24 * time.Hour // SigV4 limit
+
+// resolveExpiration turns expires_in_seconds into a URL lifetime. Values outside
+// [MinExpiration, MAX_EXPIRATION] are rejected rather than clamped so clients never
+// receive a URL that lives shorter or longer than they asked for.
+func (s *Server) resolveExpiration(expiresInSeconds int64) (time.Duration, *RequestError) {
+	if expiresInSeconds == 0 {
+		return DEFAULT_EXPIRATION, nil
+	}
+	expiration := time.Duration(expiresInSeconds) * time.Second
+	if expiresInSeconds < 0 || expiration < s.Config.MinExpiration || expiration > MAX_EXPIRATION {
+		return 0, BadRequest(fmt.Sprintf("expires_in_seconds must be between %d and %d",
+			int64(s.Config.MinExpiration.Seconds()), int64(MAX_EXPIRATION.Seconds())), nil)
+	}
+	return expiration, nil
+}
+
+// Keys
+
+const MAX_KEY_LENGTH = 1024 // S3 limit in bytes
+
+var safeKeyPattern = regexp.MustCompile(`^[a-zA-Z0-9/._-]+$`)
+
+// sanitizeKey validates a client supplied object key and strips leading slashes
+func sanitizeKey(key string) (string, error) {
+	key = strings.TrimLeft(key, "/")
+	if key == "" {
+		return "", fmt.Errorf("key is empty")
+	}
+	if len(key) > MAX_KEY_LENGTH {
+		return "", fmt.Errorf("key is longer than %d bytes", MAX_KEY_LENGTH)
+	}
+	if !safeKeyPattern.MatchString(key) {
+		return "", fmt.Errorf("key contains characters outside [a-zA-Z0-9/._-]")
+	}
+	if strings.Contains(key, "..") {
+		return "", fmt.Errorf("key must not contain \"..\"")
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "." || segment == "" {
+			return "", fmt.Errorf("key contains an invalid path segment")
+		}
+	}
+	return key, nil
+}
+
+var repeatedSlashes = regexp.MustCompile(`/{2,}`)
+
+// normalizePrefix collapses repeated slashes and makes a non-empty prefix end with a single "/"
+func normalizePrefix(prefix string) string {
+	prefix = strings.Trim(repeatedSlashes.ReplaceAllString(prefix, "/"), "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+// sanitizePrefix validates a client supplied key prefix with the same rules as keys
+func sanitizePrefix(prefix string) (string, error) {
+	prefix = normalizePrefix(prefix)
+	if prefix == "" {
+		return "", nil
+	}
+	if _, err := sanitizeKey(strings.TrimSuffix(prefix, "/")); err != nil {
+		return "", err
+	}
+	return prefix, nil
+}
+
+// extensionForContentType returns the file extension for a content type, or "" when unknown
+func extensionForContentType(contentType string) string {
+	if extension, ok := contentTypeExtensions[strings.ToLower(contentType)]; ok {
+		return extension
+	}
+	extensions, err := mime.ExtensionsByType(contentType)
+	if err != nil || len(extensions) == 0 {
+		return ""
+	}
+	return extensions[0]
+}
+
+// Metadata
+
+const MAX_METADATA_SIZE = 2 * 1024 // S3 limit for user-defined metadata in bytes
+
+var metadataKeyPattern = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+// validateMetadata checks user metadata against what can travel as x-amz-meta-* headers
+func validateMetadata(metadata map[string]string) error {
+	size := 0
+	for key, value := range metadata {
+		if !metadataKeyPattern.MatchString(key) {
+			return fmt.Errorf("metadata key %q may only contain letters, digits and hyphens", key)
+		}
+		for _, c := range value {
+			if c < 0x20 || c > 0x7e {
+				return fmt.Errorf("metadata value for %q must be printable ASCII", key)
+			}
+		}
+		size += len(key) + len(value)
+	}
+	if size > MAX_METADATA_SIZE {
+		return fmt.Errorf("metadata is larger than %d bytes", MAX_METADATA_SIZE)
+	}
+	return nil
+}
+
+// Tags
+
+const MAX_TAGS = 10 // S3 limit per object
+
+const MAX_TAG_KEY_LENGTH = 128
+
+const MAX_TAG_VALUE_LENGTH = 256
+
+var tagPattern = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+// validateTags checks object tags against S3's tagging constraints
+func validateTags(tags map[string]string) error {
+	if len(tags) > MAX_TAGS {
+		return fmt.Errorf("at most %d tags are allowed", MAX_TAGS)
+	}
+	for key, value := range tags {
+		if key == "" || utf8.RuneCountInString(key) > MAX_TAG_KEY_LENGTH {
+			return fmt.Errorf("tag key %q must be 1 to %d characters", key, MAX_TAG_KEY_LENGTH)
+		}
+		if utf8.RuneCountInString(value) > MAX_TAG_VALUE_LENGTH {
+			return fmt.Errorf("tag value for %q must be at most %d characters", key, MAX_TAG_VALUE_LENGTH)
+		}
+		if strings.HasPrefix(strings.ToLower(key), "aws:") {
+			return fmt.Errorf("tag key %q uses the reserved aws: prefix", key)
+		}
+		if !tagPattern.MatchString(key) || !tagPattern.MatchString(value) {
+			return fmt.Errorf("tag %q may only contain letters, numbers, spaces and _ . : / = + - @", key)
+		}
+	}
+	return nil
+}
+
+// encodeTagging renders tags the way the x-amz-tagging header expects them
+func encodeTagging(tags map[string]string) string {
+	values := url.Values{}
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+	return values.Encode()
+}
+
+type postTag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+// encodePostTagging renders tags as the XML document the POST "tagging" field expects
+func encodePostTagging(tags map[string]string) (string, error) {
+	var document struct {
+		XMLName xml.Name  `xml:"Tagging"`
+		TagSet  []postTag `xml:"TagSet>Tag"`
+	}
+	for _, key := range sortedKeys(tags) {
+		document.TagSet = append(document.TagSet, postTag{Key: key, Value: tags[key]})
+	}
+	encoded, err := xml.Marshal(document)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// Encryption
+
+// validateEncryption checks the server-side encryption mode and its KMS key
+func validateEncryption(serverSideEncryption string, kmsKeyID string) error {
+	switch serverSideEncryption {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		return fmt.Errorf("server_side_encryption must be %q or %q", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms)
+	}
+	if kmsKeyID != "" && serverSideEncryption != s3.ServerSideEncryptionAwsKms {
+		return fmt.Errorf("kms_key_id requires server_side_encryption %q", s3.ServerSideEncryptionAwsKms)
+	}
+	return nil
+}
+
+// ACL
+
+// validateACL accepts the empty ACL or one of S3's canned ACLs
+func validateACL(acl string) error {
+	if acl == "" {
+		return nil
+	}
+	for _, canned := range s3.ObjectCannedACL_Values() {
+		if acl == canned {
+			return nil
+		}
+	}
+	return fmt.Errorf("acl must be one of %s", strings.Join(s3.ObjectCannedACL_Values(), ", "))
+}
+
+// Checksums
+
+// validateChecksumAlgorithm accepts the empty algorithm or one of the S3 checksum algorithms
+func validateChecksumAlgorithm(algorithm string) error {
+	if algorithm == "" {
+		return nil
+	}
+	for _, allowed := range s3.ChecksumAlgorithm_Values() {
+		if algorithm == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("checksum_algorithm must be one of %s", strings.Join(s3.ChecksumAlgorithm_Values(), ", "))
+}
+
+// Storage class
+
+// validateStorageClass accepts the empty storage class or one of S3's storage classes
+func validateStorageClass(storageClass string) error {
+	if storageClass == "" {
+		return nil
+	}
+	for _, class := range s3.StorageClass_Values() {
+		if storageClass == class {
+			return nil
+		}
+	}
+	return fmt.Errorf("storage_class must be one of %s", strings.Join(s3.StorageClass_Values(), ", "))
+}
+
+// Cache control
+
+const MAX_CACHE_CONTROL_LENGTH = 256
+
+// validateCacheControl rejects values that could not travel as a single header
+func validateCacheControl(cacheControl string) error {
+	if len(cacheControl) > MAX_CACHE_CONTROL_LENGTH {
+		return fmt.Errorf("cache_control is longer than %d bytes", MAX_CACHE_CONTROL_LENGTH)
+	}
+	for _, r := range cacheControl {
+		if r > unicode.MaxASCII || unicode.IsControl(r) {
+			return errors.New("cache_control must be printable ASCII")
+		}
+	}
+	return nil
+}
+
+// Object expiry
+
+// parseObjectExpires reads an expires_at timestamp, which must be RFC3339 and in the future
+func parseObjectExpires(expiresAt string, now time.Time) (time.Time, error) {
+	expires, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		return time.Time{}, errors.New("expires_at must be an RFC3339 timestamp such as 2030-01-02T15:04:05Z")
+	}
+	if !expires.After(now) {
+		return time.Time{}, errors.New("expires_at must be in the future")
+	}
+	return expires.UTC(), nil
+}
+
+// sortedKeys returns the keys of a string map in a stable order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// contentTypeForExtension infers the content type of a file extension, FALLBACK_CONTENT_TYPE when unknown
+func contentTypeForExtension(extension string) string {
+	extension = strings.ToLower(extension)
+	for contentType, ext := range contentTypeExtensions {
+		if ext == extension {
+			return contentType
+		}
+	}
+	if extension == "" {
+		return FALLBACK_CONTENT_TYPE
+	}
+	// Drop parameters such as charset=utf-8 so the type compares against ALLOWED_CONTENT_TYPES
+	mediaType, _, err := mime.ParseMediaType(mime.TypeByExtension(extension))
+	if err != nil {
+		return FALLBACK_CONTENT_TYPE
+	}
+	return mediaType
+}
+
+// Request bodies
+
+const DEFAULT_MAX_BODY_SIZE = 64 * 1024 // 64 KB, bodies are small JSON documents
+
+// decodeBody reads a size-limited JSON body and rejects unknown fields so typos are caught
+func (s *Server) decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) *RequestError {
+	r.Body = http.MaxBytesReader(w, r.Body, s.Config.MaxBodySize)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if decoder.More() {
+		return BadRequest("request body must contain a single JSON value", nil).withCode(ERROR_CODE_INVALID_BODY)
+	}
+	return nil
+}
+
+// decodeUploadBody reads an upload request sent as JSON or as an HTML form
+func (s *Server) decodeUploadBody(w http.ResponseWriter, r *http.Request) (GeneratePresignedURLBody, *RequestError) {
+	var body GeneratePresignedURLBody
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "", "application/json":
+		return body, s.decodeBody(w, r, &body)
+	case "application/x-www-form-urlencoded":
+		r.Body = http.MaxBytesReader(w, r.Body, s.Config.MaxBodySize)
+		if err := r.ParseForm(); err != nil {
+			return body, decodeError(err)
+		}
+		return uploadBodyFromValues(r.PostForm)
+	default:
+		return body, &RequestError{
+			Status:  http.StatusUnsupportedMediaType,
+			Message: fmt.Sprintf("unsupported request content type %q, send application/json or application/x-www-form-urlencoded", mediaType),
+		}
+	}
+}
+
+// jsonKind names a Go type the way it is written in JSON
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Ptr:
+		return jsonKind(t.Elem())
+	}
+	return t.String()
+}
+
+// decodeError tells the client what exactly is wrong with the body
+func decodeError(err error) *RequestError {
+	var maxBytesErr *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return &RequestError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("request body is larger than %d bytes", maxBytesErr.Limit),
+			Code:    ERROR_CODE_PAYLOAD_TOO_LARGE,
+		}
+	case errors.Is(err, io.EOF):
+		return BadRequest("request body is empty", nil).withCode(ERROR_CODE_INVALID_BODY)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return BadRequest("request body is truncated JSON", nil).withCode(ERROR_CODE_INVALID_BODY)
+	case errors.As(err, &syntaxErr):
+		return BadRequest(fmt.Sprintf("request body is malformed JSON at byte %d", syntaxErr.Offset), err).withCode(ERROR_CODE_INVALID_BODY)
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return BadRequest(fmt.Sprintf("request body must be a JSON %s, got %s", jsonKind(typeErr.Type), typeErr.Value), nil).withCode(ERROR_CODE_INVALID_BODY)
+		}
+		return BadRequest(fmt.Sprintf("field %q must be of type %s, got %s", typeErr.Field, jsonKind(typeErr.Type), typeErr.Value), nil).forField(typeErr.Field).withCode(ERROR_CODE_INVALID_BODY)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for unknown fields
+		return BadRequest(fmt.Sprintf("unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field ")), nil).withCode(ERROR_CODE_INVALID_BODY)
+	default:
+		return BadRequest("invalid request body", err).withCode(ERROR_CODE_INVALID_BODY)
+	}
+}
+
+// Route GetUploadURL
+
+// contentTypeExtensions maps common upload content types to their preferred file extension
+var contentTypeExtensions = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"application/pdf": ".pdf",
+}
+
+const DEFAULT_CONTENT_TYPE = "image/png"
+
+// FALLBACK_CONTENT_TYPE is inferred for file names whose extension has no known type
+const FALLBACK_CONTENT_TYPE = "application/octet-stream"
+
+type GeneratePresignedURLBody struct {
+	ContentLength int64  `json:"content_length"`
+	ContentType   string `json:"content_type"`
+	FileName      string `json:"file_name"`
+	Prefix        string `json:"prefix"`
+	// ExpiresInSeconds overrides the default 10 minute URL lifetime
+	ExpiresInSeconds int64 `json:"expires_in_seconds"`
+	// Metadata is stored as x-amz-meta-* headers on the object
+	Metadata map[string]string `json:"metadata"`
+	// ServerSideEncryption is AES256 or aws:kms, KMSKeyID only applies to aws:kms
+	ServerSideEncryption string `json:"server_side_encryption"`
+	KMSKeyID             string `json:"kms_key_id"`
+	// ContentMD5 is the base64 MD5 digest of the file, S3 rejects uploads that don't match
+	ContentMD5 string `json:"content_md5"`
+	// Tags are applied to the object through the x-amz-tagging header
+	Tags map[string]string `json:"tags"`
+	// BucketAlias selects one of the configured BUCKETS instead of AWS_BUCKET
+	BucketAlias string `json:"bucket_alias"`
+	// ACL is a canned ACL such as bucket-owner-full-control, AWS_DEFAULT_ACL applies when empty
+	ACL string `json:"acl"`
+	// DryRun runs every validation and returns the would-be key and host without a signature
+	DryRun bool `json:"dry_run"`
+	// CacheControl is stored on the object, AWS_DEFAULT_CACHE_CONTROL applies when empty
+	CacheControl string `json:"cache_control"`
+	// PreventOverwrite makes S3 reject the upload when the key already exists
+	PreventOverwrite bool `json:"prevent_overwrite"`
+	// StorageClass such as STANDARD_IA or GLACIER_IR, AWS_DEFAULT_STORAGE_CLASS applies when empty
+	StorageClass string `json:"storage_class"`
+	// ExpiresAt is the RFC3339 date stored as the object Expires header, unrelated to the URL expiry
+	ExpiresAt string `json:"expires_at"`
+	// ContentHash is the hex digest of the file that names it under KEY_STRATEGY hash
+	ContentHash string `json:"content_hash"`
+	Region      string `json:"region"`
+	// IncludeExamples adds curl and fetch snippets that perform the upload
+	IncludeExamples bool `json:"include_examples"`
+	// AllowUnknownLength presigns without binding Content-Length when content_length is omitted
+	AllowUnknownLength bool `json:"allow_unknown_length"`
+	// ChecksumAlgorithm such as SHA256 or CRC32C makes S3 verify the matching x-amz-checksum-* header
+	ChecksumAlgorithm string `json:"checksum_algorithm"`
+	Verbose           *bool  `json:"verbose"`
+}
+
+type GeneratePresignedURLResponse struct {
+	Method         string    `json:"method"`
+	PreAssignedURL string    `json:"pre_assigned_url"`
+	ExpirationTime time.Time `json:"expiration_time"`
+	// ExpirationUnix is ExpirationTime in seconds since the Unix epoch
+	ExpirationUnix int64    `json:"expiration_unix"`
+	FileName       string   `json:"file_name"`
+	Host           string   `json:"host"`
+	Details        []string `json:"details"`
+	ObjectUrl      string   `json:"object_url"`
+	// ObjectUrlPathStyle and ObjectUrlVirtualHosted address the object on S3 in either style
+	ObjectUrlPathStyle     string `json:"object_url_path_style,omitempty"`
+	ObjectUrlVirtualHosted string `json:"object_url_virtual_hosted,omitempty"`
+	// ObjectSize and LastModified describe the object when the download was verified
+	ObjectSize   *int64     `json:"object_size,omitempty"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+	// RequiredHeaders are the signed headers the client must send with these exact values
+	RequiredHeaders map[string]string `json:"required_headers,omitempty"`
+	// SignedHeaders lists the lowercase header names of the SigV4 signature, host included, for proxies that replay them
+	SignedHeaders []string `json:"signed_headers,omitempty"`
+	// SigningRegion is the region baked into the signature, for debugging SigV4 mismatches against custom endpoints
+	SigningRegion string `json:"signing_region,omitempty"`
+	// CurlExample and FetchExample are ready to run upload snippets, sent when include_examples is set
+	CurlExample  string `json:"curl_example,omitempty"`
+	FetchExample string `json:"fetch_example,omitempty"`
+	// Warnings flag issues that don't stop the URL from being issued, such as a URL proxies may cut
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+const DEFAULT_MAX_URL_LENGTH = 2048
+
+// presignedURLResponse maps a PresignResult to the JSON response, warning when the URL is longer than MAX_URL_LENGTH
+func (s *Server) presignedURLResponse(result PresignResult) GeneratePresignedURLResponse {
+	res := GeneratePresignedURLResponse{
+		Method:                 result.Method,
+		PreAssignedURL:         result.URL,
+		ExpirationTime:         result.ExpirationTime,
+		ExpirationUnix:         result.ExpirationTime.Unix(),
+		FileName:               result.FileName,
+		Host:                   result.Host,
+		Details:                result.Details,
+		ObjectUrl:              result.ObjectURL,
+		ObjectUrlPathStyle:     result.PathStyleURL,
+		ObjectUrlVirtualHosted: result.VirtualHostedURL,
+		RequiredHeaders:        requiredHeaders(result.SignedHeaders),
+		SignedHeaders:          signedHeaderNames(result.URL),
+		SigningRegion:          result.SigningRegion,
+	}
+	if s.Config.MaxURLLength > 0 && len(res.PreAssignedURL) > s.Config.MaxURLLength {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("the pre-signed URL is %d characters long, over the %d some proxies and browsers accept, use a shorter file name or fewer signed fields", len(res.PreAssignedURL), s.Config.MaxURLLength))
+	}
+	return res
+}
+
+// MinimalPresignedURLResponse is sent for verbose=false
+type MinimalPresignedURLResponse struct {
+	Method         string    `json:"method"`
+	PreAssignedURL string    `json:"pre_assigned_url"`
+	ExpirationTime time.Time `json:"expiration_time"`
+}
+
+// verboseResponse reads verbose from the body, then the ?verbose query, defaulting to true.
+// verbose false answers with only the method, URL and expiry of MinimalPresignedURLResponse.
+func verboseResponse(r *http.Request, verbose *bool) (bool, *RequestError) {
+	if verbose != nil {
+		return *verbose, nil
+	}
+	value := r.URL.Query().Get("verbose")
+	if value == "" {
+		return true, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return true, BadRequest("invalid verbose", err).forField("verbose")
+	}
+	return parsed, nil
+}
+
+// withVerbosity returns the response as is or cut down to MinimalPresignedURLResponse
+func (res GeneratePresignedURLResponse) withVerbosity(verbose bool) interface{} {
+	if verbose {
+		return res
+	}
+	return MinimalPresignedURLResponse{
+		Method:         res.Method,
+		PreAssignedURL: res.PreAssignedURL,
+		ExpirationTime: res.ExpirationTime,
+	}
+}
+
+// signedHeaderNames reads X-Amz-SignedHeaders from a SigV4 presigned URL, nil for other URLs
+func signedHeaderNames(presignedURL string) []string {
+	u, err := url.Parse(presignedURL)
+	if err != nil {
+		return nil
+	}
+	names := u.Query().Get("X-Amz-SignedHeaders")
+	if names == "" {
+		return nil
+	}
+	return strings.Split(names, ";")
+}
+
+const DEFAULT_KEY_TIME_LAYOUT = "2006-01-02-15-04-05"
+
+// KEY_SUFFIX_BYTES of randomness keep names generated in the same second apart
+const KEY_SUFFIX_BYTES = 4
+
+// generateFileName names an upload that didn't ask for a key after its time plus a random suffix
+func generateFileName(layout string, now time.Time, contentType string) string {
+	suffix := make([]byte, KEY_SUFFIX_BYTES)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%s%s", now.Format(layout), hex.EncodeToString(suffix), extensionForContentType(contentType))
+}
+
+// Key strategies
+
+const (
+	KEY_STRATEGY_TIMESTAMP = "timestamp"
+	KEY_STRATEGY_UUID      = "uuid"
+	KEY_STRATEGY_HASH      = "hash"
+)
+
+// contentHashPattern accepts hex digests from MD5 up to SHA-512
+var contentHashPattern = regexp.MustCompile(`^[a-fA-F0-9]{32,128}$`)
+
+// KeyRequest is what a strategy may name a generated key after
+type KeyRequest struct {
+	Now         time.Time
+	ContentType string
+	// ContentHash is the hex digest of the file as the client computed it
+	ContentHash string
+}
+
+// KeyStrategy names uploads that didn't ask for a key, the prefix is added by the caller
+type KeyStrategy interface {
+	GenerateKey(request KeyRequest) (string, *RequestError)
+}
+
+// TimestampKeyStrategy names keys after the upload time plus a random suffix
+type TimestampKeyStrategy struct {
+	Layout string
+}
+
+func (k TimestampKeyStrategy) GenerateKey(request KeyRequest) (string, *RequestError) {
+	return generateFileName(k.Layout, request.Now, request.ContentType), nil
+}
+
+// UUIDKeyStrategy names keys with a random UUIDv4
+type UUIDKeyStrategy struct{}
+
+func (UUIDKeyStrategy) GenerateKey(request KeyRequest) (string, *RequestError) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	// RFC 4122 version 4 and variant bits
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	encoded := hex.EncodeToString(id)
+	return fmt.Sprintf("%s-%s-%s-%s-%s%s", encoded[:8], encoded[8:12], encoded[12:16], encoded[16:20], encoded[20:], extensionForContentType(request.ContentType)), nil
+}
+
+// ContentHashKeyStrategy names keys after the content hash the client sends, identical files share a key
+type ContentHashKeyStrategy struct{}
+
+func (ContentHashKeyStrategy) GenerateKey(request KeyRequest) (string, *RequestError) {
+	if request.ContentHash == "" {
+		return "", BadRequest("content_hash is required to name the file, or set file_name", nil).forField("content_hash")
+	}
+	if !contentHashPattern.MatchString(request.ContentHash) {
+		return "", BadRequest("content_hash must be a hex digest of 32 to 128 characters", nil).forField("content_hash")
+	}
+	return strings.ToLower(request.ContentHash) + extensionForContentType(request.ContentType), nil
+}
+
+// newKeyStrategy builds the strategy KEY_STRATEGY selects
+func newKeyStrategy(config Config) KeyStrategy {
+	switch config.KeyStrategy {
+	case KEY_STRATEGY_UUID:
+		return UUIDKeyStrategy{}
+	case KEY_STRATEGY_HASH:
+		return ContentHashKeyStrategy{}
+	}
+	return TimestampKeyStrategy{Layout: config.KeyTimeLayout}
+}
+
+// resolveUploadKey builds the object key from the requested name and prefix and
+// resolves the content type every upload route signs
+func (s *Server) resolveUploadKey(target BucketTarget, requestedName string, requestPrefix string, requestedType string, contentHash string) (string, string, *RequestError) {
+	var fileName string
+	var keyErr *RequestError
+	if requestedName != "" {
+		key, err := sanitizeKey(requestedName)
+		if err != nil {
+			// The content type is still checked below, so both problems are reported at once
+			keyErr = BadRequest("invalid file name", err).forField("file_name")
+		}
+		fileName = key
+	}
+	prefix := target.KeyPrefix
+	if requestPrefix != "" {
+		sanitized, err := sanitizePrefix(requestPrefix)
+		if err != nil {
+			return "", "", BadRequest("invalid prefix", err).forField("prefix")
+		}
+		prefix += sanitized
+	}
+	contentType := requestedType
+	if contentType == "" && fileName != "" {
+		// Derive the content type from the requested key, the allow-list below still applies
+		contentType = contentTypeForExtension(path.Ext(fileName))
+	}
+	if contentType == "" {
+		contentType = DEFAULT_CONTENT_TYPE
+	}
+	if s.Config.StrictContentType && requestedType != "" && fileName != "" {
+		// Extensions without a known type can't be checked and pass
+		inferred := contentTypeForExtension(path.Ext(fileName))
+		declared, _, err := mime.ParseMediaType(requestedType)
+		if inferred != FALLBACK_CONTENT_TYPE && (err != nil || declared != inferred) {
+			return "", "", BadRequest(fmt.Sprintf("content type %q doesn't match the %q the extension %q implies", requestedType, inferred, path.Ext(fileName)), nil).forField("content_type").withCode(ERROR_CODE_CONTENT_TYPE_MISMATCH)
+		}
+	}
+	if !s.Config.AllowedContentTypes[strings.ToLower(contentType)] {
+		typeErr := &RequestError{
+			Status:  http.StatusUnsupportedMediaType,
+			Message: fmt.Sprintf("unsupported content type %q", contentType),
+			Field:   "content_type",
+		}
+		if keyErr != nil {
+			return "", "", joinFieldErrors([]*RequestError{keyErr, typeErr})
+		}
+		return "", "", typeErr
+	}
+	if keyErr != nil {
+		return "", contentType, keyErr
+	}
+	if fileName == "" {
+		keys := s.Keys
+		if keys == nil {
+			keys = TimestampKeyStrategy{Layout: s.Config.KeyTimeLayout}
+		}
+		key, reqErr := keys.GenerateKey(KeyRequest{Now: clockNow(s.Clock), ContentType: contentType, ContentHash: contentHash})
+		if reqErr != nil {
+			return "", "", reqErr
+		}
+		fileName = key
+	}
+	if len(s.Config.AllowedExtensions) > 0 {
+		// Content types such as application/octet-stream say nothing about the file, so the key is checked too
+		extension := strings.ToLower(path.Ext(fileName))
+		if extension == "" {
+			return "", "", BadRequest("file name must have an extension", nil).forField("file_name")
+		}
+		if !s.Config.AllowedExtensions[extension] {
+			return "", "", BadRequest(fmt.Sprintf("file extension %q is not allowed", extension), nil).forField("file_name")
+		}
+	}
+	fileName = prefix + fileName
+	if len(fileName) > MAX_KEY_LENGTH {
+		return "", "", BadRequest(fmt.Sprintf("file name is longer than %d bytes", MAX_KEY_LENGTH), nil).forField("file_name")
+	}
+
+	return fileName, contentType, nil
+}
+
+// resolveCacheControl validates the requested Cache-Control, falling back to AWS_DEFAULT_CACHE_CONTROL
+func (s *Server) resolveCacheControl(cacheControl string) (string, *RequestError) {
+	if cacheControl == "" {
+		return s.Config.DefaultCacheControl, nil
+	}
+	if err := validateCacheControl(cacheControl); err != nil {
+		return "", BadRequest("invalid cache_control", err)
+	}
+	return cacheControl, nil
+}
+
+// resolveObjectExpires validates the requested object Expires date, falling back to OBJECT_EXPIRES_AFTER_DAYS from now
+func (s *Server) resolveObjectExpires(expiresAt string) (time.Time, *RequestError) {
+	now := clockNow(s.Clock)
+	if expiresAt == "" {
+		if s.Config.DefaultObjectExpiry == 0 {
+			return time.Time{}, nil
+		}
+		return now.Add(s.Config.DefaultObjectExpiry).UTC().Truncate(time.Second), nil
+	}
+	expires, err := parseObjectExpires(expiresAt, now)
+	if err != nil {
+		return time.Time{}, BadRequest("invalid expires_at", err)
+	}
+	return expires, nil
+}
+
+// maxUploadSize is the size limit for a content type, MaxUploadSize unless MAX_UPLOAD_SIZES overrides it
+func (s *Server) maxUploadSize(contentType string) int64 {
+	if size, ok := s.Config.MaxUploadSizes[strings.ToLower(contentType)]; ok {
+		return size
+	}
+	return s.Config.MaxUploadSize
+}
+
+// resolveACL validates the requested ACL, falling back to AWS_DEFAULT_ACL
+func (s *Server) resolveACL(acl string) (string, *RequestError) {
+	if acl == "" {
+		return s.Config.DefaultACL, nil
+	}
+	if err := validateACL(acl); err != nil {
+		return "", BadRequest("invalid acl", err)
+	}
+	return acl, nil
+}
+
+// resolveStorageClass validates the requested storage class, falling back to AWS_DEFAULT_STORAGE_CLASS
+func (s *Server) resolveStorageClass(storageClass string) (string, *RequestError) {
+	if storageClass == "" {
+		return s.Config.DefaultStorageClass, nil
+	}
+	if err := validateStorageClass(storageClass); err != nil {
+		return "", BadRequest("invalid storage_class", err)
+	}
+	return storageClass, nil
+}
+
+// validateUploadBody runs the upload validations shared by every upload route
+// and resolves the body into presign parameters
+func (s *Server) validateUploadBody(bucket BucketTarget, body GeneratePresignedURLBody) (GeneratePresignedURLParam, *RequestError) {
+	var target GeneratePresignedURLParam
+	// Every field is checked so clients can report all problems at once
+	var problems []*RequestError
+	expiration, reqErr := s.resolveExpiration(body.ExpiresInSeconds)
+	if reqErr != nil {
+		problems = append(problems, reqErr.forField("expires_in_seconds"))
+	}
+	if err := validateMetadata(body.Metadata); err != nil {
+		problems = append(problems, BadRequest("invalid metadata", err).forField("metadata"))
+	}
+	if err := validateEncryption(body.ServerSideEncryption, body.KMSKeyID); err != nil {
+		problems = append(problems, BadRequest("invalid encryption", err).forField("server_side_encryption"))
+	}
+	if err := validateTags(body.Tags); err != nil {
+		problems = append(problems, BadRequest("invalid tags", err).forField("tags"))
+	}
+	acl, reqErr := s.resolveACL(body.ACL)
+	if reqErr != nil {
+		problems = append(problems, reqErr.forField("acl"))
+	}
+	cacheControl, reqErr := s.resolveCacheControl(body.CacheControl)
+	if reqErr != nil {
+		problems = append(problems, reqErr.forField("cache_control"))
+	}
+	storageClass, reqErr := s.resolveStorageClass(body.StorageClass)
+	if reqErr != nil {
+		problems = append(problems, reqErr.forField("storage_class"))
+	}
+	objectExpires, reqErr := s.resolveObjectExpires(body.ExpiresAt)
+	if reqErr != nil {
+		problems = append(problems, reqErr.forField("expires_at"))
+	}
+	if err := validateChecksumAlgorithm(body.ChecksumAlgorithm); err != nil {
+		problems = append(problems, BadRequest("invalid checksum_algorithm", err).forField("checksum_algorithm"))
+	}
+	if body.ContentMD5 != "" {
+		digest, err := base64.StdEncoding.DecodeString(body.ContentMD5)
+		if err != nil || len(digest) != md5.Size {
+			problems = append(problems, BadRequest("content_md5 must be a base64 encoded MD5 digest", nil).forField("content_md5"))
+		}
+	}
+	fileName, contentType, reqErr := s.resolveUploadKey(bucket, body.FileName, body.Prefix, body.ContentType, body.ContentHash)
+	if reqErr != nil {
+		problems = append(problems, reqErr)
+	}
+	maxUploadSize := s.maxUploadSize(contentType)
+	unknownLength := body.AllowUnknownLength && body.ContentLength == 0
+	if !unknownLength && (body.ContentLength < s.Config.MinUploadSize || body.ContentLength > maxUploadSize) {
+		limit := fmt.Sprintf("content length must be between %d and %d bytes", s.Config.MinUploadSize, maxUploadSize)
+		if contentType != "" {
+			limit += " for " + contentType
+		}
+		problems = append(problems, BadRequest(limit, nil).forField("content_length"))
+	}
+	if reqErr := joinFieldErrors(problems); reqErr != nil {
+		return target, reqErr
+	}
+
+	return GeneratePresignedURLParam{
+		Operation:            OperationPut,
+		FileName:             fileName,
+		Timout:               expiration,
+		ContentLength:        body.ContentLength,
+		MinUploadSize:        s.Config.MinUploadSize,
+		MaxUploadSize:        maxUploadSize,
+		Bucket:               bucket.Bucket,
+		ContentType:          contentType,
+		Metadata:             body.Metadata,
+		ServerSideEncryption: body.ServerSideEncryption,
+		SSEKMSKeyId:          body.KMSKeyID,
+		ContentMD5:           body.ContentMD5,
+		ChecksumAlgorithm:    body.ChecksumAlgorithm,
+		Tags:                 body.Tags,
+		ACL:                  acl,
+		DryRun:               body.DryRun,
+		CacheControl:         cacheControl,
+		ObjectBaseURL:        bucket.ObjectBaseURL,
+		PreventOverwrite:     body.PreventOverwrite,
+		StorageClass:         storageClass,
+		ObjectExpires:        objectExpires,
+		Clock:                s.Clock,
+	}, nil
+}
+
+// addExamples renders curl and fetch snippets that send the upload with its method, URL and required headers
+func addExamples(res *GeneratePresignedURLResponse) {
+	if res.PreAssignedURL == "" {
+		// Nothing to send for a dry run
+		return
+	}
+	names := sortedKeys(res.RequiredHeaders)
+
+	curl := []string{"curl -X " + res.Method}
+	for _, name := range names {
+		curl = append(curl, "-H "+shellQuote(name+": "+res.RequiredHeaders[name]))
+	}
+	curl = append(curl, "--upload-file "+shellQuote("./"+path.Base(res.FileName)), shellQuote(res.PreAssignedURL))
+	res.CurlExample = strings.Join(curl, " \\\n  ")
+
+	var headers []string
+	for _, name := range names {
+		// Browsers set Content-Length from the body and refuse it as a header
+		if name == "Content-Length" {
+			continue
+		}
+		headers = append(headers, fmt.Sprintf("    %s: %s,", jsString(name), jsString(res.RequiredHeaders[name])))
+	}
+	fetch := []string{
+		fmt.Sprintf("await fetch(%s, {", jsString(res.PreAssignedURL)),
+		fmt.Sprintf("  method: %s,", jsString(res.Method)),
+	}
+	if len(headers) > 0 {
+		fetch = append(fetch, "  headers: {")
+		fetch = append(fetch, headers...)
+		fetch = append(fetch, "  },")
+	}
+	fetch = append(fetch, "  body: file,", "});")
+	res.FetchExample = strings.Join(fetch, "\n")
+}
+
+// shellQuote wraps a value in single quotes for a POSIX shell
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// jsString renders a value as a JavaScript string literal
+func jsString(value string) string {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	// Keep & in query strings readable
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// FORMAT_QR answers /get-upload-url with a PNG QR code of the URL instead of JSON
+const FORMAT_QR = "qr"
+
+const QR_CODE_SIZE = 512 // pixels, presigned URLs need a dense code
+
+func (s *Server) GetUploadURLHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the request body
+	body, reqErr := s.decodeUploadBody(w, r)
+	if reqErr != nil {
+		// Send bad request response
+		SendRequestError(w, reqErr)
+		return
+	}
+	bucket, reqErr := s.resolveBucketRegion(body.BucketAlias, body.Region)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	param, reqErr := s.validateUploadBody(bucket, body)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != FORMAT_QR {
+		SendResponse(w, Error(fmt.Sprintf("unsupported format %q", format), nil), http.StatusBadRequest)
+		return
+	}
+	if format == FORMAT_QR && param.DryRun {
+		SendResponse(w, Error("dry_run has no URL to encode as a QR code", nil), http.StatusBadRequest)
+		return
+	}
+	idempotencyKey, reqErr := idempotencyKey(r)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	if s.Idempotency == nil || param.DryRun {
+		idempotencyKey = ""
+	}
+	fingerprint := requestFingerprint(body, r.URL.Query())
+	var PreAssignedURL PresignResult
+	replayed := false
+	if idempotencyKey != "" {
+		PreAssignedURL, replayed, reqErr = s.replayUpload(idempotencyKey, fingerprint)
+		if reqErr != nil {
+			SendRequestError(w, reqErr)
+			return
+		}
+	}
+	verbose, reqErr := verboseResponse(r, body.Verbose)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	r.Body.Close()
+	// Validations - End
+
+	if replayed {
+		// A retry of an upload that was already issued
+		w.Header().Set(IDEMPOTENT_REPLAYED_HEADER, "true")
+	} else {
+		// Generate pre-signed URL
+		var err error
+		PreAssignedURL, err = bucket.Storage.PresignUpload(r.Context(), param)
+		if err != nil {
+			SendPresignError(w, r, err)
+			return
+		}
+		s.notifyUploadIssued(r, param, PreAssignedURL.ExpirationTime)
+		if idempotencyKey != "" {
+			PreAssignedURL = s.rememberUpload(idempotencyKey, fingerprint, PreAssignedURL)
+		}
+	}
+
+	if format == FORMAT_QR {
+		// Send the URL as a QR code for mobile clients
+		png, err := qrcode.Encode(PreAssignedURL.URL, qrcode.Medium, QR_CODE_SIZE)
+		if err != nil {
+			SendResponse(w, Error("failed to encode QR code", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(http.StatusOK)
+		w.Write(png)
+		return
+	}
+
+	res := s.presignedURLResponse(PreAssignedURL)
+	if body.IncludeExamples {
+		addExamples(&res)
+	}
+
+	// Send the response
+	SendResponse(w, Success("pre-signed URL generated", res.withVerbosity(verbose)), http.StatusOK)
+
+}
+
+// Route GetUploadURLs
+
+const DEFAULT_MAX_BATCH_SIZE = 100
+
+// checkBatch bounds a batch by its number of items and by the summed declared content length
+func (s *Server) checkBatch(contentLengths []int64) *RequestError {
+	if len(contentLengths) == 0 || len(contentLengths) > s.Config.MaxBatchSize {
+		reqErr := BadRequest(fmt.Sprintf("a batch must contain between 1 and %d items", s.Config.MaxBatchSize), nil)
+		if len(contentLengths) > 0 {
+			reqErr.Code = ERROR_CODE_BATCH_TOO_LARGE
+		}
+		return reqErr
+	}
+	if s.Config.MaxBatchBytes == 0 {
+		return nil
+	}
+	var total int64
+	for _, length := range contentLengths {
+		// Compared before adding so huge lengths cannot overflow the sum
+		if length > s.Config.MaxBatchBytes-total {
+			return BadRequest(fmt.Sprintf("the files of a batch must add up to at most %d bytes", s.Config.MaxBatchBytes), nil).withCode(ERROR_CODE_BATCH_TOO_LARGE)
+		}
+		if length > 0 {
+			total += length
+		}
+	}
+	return nil
+}
+
+// GetUploadURLsHandler presigns a batch of uploads, reporting each item on its own
+func (s *Server) GetUploadURLsHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the request body
+	var bodies []GeneratePresignedURLBody
+	if reqErr := s.decodeBody(w, r, &bodies); reqErr != nil {
+		// Send bad request response
+		SendRequestError(w, reqErr)
+		return
+	}
+	lengths := make([]int64, len(bodies))
+	for i, body := range bodies {
+		lengths[i] = body.ContentLength
+	}
+	if reqErr := s.checkBatch(lengths); reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	r.Body.Close()
+	// Validations - End
+
+	// Generate pre-signed URLs
+	results := make([]map[string]interface{}, len(bodies))
+	for i, body := range bodies {
+		bucket, reqErr := s.resolveBucketRegion(body.BucketAlias, body.Region)
+		if reqErr != nil {
+			results[i] = reqErr.Response()
+			continue
+		}
+		param, reqErr := s.validateUploadBody(bucket, body)
+		if reqErr != nil {
+			results[i] = reqErr.Response()
+			continue
+		}
+		verbose, reqErr := verboseResponse(r, body.Verbose)
+		if reqErr != nil {
+			results[i] = reqErr.Response()
+			continue
+		}
+		PreAssignedURL, err := bucket.Storage.PresignUpload(r.Context(), param)
+		if err != nil {
+			LogPresignError(r, err)
+			results[i] = Error(PresignErrorMessage(err), nil)
+			results[i]["code"] = ERROR_CODE_AWS_ERROR
+			continue
+		}
+		s.notifyUploadIssued(r, param, PreAssignedURL.ExpirationTime)
+		res := s.presignedURLResponse(PreAssignedURL)
+		if body.IncludeExamples {
+			addExamples(&res)
+		}
+		results[i] = Success("pre-signed URL generated", res.withVerbosity(verbose))
+	}
+
+	// Send the response
+	SendResponse(w, Success("pre-signed URLs generated", results), http.StatusOK)
+}
+
+// Route GetUploadPost
+
+type GeneratePresignedPostResponse struct {
+	URL            string            `json:"url"`
+	Fields         map[string]string `json:"fields"`
+	ExpirationTime time.Time         `json:"expiration_time"`
+	ExpirationUnix int64             `json:"expiration_unix"`
+	FileName       string            `json:"file_name"`
+	Details        []string          `json:"details"`
+	ObjectUrl      string            `json:"object_url"`
+	// ObjectUrlPathStyle and ObjectUrlVirtualHosted address the object on S3 in either style
+	ObjectUrlPathStyle     string `json:"object_url_path_style,omitempty"`
+	ObjectUrlVirtualHosted string `json:"object_url_virtual_hosted,omitempty"`
+	// SigningRegion is the region of the policy's credential scope
+	SigningRegion string `json:"signing_region,omitempty"`
+}
+
+func (s *Server) GetUploadPostHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the request body
+	var body GeneratePresignedURLBody
+	if reqErr := s.decodeBody(w, r, &body); reqErr != nil {
+		// Send bad request response
+		SendRequestError(w, reqErr)
+		return
+	}
+	bucket, reqErr := s.resolveBucketRegion(body.BucketAlias, body.Region)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	param, reqErr := s.validateUploadBody(bucket, body)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	if param.ContentMD5 != "" {
+		// POST policies have no condition for the body digest
+		SendResponse(w, Error("content_md5 is not supported for POST uploads", nil), http.StatusBadRequest)
+		return
+	}
+	if param.ChecksumAlgorithm != "" {
+		SendResponse(w, Error("checksum_algorithm is not supported for POST uploads", nil), http.StatusBadRequest)
+		return
+	}
+	if param.DryRun {
+		SendResponse(w, Error("dry_run is not supported for POST uploads", nil), http.StatusBadRequest)
+		return
+	}
+	if param.PreventOverwrite {
+		SendResponse(w, Error("prevent_overwrite is not supported for POST uploads", nil), http.StatusBadRequest)
+		return
+	}
+	if s.Config.SignatureVersion != SIGNATURE_VERSION_4 {
+		// The POST policy is signed with SigV4 only
+		SendResponse(w, Error("POST uploads require AWS_SIGNATURE_VERSION v4", nil), http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+	// Validations - End
+
+	// Generate pre-signed POST policy
+	PresignedPost, err := GeneratePresignedPost(r.Context(), bucket.S3, param)
+	if err != nil {
+		SendPresignError(w, r, err)
+		return
+	}
+	s.notifyUploadIssued(r, param, PresignedPost.ExpirationTime)
+
+	// Send the response
+	SendResponse(w, Success("pre-signed POST generated", PresignedPost), http.StatusOK)
+}
+
+// Route UploadRedirect
+
+// uploadBodyFromValues reads the scalar upload fields from query or form values named like the JSON body
+func uploadBodyFromValues(values url.Values) (GeneratePresignedURLBody, *RequestError) {
+	body := GeneratePresignedURLBody{
+		ContentType:          values.Get("content_type"),
+		FileName:             values.Get("file_name"),
+		Prefix:               values.Get("prefix"),
+		BucketAlias:          values.Get("bucket_alias"),
+		ACL:                  values.Get("acl"),
+		StorageClass:         values.Get("storage_class"),
+		CacheControl:         values.Get("cache_control"),
+		ExpiresAt:            values.Get("expires_at"),
+		ContentHash:          values.Get("content_hash"),
+		Region:               values.Get("region"),
+		ContentMD5:           values.Get("content_md5"),
+		ChecksumAlgorithm:    values.Get("checksum_algorithm"),
+		ServerSideEncryption: values.Get("server_side_encryption"),
+		KMSKeyID:             values.Get("kms_key_id"),
+	}
+	var err error
+	if value := values.Get("content_length"); value != "" {
+		if body.ContentLength, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return body, BadRequest("invalid content length", err).forField("content_length")
+		}
+	}
+	if value := values.Get("expires_in_seconds"); value != "" {
+		if body.ExpiresInSeconds, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return body, BadRequest("invalid expires_in_seconds", err).forField("expires_in_seconds")
+		}
+	}
+	flags := map[string]*bool{
+		"dry_run":              &body.DryRun,
+		"prevent_overwrite":    &body.PreventOverwrite,
+		"include_examples":     &body.IncludeExamples,
+		"allow_unknown_length": &body.AllowUnknownLength,
+	}
+	for name, flag := range flags {
+		if value := values.Get(name); value != "" {
+			if *flag, err = strconv.ParseBool(value); err != nil {
+				return body, BadRequest(fmt.Sprintf("invalid %s", name), err).forField(name)
+			}
+		}
+	}
+	return body, nil
+}
+
+// UploadRedirectHandler answers with a 307 to the pre-signed upload URL so tools can follow it
+func (s *Server) UploadRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the query
+	body, reqErr := uploadBodyFromValues(r.URL.Query())
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	bucket, reqErr := s.resolveBucketRegion(body.BucketAlias, body.Region)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	param, reqErr := s.validateUploadBody(bucket, body)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	// Validations - End
+
+	// Generate pre-signed URL
+	PreAssignedURL, err := bucket.Storage.PresignUpload(r.Context(), param)
+	if err != nil {
+		SendPresignError(w, r, err)
+		return
+	}
+	s.notifyUploadIssued(r, param, PreAssignedURL.ExpirationTime)
+
+	// Redirect to the pre-signed URL
+	http.Redirect(w, r, PreAssignedURL.URL, http.StatusTemporaryRedirect)
+}
+
+// Route RefreshUploadURL
+
+type RefreshUploadURLBody struct {
+	// FileName is the key a previous upload URL returned
+	FileName         string `json:"file_name"`
+	ContentType      string `json:"content_type"`
+	ContentLength    int64  `json:"content_length"`
+	ExpiresInSeconds int64  `json:"expires_in_seconds"`
+	BucketAlias      string `json:"bucket_alias"`
+	Region           string `json:"region"`
+	Verbose          *bool  `json:"verbose"`
+}
+
+// RefreshUploadURLHandler presigns a new upload URL for a key issued before, for uploads outliving their URL
+func (s *Server) RefreshUploadURLHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the request body
+	var body RefreshUploadURLBody
+	if reqErr := s.decodeBody(w, r, &body); reqErr != nil {
+		// Send bad request response
+		SendRequestError(w, reqErr)
+		return
+	}
+	fileName, err := sanitizeKey(body.FileName)
+	if err != nil {
+		SendRequestError(w, BadRequest("invalid file name", err).forField("file_name"))
+		return
+	}
+	bucket, reqErr := s.resolveBucketRegion(body.BucketAlias, body.Region)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	// Keys are issued under the bucket prefix, validateUploadBody adds it back
+	name, ok := strings.CutPrefix(fileName, bucket.KeyPrefix)
+	if !ok {
+		SendRequestError(w, BadRequest(fmt.Sprintf("file name must start with %q", bucket.KeyPrefix), nil).forField("file_name"))
+		return
+	}
+	param, reqErr := s.validateUploadBody(bucket, GeneratePresignedURLBody{
+		FileName:         name,
+		ContentType:      body.ContentType,
+		ContentLength:    body.ContentLength,
+		ExpiresInSeconds: body.ExpiresInSeconds,
+		BucketAlias:      body.BucketAlias,
+	})
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	verbose, reqErr := verboseResponse(r, body.Verbose)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	r.Body.Close()
+	// Validations - End
+
+	// Generate pre-signed URL
+	PreAssignedURL, err := bucket.Storage.PresignUpload(r.Context(), param)
+	if err != nil {
+		SendPresignError(w, r, err)
+		return
+	}
+	s.notifyUploadIssued(r, param, PreAssignedURL.ExpirationTime)
+
+	// Send the response
+	SendResponse(w, Success("pre-signed URL refreshed", s.presignedURLResponse(PreAssignedURL).withVerbosity(verbose)), http.StatusOK)
+}
+
+// Route GetDownloadURL
+
+type GenerateDownloadURLBody struct {
+	FileName         string `json:"file_name"`
+	ExpiresInSeconds int64  `json:"expires_in_seconds"`
+	BucketAlias      string `json:"bucket_alias"`
+	// VerifyExists checks the object with HeadObject before presigning
+	VerifyExists bool `json:"verify_exists"`
+	// DownloadFilename makes browsers save the file under this name
+	DownloadFilename string `json:"download_filename"`
+	// ResponseContentType overrides the Content-Type S3 answers with, such as video/mp4 for players
+	ResponseContentType string `json:"response_content_type"`
+	// VersionID downloads a specific version of the object in a versioned bucket
+	VersionID string `json:"version_id"`
+	Region    string `json:"region"`
+	Verbose   *bool  `json:"verbose"`
+}
+
+func (s *Server) GetDownloadURLHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the request body
+	var body GenerateDownloadURLBody
+	if reqErr := s.decodeBody(w, r, &body); reqErr != nil {
+		// Send bad request response
+		SendRequestError(w, reqErr)
+		return
+	}
+	fileName, err := sanitizeKey(body.FileName)
+	if err != nil {
+		SendResponse(w, Error("file not found", err), http.StatusNotFound)
+		return
+	}
+	downloadTimeout, reqErr := s.resolveExpiration(body.ExpiresInSeconds)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	var disposition string
+	if body.DownloadFilename != "" {
+		disposition, err = attachmentDisposition(body.DownloadFilename)
+		if err != nil {
+			SendRequestError(w, BadRequest("invalid download_filename", err).forField("download_filename"))
+			return
+		}
+	}
+	if body.ResponseContentType != "" {
+		if _, _, err := mime.ParseMediaType(body.ResponseContentType); err != nil {
+			SendRequestError(w, BadRequest("invalid response_content_type", err).forField("response_content_type"))
+			return
+		}
+	}
+	if err := validateVersionID(body.VersionID); err != nil {
+		SendRequestError(w, BadRequest("invalid version_id", err).forField("version_id"))
+		return
+	}
+	bucket, reqErr := s.resolveBucketRegion(body.BucketAlias, body.Region)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	verbose, reqErr := verboseResponse(r, body.Verbose)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	r.Body.Close()
+	var object *s3.HeadObjectOutput
+	if body.VerifyExists {
+		err := withRetry(r.Context(), s.Config.MaxRetries, func() (err error) {
+			object, err = HeadObject(r.Context(), bucket.S3, bucket.Bucket, fileName, body.VersionID)
+			return err
+		})
+		if isNotFound(err) {
+			SendResponse(w, Error("file not found", nil), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			SendPresignError(w, r, err)
+			return
+		}
+	}
+	// Validations - End
+
+	// Generate pre-signed URL
+	PreAssignedURL, err := GeneratePresignedURL(r.Context(), bucket.S3, GeneratePresignedURLParam{
+		Operation:                  OperationGet,
+		FileName:                   fileName,
+		Timout:                     downloadTimeout,
+		ResponseContentDisposition: disposition,
+		ResponseContentType:        body.ResponseContentType,
+		VersionID:                  body.VersionID,
+		Bucket:                     bucket.Bucket,
+		ObjectBaseURL:              bucket.ObjectBaseURL,
+		Clock:                      s.Clock,
+	})
+	if err != nil {
+		SendPresignError(w, r, err)
+		return
+	}
+	res := s.presignedURLResponse(PreAssignedURL)
+	if object != nil {
+		res.ObjectSize = object.ContentLength
+		res.LastModified = object.LastModified
+	}
+
+	// Send the response
+	SendResponse(w, Success("pre-signed URL generated", res.withVerbosity(verbose)), http.StatusOK)
+}
+
+const MAX_VERSION_ID_LENGTH = 1024
+
+// validateVersionID accepts the empty version or an opaque S3 version ID, which is printable ASCII without spaces
+func validateVersionID(versionID string) error {
+	if len(versionID) > MAX_VERSION_ID_LENGTH {
+		return fmt.Errorf("version_id is longer than %d bytes", MAX_VERSION_ID_LENGTH)
+	}
+	for _, r := range versionID {
+		if r <= ' ' || r > '~' {
+			return errors.New("version_id must be printable ASCII without spaces")
+		}
+	}
+	return nil
+}
+
+const MAX_DOWNLOAD_FILENAME_LENGTH = 255
+
+// attachmentDisposition builds an attachment Content-Disposition, quoting the name
+// and switching to RFC 2231 encoding for non-ASCII names
+func attachmentDisposition(name string) (string, error) {
+	if len(name) > MAX_DOWNLOAD_FILENAME_LENGTH {
+		return "", fmt.Errorf("download_filename is longer than %d bytes", MAX_DOWNLOAD_FILENAME_LENGTH)
+	}
+	for _, r := range name {
+		// Control characters such as CR and LF would let the name inject headers
+		if unicode.IsControl(r) {
+			return "", errors.New("download_filename must not contain control characters")
+		}
+	}
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": name})
+	if disposition == "" {
+		return "", errors.New("download_filename cannot be encoded")
+	}
+	return disposition, nil
+}
+
+// Route GetDeleteURL
+
+type GenerateDeleteURLBody struct {
+	FileName         string `json:"file_name"`
+	ExpiresInSeconds int64  `json:"expires_in_seconds"`
+	BucketAlias      string `json:"bucket_alias"`
+	Region           string `json:"region"`
+	Verbose          *bool  `json:"verbose"`
+}
+
+func (s *Server) GetDeleteURLHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the request body
+	var body GenerateDeleteURLBody
+	if reqErr := s.decodeBody(w, r, &body); reqErr != nil {
+		// Send bad request response
+		SendRequestError(w, reqErr)
+		return
+	}
+	fileName, err := sanitizeKey(body.FileName)
+	if err != nil {
+		SendResponse(w, Error("file not found", err), http.StatusNotFound)
+		return
+	}
+	deleteTimeout, reqErr := s.resolveExpiration(body.ExpiresInSeconds)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	bucket, reqErr := s.resolveBucketRegion(body.BucketAlias, body.Region)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	verbose, reqErr := verboseResponse(r, body.Verbose)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	r.Body.Close()
+	// Validations - End
+
+	// Generate pre-signed URL
+	PreAssignedURL, err := GeneratePresignedURL(r.Context(), bucket.S3, GeneratePresignedURLParam{
+		Operation:     OperationDelete,
+		FileName:      fileName,
+		Timout:        deleteTimeout,
+		Bucket:        bucket.Bucket,
+		ObjectBaseURL: bucket.ObjectBaseURL,
+		Clock:         s.Clock,
+	})
+	if err != nil {
+		SendPresignError(w, r, err)
+		return
+	}
+
+	// Send the response
+	SendResponse(w, Success("pre-signed URL generated", s.presignedURLResponse(PreAssignedURL).withVerbosity(verbose)), http.StatusOK)
+}
+
+// Route GetHeadURL
+
+type GenerateHeadURLBody struct {
+	FileName         string `json:"file_name"`
+	ExpiresInSeconds int64  `json:"expires_in_seconds"`
+	BucketAlias      string `json:"bucket_alias"`
+	Region           string `json:"region"`
+	Verbose          *bool  `json:"verbose"`
+}
+
+// GetHeadURLHandler presigns a HEAD request so clients can read object metadata without downloading it
+func (s *Server) GetHeadURLHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the request body
+	var body GenerateHeadURLBody
+	if reqErr := s.decodeBody(w, r, &body); reqErr != nil {
+		// Send bad request response
+		SendRequestError(w, reqErr)
+		return
+	}
+	fileName, err := sanitizeKey(body.FileName)
+	if err != nil {
+		SendResponse(w, Error("file not found", err), http.StatusNotFound)
+		return
+	}
+	headTimeout, reqErr := s.resolveExpiration(body.ExpiresInSeconds)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	bucket, reqErr := s.resolveBucketRegion(body.BucketAlias, body.Region)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	verbose, reqErr := verboseResponse(r, body.Verbose)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	r.Body.Close()
+	// Validations - End
+
+	// Generate pre-signed URL
+	PreAssignedURL, err := GeneratePresignedURL(r.Context(), bucket.S3, GeneratePresignedURLParam{
+		Operation:     OperationHead,
+		FileName:      fileName,
+		Timout:        headTimeout,
+		Bucket:        bucket.Bucket,
+		ObjectBaseURL: bucket.ObjectBaseURL,
+		Clock:         s.Clock,
+	})
+	if err != nil {
+		SendPresignError(w, r, err)
+		return
+	}
+
+	// Send the response
+	SendResponse(w, Success("pre-signed URL generated", s.presignedURLResponse(PreAssignedURL).withVerbosity(verbose)), http.StatusOK)
+}
+
+// Route GetCopyURL
+
+type GenerateCopyURLBody struct {
+	SourceKey        string `json:"source_key"`
+	DestinationKey   string `json:"destination_key"`
+	ExpiresInSeconds int64  `json:"expires_in_seconds"`
+	BucketAlias      string `json:"bucket_alias"`
+	Region           string `json:"region"`
+	Verbose          *bool  `json:"verbose"`
+}
+
+// GetCopyURLHandler presigns a server-side copy between two keys of a bucket, for move and rename workflows
+func (s *Server) GetCopyURLHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the request body
+	var body GenerateCopyURLBody
+	if reqErr := s.decodeBody(w, r, &body); reqErr != nil {
+		// Send bad request response
+		SendRequestError(w, reqErr)
+		return
+	}
+	sourceKey, err := sanitizeKey(body.SourceKey)
+	if err != nil {
+		SendRequestError(w, BadRequest("invalid source_key", err).forField("source_key"))
+		return
+	}
+	destinationKey, err := sanitizeKey(body.DestinationKey)
+	if err != nil {
+		SendRequestError(w, BadRequest("invalid destination_key", err).forField("destination_key"))
+		return
+	}
+	if sourceKey == destinationKey {
+		SendRequestError(w, BadRequest("destination_key must differ from source_key", nil).forField("destination_key"))
+		return
+	}
+	copyTimeout, reqErr := s.resolveExpiration(body.ExpiresInSeconds)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	bucket, reqErr := s.resolveBucketRegion(body.BucketAlias, body.Region)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	verbose, reqErr := verboseResponse(r, body.Verbose)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	r.Body.Close()
+	// Validations - End
+
+	// Generate pre-signed URL
+	PreAssignedURL, err := GeneratePresignedURL(r.Context(), bucket.S3, GeneratePresignedURLParam{
+		Operation:     OperationCopy,
+		FileName:      destinationKey,
+		CopySourceKey: sourceKey,
+		Timout:        copyTimeout,
+		Bucket:        bucket.Bucket,
+		ObjectBaseURL: bucket.ObjectBaseURL,
+		Clock:         s.Clock,
+	})
+	if err != nil {
+		SendPresignError(w, r, err)
+		return
+	}
+
+	// Send the response
+	SendResponse(w, Success("pre-signed URL generated", s.presignedURLResponse(PreAssignedURL).withVerbosity(verbose)), http.StatusOK)
+}
+
+// Route ConfirmUpload
+
+type ConfirmUploadBody struct {
+	FileName string `json:"file_name"`
+	// ContentType and ContentLength are compared with the stored object when set
+	ContentType   string `json:"content_type"`
+	ContentLength int64  `json:"content_length"`
+	BucketAlias   string `json:"bucket_alias"`
+	Region        string `json:"region"`
+}
+
+type ConfirmUploadResponse struct {
+	FileName     string     `json:"file_name"`
+	ObjectUrl    string     `json:"object_url"`
+	Size         int64      `json:"size"`
+	ContentType  string     `json:"content_type"`
+	ETag         string     `json:"etag"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+}
+
+// ConfirmUploadHandler lets a client check that its upload reached the bucket as intended
+func (s *Server) ConfirmUploadHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the request body
+	var body ConfirmUploadBody
+	if reqErr := s.decodeBody(w, r, &body); reqErr != nil {
+		// Send bad request response
+		SendRequestError(w, reqErr)
+		return
+	}
+	fileName, err := sanitizeKey(body.FileName)
+	if err != nil {
+		SendResponse(w, Error("file not found", err), http.StatusNotFound)
+		return
+	}
+	if body.ContentLength < 0 {
+		SendRequestError(w, BadRequest("content_length must not be negative", nil).forField("content_length"))
+		return
+	}
+	bucket, reqErr := s.resolveBucketRegion(body.BucketAlias, body.Region)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	r.Body.Close()
+	// Validations - End
+
+	// Read the object metadata
+	var object *s3.HeadObjectOutput
+	err = withRetry(r.Context(), s.Config.MaxRetries, func() (err error) {
+		object, err = HeadObject(r.Context(), bucket.S3, bucket.Bucket, fileName, "")
+		return err
+	})
+	if isNotFound(err) {
+		SendResponse(w, Error("file not found", nil), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		SendPresignError(w, r, err)
+		return
+	}
+	size := aws.Int64Value(object.ContentLength)
+	contentType := aws.StringValue(object.ContentType)
+	var mismatches []string
+	if body.ContentType != "" && !strings.EqualFold(body.ContentType, contentType) {
+		mismatches = append(mismatches, fmt.Sprintf("content type is %q, expected %q", contentType, body.ContentType))
+	}
+	if body.ContentLength > 0 && body.ContentLength != size {
+		mismatches = append(mismatches, fmt.Sprintf("size is %d bytes, expected %d", size, body.ContentLength))
+	}
+	if len(mismatches) > 0 {
+		SendRequestError(w, &RequestError{
+			Status:  http.StatusConflict,
+			Message: "the uploaded file does not match: " + strings.Join(mismatches, ", "),
+			Code:    ERROR_CODE_UPLOAD_MISMATCH,
+		})
+		return
+	}
+	_, baseURL, err := bucketLocation(bucket.S3, bucket.Bucket)
+	if err != nil {
+		SendPresignError(w, r, err)
+		return
+	}
+
+	// Send the response
+	SendResponse(w, Success("upload confirmed", ConfirmUploadResponse{
+		FileName:     fileName,
+		ObjectUrl:    objectURL(baseURL, bucket.ObjectBaseURL, fileName),
+		Size:         size,
+		ContentType:  contentType,
+		ETag:         aws.StringValue(object.ETag),
+		LastModified: object.LastModified,
+	}), http.StatusOK)
+}
+
+// Route ListObjects
+
+const (
+	DEFAULT_LIST_LIMIT = 100
+	MAX_LIST_LIMIT     = 1000 // S3 limit
+)
+
+type ListedObject struct {
+	FileName     string     `json:"file_name"`
+	Size         *int64     `json:"size"`
+	LastModified *time.Time `json:"last_modified"`
+}
+
+type ListObjectsResponse struct {
+	Objects []ListedObject `json:"objects"`
+	// ContinuationToken is sent back as continuation_token to read the next page, empty on the last page
+	ContinuationToken string `json:"continuation_token,omitempty"`
+}
+
+// ListObjectsHandler lists the objects under a prefix one page at a time
+func (s *Server) ListObjectsHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the query
+	query := r.URL.Query()
+	limit := int64(DEFAULT_LIST_LIMIT)
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || limit <= 0 || limit > MAX_LIST_LIMIT {
+			SendRequestError(w, BadRequest(fmt.Sprintf("limit must be between 1 and %d", MAX_LIST_LIMIT), nil).forField("limit"))
+			return
+		}
+	}
+	bucket, reqErr := s.resolveBucketRegion(query.Get("bucket_alias"), query.Get("region"))
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	prefix, err := sanitizePrefix(query.Get("prefix"))
+	if err != nil {
+		SendRequestError(w, BadRequest("invalid prefix", err).forField("prefix"))
+		return
+	}
+	// Validations - End
+
+	var res ListObjectsResponse
+	err = withRetry(r.Context(), s.Config.MaxRetries, func() (err error) {
+		res, err = ListObjects(r.Context(), bucket.S3, ListObjectsParam{
+			Bucket:            bucket.Bucket,
+			Prefix:            bucket.KeyPrefix + prefix,
+			Limit:             limit,
+			ContinuationToken: query.Get("continuation_token"),
+		})
+		return err
+	})
+	if err != nil {
+		SendPresignError(w, r, err)
+		return
+	}
+
+	// Send the response
+	SendResponse(w, Success("objects listed", res), http.StatusOK)
+}
+
+// Route Multipart
+
+const MAX_PART_NUMBER = 10000 // S3 limit
+
+type CreateMultipartUploadBody struct {
+	FileName             string            `json:"file_name"`
+	Prefix               string            `json:"prefix"`
+	ContentType          string            `json:"content_type"`
+	Metadata             map[string]string `json:"metadata"`
+	ServerSideEncryption string            `json:"server_side_encryption"`
+	KMSKeyID             string            `json:"kms_key_id"`
+	BucketAlias          string            `json:"bucket_alias"`
+	ACL                  string            `json:"acl"`
+	CacheControl         string            `json:"cache_control"`
+	StorageClass         string            `json:"storage_class"`
+	ExpiresAt            string            `json:"expires_at"`
+	ContentHash          string            `json:"content_hash"`
+	Region               string            `json:"region"`
+}
+
+type CreateMultipartUploadResponse struct {
+	UploadId    string   `json:"upload_id"`
+	FileName    string   `json:"file_name"`
+	ContentType string   `json:"content_type"`
+	Details     []string `json:"details"`
+}
+
+type MultipartPartURLBody struct {
+	FileName         string `json:"file_name"`
+	UploadId         string `json:"upload_id"`
+	PartNumber       int64  `json:"part_number"`
+	ExpiresInSeconds int64  `json:"expires_in_seconds"`
+	BucketAlias      string `json:"bucket_alias"`
+	Region           string `json:"region"`
+}
+
+type CompleteMultipartUploadBody struct {
+	FileName         string `json:"file_name"`
+	UploadId         string `json:"upload_id"`
+	ExpiresInSeconds int64  `json:"expires_in_seconds"`
+	BucketAlias      string `json:"bucket_alias"`
+	Region           string `json:"region"`
+}
+
+// CreateMultipartUploadHandler starts a multipart upload and returns its upload ID
+func (s *Server) CreateMultipartUploadHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the request body
+	var body CreateMultipartUploadBody
+	if reqErr := s.decodeBody(w, r, &body); reqErr != nil {
+		// Send bad request response
+		SendRequestError(w, reqErr)
+		return
+	}
+	bucket, reqErr := s.resolveBucketRegion(body.BucketAlias, body.Region)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	// Every field is checked so clients can report all problems at once
+	var problems []*RequestError
+	fileName, contentType, reqErr := s.resolveUploadKey(bucket, body.FileName, body.Prefix, body.ContentType, body.ContentHash)
+	if reqErr != nil {
+		problems = append(problems, reqErr)
+	}
+	if err := validateMetadata(body.Metadata); err != nil {
+		problems = append(problems, BadRequest("invalid metadata", err).forField("metadata"))
+	}
+	if err := validateEncryption(body.ServerSideEncryption, body.KMSKeyID); err != nil {
+		problems = append(problems, BadRequest("invalid encryption", err).forField("server_side_encryption"))
+	}
+	acl, reqErr := s.resolveACL(body.ACL)
+	if reqErr != nil {
+		problems = append(problems, reqErr.forField("acl"))
+	}
+	cacheControl, reqErr := s.resolveCacheControl(body.CacheControl)
+	if reqErr != nil {
+		problems = append(problems, reqErr.forField("cache_control"))
+	}
+	storageClass, reqErr := s.resolveStorageClass(body.StorageClass)
+	if reqErr != nil {
+		problems = append(problems, reqErr.forField("storage_class"))
+	}
+	objectExpires, reqErr := s.resolveObjectExpires(body.ExpiresAt)
+	if reqErr != nil {
+		problems = append(problems, reqErr.forField("expires_at"))
+	}
+	if reqErr := joinFieldErrors(problems); reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	r.Body.Close()
+	// Validations - End
+
+	// Start the multipart upload
+	var MultipartUpload CreateMultipartUploadResponse
+	err := withRetry(r.Context(), s.Config.MaxRetries, func() (err error) {
+		MultipartUpload, err = CreateMultipartUpload(r.Context(), bucket.S3, CreateMultipartUploadParam{
+			FileName:             fileName,
+			Bucket:               bucket.Bucket,
+			ContentType:          contentType,
+			Metadata:             body.Metadata,
+			ServerSideEncryption: body.ServerSideEncryption,
+			SSEKMSKeyId:          body.KMSKeyID,
+			ACL:                  acl,
+			CacheControl:         cacheControl,
+			StorageClass:         storageClass,
+			ObjectExpires:        objectExpires,
+		})
+		return err
+	})
+	if err != nil {
+		SendPresignError(w, r, err)
+		return
+	}
+
+	// Send the response
+	SendResponse(w, Success("multipart upload created", MultipartUpload), http.StatusOK)
+}
+
+// MultipartPartURLHandler presigns the upload of a single part
+func (s *Server) MultipartPartURLHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the request body
+	var body MultipartPartURLBody
+	if reqErr := s.decodeBody(w, r, &body); reqErr != nil {
+		// Send bad request response
+		SendRequestError(w, reqErr)
+		return
+	}
+	// Every field is checked so clients can report all problems at once
+	var problems []*RequestError
+	fileName, err := sanitizeKey(body.FileName)
+	if err != nil {
+		problems = append(problems, BadRequest("invalid file name", err).forField("file_name"))
+	}
+	if body.UploadId == "" {
+		problems = append(problems, BadRequest("upload_id is required", nil).forField("upload_id"))
+	}
+	if body.PartNumber < 1 || body.PartNumber > MAX_PART_NUMBER {
+		problems = append(problems, BadRequest(fmt.Sprintf("part_number must be between 1 and %d", MAX_PART_NUMBER), nil).forField("part_number"))
+	}
+	partTimeout, reqErr := s.resolveExpiration(body.ExpiresInSeconds)
+	if reqErr != nil {
+		problems = append(problems, reqErr.forField("expires_in_seconds"))
+	}
+	if reqErr := joinFieldErrors(problems); reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	bucket, reqErr := s.resolveBucketRegion(body.BucketAlias, body.Region)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	r.Body.Close()
+	// Validations - End
+
+	// Generate pre-signed URL
+	PreAssignedURL, err := GeneratePresignedPartURL(r.Context(), bucket.S3, GeneratePresignedPartURLParam{
+		FileName:      fileName,
+		Timout:        partTimeout,
+		Bucket:        bucket.Bucket,
+		UploadId:      body.UploadId,
+		PartNumber:    body.PartNumber,
+		ObjectBaseURL: bucket.ObjectBaseURL,
+		Clock:         s.Clock,
+	})
+	if err != nil {
+		SendPresignError(w, r, err)
+		return
+	}
+
+	// Send the response
+	SendResponse(w, Success("pre-signed URL generated", s.presignedURLResponse(PreAssignedURL)), http.StatusOK)
+}
+
+// CompleteMultipartUploadHandler presigns the request that assembles the uploaded parts
+func (s *Server) CompleteMultipartUploadHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the request body
+	var body CompleteMultipartUploadBody
+	if reqErr := s.decodeBody(w, r, &body); reqErr != nil {
+		// Send bad request response
+		SendRequestError(w, reqErr)
+		return
+	}
+	// Every field is checked so clients can report all problems at once
+	var problems []*RequestError
+	fileName, err := sanitizeKey(body.FileName)
+	if err != nil {
+		problems = append(problems, BadRequest("invalid file name", err).forField("file_name"))
+	}
+	if body.UploadId == "" {
+		problems = append(problems, BadRequest("upload_id is required", nil).forField("upload_id"))
+	}
+	completeTimeout, reqErr := s.resolveExpiration(body.ExpiresInSeconds)
+	if reqErr != nil {
+		problems = append(problems, reqErr.forField("expires_in_seconds"))
+	}
+	if reqErr := joinFieldErrors(problems); reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	bucket, reqErr := s.resolveBucketRegion(body.BucketAlias, body.Region)
+	if reqErr != nil {
+		SendRequestError(w, reqErr)
+		return
+	}
+	r.Body.Close()
+	// Validations - End
+
+	// Generate pre-signed URL
+	PreAssignedURL, err := GeneratePresignedCompleteURL(r.Context(), bucket.S3, GeneratePresignedCompleteURLParam{
+		FileName:      fileName,
+		Timout:        completeTimeout,
+		Bucket:        bucket.Bucket,
+		UploadId:      body.UploadId,
+		ObjectBaseURL: bucket.ObjectBaseURL,
+		Clock:         s.Clock,
+	})
+	if err != nil {
+		SendPresignError(w, r, err)
+		return
+	}
+
+	// Send the response
+	SendResponse(w, Success("pre-signed URL generated", s.presignedURLResponse(PreAssignedURL)), http.StatusOK)
+}
+
+// Route Health
+
+const HEALTH_CHECK_TIMEOUT = 2 * time.Second
+
+// HealthzHandler reports ready only when the configured bucket is reachable
+// and, with CREDENTIALS_CHECK_INTERVAL_SECONDS, the credentials were last found valid
+func (s *Server) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	res := map[string]interface{}{"status": "ok"}
+	if s.Credentials != nil {
+		credentials := s.Credentials.Status()
+		if !credentials.Valid {
+			message := "AWS credentials are invalid"
+			if credentials.CheckedAt.IsZero() {
+				message = "AWS credentials have not been checked yet"
+			}
+			response := Error(message, nil)
+			response["credentials"] = credentials
+			SendResponse(w, response, http.StatusServiceUnavailable)
+			return
+		}
+		res["credentials"] = credentials
+	}
+
+	if local, ok := s.Storage.(*LocalBackend); ok {
+		// There is no bucket to reach, the storage directory is what uploads need
+		if _, err := os.Stat(local.Dir); err != nil {
+			slog.Error("health check failed", "request_id", middleware.GetReqID(r.Context()), "dir", local.Dir, "error", err)
+			SendResponse(w, Error("local storage is unavailable", nil), http.StatusServiceUnavailable)
+			return
+		}
+		res["storage"] = STORAGE_BACKEND_LOCAL
+		SendResponse(w, res, http.StatusOK)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+
+	err := withRetry(ctx, s.Config.MaxRetries, func() error {
+		_, err := s.S3.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+			Bucket: aws.String(s.Config.Bucket),
+		})
+		return err
+	})
+	if err != nil {
+		// AWS errors name the bucket and account, they stay in the logs
+		slog.Error("health check failed", "request_id", middleware.GetReqID(r.Context()), "bucket", s.Config.Bucket, "error", err)
+		SendResponse(w, Error("S3 is unreachable", nil), http.StatusServiceUnavailable)
+		return
+	}
+
+	SendResponse(w, res, http.StatusOK)
+}
+
+// LivezHandler reports that the process is up without touching AWS
+func LivezHandler(w http.ResponseWriter, r *http.Request) {
+	SendResponse(w, map[string]interface{}{"status": "ok"}, http.StatusOK)
+}
+
+// Route Version
+
+// Version and Commit are set at build time:
+// go build -ldflags "-X main.Version=1.2.0 -X main.Commit=$(git rev-parse HEAD)"
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+type VersionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"go_version"`
+}
+
+// VersionHandler reports which build is running
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	commit := Commit
+	if commit == "" {
+		// go build stamps the revision of a git checkout on its own
+		commit = "unknown"
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "vcs.revision" {
+					commit = setting.Value
+				}
+			}
+		}
+	}
+	SendResponse(w, VersionResponse{
+		Version:   Version,
+		Commit:    commit,
+		GoVersion: runtime.Version(),
+	}, http.StatusOK)
+}
+
+// Route fallbacks
+
+func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	SendResponse(w, Error(fmt.Sprintf("route %s not found", r.URL.Path), nil), http.StatusNotFound)
+}
+
+func MethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	SendResponse(w, Error(fmt.Sprintf("method %s not allowed on %s", r.Method, r.URL.Path), nil), http.StatusMethodNotAllowed)
+}
+
+// s3service
+
+// PresignError keeps the underlying AWS error behind the step that failed
+type PresignError struct {
+	Op  string
+	Err error
+}
+
+func (e *PresignError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *PresignError) Unwrap() error {
+	return e.Err
+}
+
+// S3Client is the part of the S3 API the service uses. *s3.S3 satisfies it and
+// tests can substitute a fake that never talks to AWS.
+type S3Client interface {
+	PutObjectRequest(*s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput)
+	GetObjectRequest(*s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput)
+	DeleteObjectRequest(*s3.DeleteObjectInput) (*request.Request, *s3.DeleteObjectOutput)
+	HeadObjectRequest(*s3.HeadObjectInput) (*request.Request, *s3.HeadObjectOutput)
+	CopyObjectRequest(*s3.CopyObjectInput) (*request.Request, *s3.CopyObjectOutput)
+	UploadPartRequest(*s3.UploadPartInput) (*request.Request, *s3.UploadPartOutput)
+	CompleteMultipartUploadRequest(*s3.CompleteMultipartUploadInput) (*request.Request, *s3.CompleteMultipartUploadOutput)
+	HeadBucketRequest(*s3.HeadBucketInput) (*request.Request, *s3.HeadBucketOutput)
+	HeadBucketWithContext(aws.Context, *s3.HeadBucketInput, ...request.Option) (*s3.HeadBucketOutput, error)
+	HeadObjectWithContext(aws.Context, *s3.HeadObjectInput, ...request.Option) (*s3.HeadObjectOutput, error)
+	CreateMultipartUploadWithContext(aws.Context, *s3.CreateMultipartUploadInput, ...request.Option) (*s3.CreateMultipartUploadOutput, error)
+	ListObjectsV2WithContext(aws.Context, *s3.ListObjectsV2Input, ...request.Option) (*s3.ListObjectsV2Output, error)
+}
+
+var _ S3Client = (*s3.S3)(nil)
+
+// StorageBackend presigns uploads, handlers go through it instead of S3 directly
+type StorageBackend interface {
+	PresignUpload(ctx context.Context, param GeneratePresignedURLParam) (PresignResult, error)
+}
+
+const (
+	STORAGE_BACKEND_S3    = "s3"
+	STORAGE_BACKEND_LOCAL = "local"
+)
+
+func newStorageBackend(config Config, svc S3Client, clock Clock) (StorageBackend, error) {
+	if config.StorageBackend == STORAGE_BACKEND_LOCAL {
+		return NewLocalBackend(config.LocalStorageDir, config.LocalBaseURL, clock)
+	}
+	return &S3Backend{S3: svc}, nil
+}
+
+// S3Backend presigns uploads as S3 PUT URLs
+type S3Backend struct {
+	S3 S3Client
+}
+
+func (b *S3Backend) PresignUpload(ctx context.Context, param GeneratePresignedURLParam) (PresignResult, error) {
+	return GeneratePresignedURL(ctx, b.S3, param)
+}
+
+// ROLE_CREDENTIALS_EXPIRY_WINDOW renews assumed role credentials before they lapse,
+// so a URL is never signed with credentials about to expire
+const ROLE_CREDENTIALS_EXPIRY_WINDOW = 5 * time.Minute
+
+// CredentialsProviderFactory builds the provider URLs are signed with, such as a
+// credentials.StaticProvider with fake keys in tests or a custom rotation in production
+type CredentialsProviderFactory func(sess *session.Session) credentials.Provider
+
+// sessionOptions loads the shared config files when a profile or the files are configured,
+// the environment and the default credential chain apply otherwise
+func sessionOptions(config Config, awsConfig *aws.Config) session.Options {
+	options := session.Options{Config: *awsConfig}
+	if config.Profile != "" || len(config.SharedConfigFiles) > 0 {
+		options.Profile = config.Profile
+		options.SharedConfigState = session.SharedConfigEnable
+		options.SharedConfigFiles = config.SharedConfigFiles
+	}
+	return options
+}
+
+func newS3Client(config Config) (*s3.S3, error) {
+	awsConfig := &aws.Config{
+		Region: aws.String(config.Region),
+		// withRetry owns the retry policy, SDK retries would multiply the attempts
+		MaxRetries: aws.Int(0),
+	}
+	// S3-compatible stores such as MinIO or DigitalOcean Spaces
+	if config.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.Endpoint)
+	}
+	if config.ForcePathStyle {
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	// Create a new session
+	sess, err := session.NewSessionWithOptions(sessionOptions(config, awsConfig))
+	if err != nil {
+		return nil, &PresignError{Op: "failed to create AWS session", Err: err}
+	}
+	if config.CredentialsProvider != nil {
+		sess.Config.Credentials = credentials.NewCredentials(config.CredentialsProvider(sess))
+	} else if config.RoleARN != "" {
+		sess.Config.Credentials = assumeRoleCredentials(sts.New(sess), config)
+	}
+
+	// Create S3 service client
+	svc := s3.New(sess)
+	if config.SignatureVersion == SIGNATURE_VERSION_2 {
+		svc.Handlers.Sign.Clear()
+		svc.Handlers.Sign.PushBackNamed(request.NamedHandler{Name: "signer.s3v2", Fn: signV2})
+	}
+	return svc, nil
+}
+
+// assumeRoleCredentials assumes AWS_ROLE_ARN through client. The credentials are cached and renewed ahead of expiry.
+func assumeRoleCredentials(client stscreds.AssumeRoler, config Config) *credentials.Credentials {
+	return credentials.NewCredentials(&retryingProvider{
+		Provider: &stscreds.AssumeRoleProvider{
+			Client:          client,
+			RoleARN:         config.RoleARN,
+			RoleSessionName: config.RoleSessionName,
+			Duration:        stscreds.DefaultDuration,
+			ExpiryWindow:    ROLE_CREDENTIALS_EXPIRY_WINDOW,
+		},
+		maxRetries: config.MaxRetries,
+	})
+}
+
+// SigV2
+
+const (
+	SIGNATURE_VERSION_4 = "v4"
+	SIGNATURE_VERSION_2 = "v2"
+)
+
+// v2SubResources are the query parameters SigV2 includes in the canonical resource
+var v2SubResources = map[string]bool{
+	"acl": true, "delete": true, "lifecycle": true, "location": true, "logging": true,
+	"notification": true, "partNumber": true, "policy": true, "requestPayment": true,
+	"tagging": true, "torrent": true, "uploadId": true, "uploads": true, "versionId": true,
+	"versioning": true, "versions": true, "website": true,
+	"response-cache-control": true, "response-content-disposition": true, "response-content-encoding": true,
+	"response-content-language": true, "response-content-type": true, "response-expires": true,
+}
+
+// signV2 signs S3 requests with the legacy signature version 2, in the query
+// string when presigning and in the Authorization header otherwise
+func signV2(r *request.Request) {
+	creds, err := r.Config.Credentials.GetWithContext(r.Context())
+	if err != nil {
+		r.Error = err
+		return
+	}
+	req := r.HTTPRequest
+	presign := r.ExpireTime > 0
+
+	// r.Time is the signing time, like the SigV4 signer uses
+	date := r.Time.UTC().Format(http.TimeFormat)
+	if presign {
+		date = strconv.FormatInt(r.Time.Add(r.ExpireTime).Unix(), 10)
+	} else {
+		req.Header.Set("Date", date)
+	}
+	if creds.SessionToken != "" && !presign {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	signed := http.Header{}
+	var amzHeaders []string
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			amzHeaders = append(amzHeaders, lower+":"+strings.Join(values, ","))
+			signed[name] = values
+		}
+	}
+	if creds.SessionToken != "" && presign {
+		amzHeaders = append(amzHeaders, "x-amz-security-token:"+creds.SessionToken)
+	}
+	sort.Strings(amzHeaders)
+	for _, name := range []string{"Content-MD5", "Content-Type"} {
+		if value := req.Header.Get(name); value != "" {
+			signed.Set(name, value)
+		}
+	}
+
+	stringToSign := strings.Join([]string{req.Method, req.Header.Get("Content-MD5"), req.Header.Get("Content-Type"), date}, "\n") + "\n"
+	for _, header := range amzHeaders {
+		stringToSign += header + "\n"
+	}
+	stringToSign += v2Resource(r)
+	mac := hmac.New(sha1.New, []byte(creds.SecretAccessKey))
+	mac.Write([]byte(stringToSign))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	if presign {
+		query := req.URL.Query()
+		query.Set("AWSAccessKeyId", creds.AccessKeyID)
+		query.Set("Expires", date)
+		query.Set("Signature", signature)
+		if creds.SessionToken != "" {
+			query.Set("x-amz-security-token", creds.SessionToken)
+		}
+		req.URL.RawQuery = query.Encode()
+	} else {
+		req.Header.Set("Authorization", fmt.Sprintf("AWS %s:%s", creds.AccessKeyID, signature))
+	}
+	r.SignedHeaderVals = signed
+}
+
+// v2Resource is the SigV2 canonical resource, /bucket/key plus the signed sub-resources
+func v2Resource(r *request.Request) string {
+	u := r.HTTPRequest.URL
+	resource := u.EscapedPath()
+	if buckets, _ := awsutil.ValuesAtPath(r.Params, "Bucket"); len(buckets) == 1 {
+		// Virtual hosted requests leave the bucket out of the path
+		bucket := aws.StringValue(buckets[0].(*string))
+		if strings.HasPrefix(u.Host, bucket+".") {
+			resource = "/" + bucket + resource
+		}
+	}
+	if resource == "" {
+		resource = "/"
+	}
+
+	query := u.Query()
+	var subResources []string
+	for name := range query {
+		if v2SubResources[name] {
+			subResources = append(subResources, name)
+		}
+	}
+	sort.Strings(subResources)
+	for i, name := range subResources {
+		if value := query.Get(name); value != "" {
+			subResources[i] = name + "=" + value
+		}
+	}
+	if len(subResources) > 0 {
+		resource += "?" + strings.Join(subResources, "&")
+	}
+	return resource
+}
+
+// bucketLocation returns the host and base URL clients use to address a bucket.
+// It lets the SDK build a request so region endpoints, custom endpoints, path style
+// and buckets with dots (path style over HTTPS) match the presigned URLs exactly.
+func bucketLocation(svc S3Client, bucket string) (host string, baseURL string, err error) {
+	req, _ := svc.HeadBucketRequest(&s3.HeadBucketInput{
+		Bucket: aws.String(bucket),
+	})
+	if err := req.Build(); err != nil {
+		return "", "", &PresignError{Op: "failed to resolve bucket URL", Err: err}
+	}
+
+	u := req.HTTPRequest.URL
+	return u.Host, fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, strings.TrimSuffix(u.EscapedPath(), "/")), nil
+}
+
+// Operations GeneratePresignedURL can sign
+const (
+	OperationPut    = "put"
+	OperationGet    = "get"
+	OperationDelete = "delete"
+	OperationHead   = "head"
+	OperationCopy   = "copy"
+)
+
+type GeneratePresignedURLParam struct {
+	// Operation selects the signed request, an empty value means OperationPut
+	Operation string
+	FileName  string
+	Timout    time.Duration
+	// ContentLength is signed as the Content-Length header, 0 leaves the length unbound
+	ContentLength int64
+	// MinUploadSize and MaxUploadSize bound the size of uploads whose length is not signed
+	MinUploadSize int64
+	MaxUploadSize int64
+	Bucket        string
+	ContentType   string
+	Metadata      map[string]string
+	// ServerSideEncryption and SSEKMSKeyId are signed as x-amz-server-side-encryption headers
+	ServerSideEncryption string
+	SSEKMSKeyId          string
+	ContentMD5           string
+	// ChecksumAlgorithm is signed into the query as X-Amz-Sdk-Checksum-Algorithm
+	ChecksumAlgorithm string
+	Tags              map[string]string
+	// ACL is signed as the x-amz-acl header
+	ACL string
+	// DryRun resolves the request without signing it
+	DryRun bool
+	// CacheControl is signed as the Cache-Control header
+	CacheControl string
+	// PreventOverwrite signs an If-None-Match: * condition
+	PreventOverwrite bool
+	// StorageClass is signed as the x-amz-storage-class header
+	StorageClass string
+	// ObjectExpires is signed as the Expires header, S3 stores it for caches and keeps the file past it
+	ObjectExpires time.Time
+	// ObjectBaseURL replaces the S3 host in ObjectUrl, such as a CDN in front of the bucket
+	ObjectBaseURL string
+	// ResponseContentDisposition overrides the Content-Disposition S3 answers a GET with
+	ResponseContentDisposition string
+	// ResponseContentType overrides the Content-Type S3 answers a GET with
+	ResponseContentType string
+	// VersionID selects an object version for a GET, it is signed into the query as versionId
+	VersionID string
+	// CopySourceKey is the key a copy reads from, FileName is the destination
+	CopySourceKey string
+	// Clock dates the signature, the system clock when nil
+	Clock Clock
+}
+
+// PresignResult is a signed request as the service produced it, handlers map it to a GeneratePresignedURLResponse
+type PresignResult struct {
+	Method         string
+	URL            string
+	ExpirationTime time.Time
+	FileName       string
+	Host           string
+	Details        []string
+	ObjectURL      string
+	// PathStyleURL and VirtualHostedURL are the object on S3 in both address styles
+	PathStyleURL     string
+	VirtualHostedURL string
+	// SignedHeaders are the headers bound by the signature, Host included
+	SignedHeaders http.Header
+	// SigningRegion is the region of the SigV4 credential scope, empty under SigV2
+	SigningRegion string
+}
+
+// signAt dates the signature at signedAt. SigV2 reads req.Time, the SigV4 handler S3 installs
+// reads time.Now itself, so it is swapped for one with the same options and the given time.
+func signAt(req *request.Request, signedAt time.Time) {
+	req.Time = signedAt
+	req.Handlers.Sign.Swap(v4.SignRequestHandler.Name, request.NamedHandler{
+		Name: v4.SignRequestHandler.Name,
+		Fn: func(r *request.Request) {
+			v4.SignSDKRequestWithCurrentTime(r, func() time.Time { return signedAt }, func(signer *v4.Signer) {
+				signer.DisableURIPathEscaping = true
+			})
+		},
+	})
+}
+
+// signingRegion is the region the client signs a request for, which custom endpoints don't change
+func signingRegion(req *request.Request) string {
+	if req.ClientInfo.SigningRegion != "" {
+		return req.ClientInfo.SigningRegion
+	}
+	return aws.StringValue(req.Config.Region)
+}
+
+// credentialScopeRegion is the region in the SigV4 credential scope of a signed URL, empty under SigV2 which signs no region
+func credentialScopeRegion(signedURL string) string {
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		return ""
+	}
+	// <access key>/<date>/<region>/s3/aws4_request
+	scope := strings.Split(u.Query().Get("X-Amz-Credential"), "/")
+	if len(scope) != 5 {
+		return ""
+	}
+	return scope[2]
+}
+
+func GeneratePresignedURL(ctx context.Context, svc S3Client, param GeneratePresignedURLParam) (res PresignResult, err error) {
+	ctx, span := tracer.Start(ctx, "GeneratePresignedURL", trace.WithAttributes(
+		attribute.String("presign.operation", param.Operation),
+		attribute.String("aws.s3.bucket", param.Bucket),
+		attribute.String("aws.s3.key", param.FileName),
+		attribute.Int64("presign.content_length", param.ContentLength),
+	))
+	defer func() { endSpan(span, err) }()
+
+	var req *request.Request
+	var usage string
+	switch param.Operation {
+	case OperationPut, "":
+		req, _ = svc.PutObjectRequest(putObjectInput(param))
+		if param.PreventOverwrite {
+			// PutObjectInput has no field for conditional writes in this SDK, the signer binds the header all the same
+			req.HTTPRequest.Header.Set("If-None-Match", "*")
+		}
+		usage = "Use the pre-signed URL to upload the file"
+	case OperationGet:
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(param.Bucket),
+			Key:    aws.String(param.FileName),
+		}
+		if param.ResponseContentDisposition != "" {
+			input.ResponseContentDisposition = aws.String(param.ResponseContentDisposition)
+		}
+		if param.ResponseContentType != "" {
+			input.ResponseContentType = aws.String(param.ResponseContentType)
+		}
+		if param.VersionID != "" {
+			input.VersionId = aws.String(param.VersionID)
+		}
+		req, _ = svc.GetObjectRequest(input)
+		usage = "Use the pre-signed URL to download the file"
+	case OperationDelete:
+		req, _ = svc.DeleteObjectRequest(&s3.DeleteObjectInput{
+			Bucket: aws.String(param.Bucket),
+			Key:    aws.String(param.FileName),
+		})
+		usage = "Issue a DELETE request to the pre-signed URL to remove the file"
+	case OperationHead:
+		req, _ = svc.HeadObjectRequest(&s3.HeadObjectInput{
+			Bucket: aws.String(param.Bucket),
+			Key:    aws.String(param.FileName),
+		})
+		usage = "Issue a HEAD request to the pre-signed URL to read the object metadata"
+	case OperationCopy:
+		req, _ = svc.CopyObjectRequest(&s3.CopyObjectInput{
+			Bucket:     aws.String(param.Bucket),
+			Key:        aws.String(param.FileName),
+			CopySource: aws.String(copySource(param.Bucket, param.CopySourceKey)),
+		})
+		usage = "Issue a PUT request with an empty body to the pre-signed URL to copy the file"
+	default:
+		return res, &PresignError{Op: "unsupported operation", Err: fmt.Errorf("unknown presign operation %q", param.Operation)}
+	}
+
+	// Credential lookups such as STS stop when the request is canceled
+	req.SetContext(ctx)
+
+	// Set the expiration for the pre-signed URL
+	// X-Amz-Date has second precision, the URL expires Timout after the truncated time
+	signedAt := clockNow(param.Clock).Truncate(time.Second)
+	signAt(req, signedAt)
+	var urlStr string
+	var signedHeaders http.Header
+	if !param.DryRun {
+		urlStr, signedHeaders, err = req.PresignRequest(param.Timout)
+		if err != nil {
+			return res, &PresignError{Op: "failed to sign request", Err: err}
+		}
+	}
+
+	// Return the pre-signed URL
+	res.Method = req.HTTPRequest.Method
+	res.URL = urlStr
+	res.SignedHeaders = signedHeaders
+	res.SigningRegion = credentialScopeRegion(urlStr)
+	res.FileName = param.FileName
+	res.ExpirationTime = signedAt.Add(param.Timout)
+	host, baseURL, err := bucketLocation(svc, param.Bucket)
+	if err != nil {
+		return res, err
+	}
+	res.Host = host
+	res.Details = []string{
+		usage,
+		fmt.Sprintf("The URL will expire after %s, at %s", describeTimeout(param.Timout), res.ExpirationTime.Format(time.RFC3339)),
+	}
+	if param.DryRun {
+		res.Details = append(res.Details, "Dry run, the request was validated but not signed")
+	}
+	if param.Operation == OperationCopy {
+		res.Details = append(res.Details,
+			fmt.Sprintf("Send the header x-amz-copy-source: %s", copySource(param.Bucket, param.CopySourceKey)),
+			fmt.Sprintf("The source file %s is left in place, delete it to complete a move", param.CopySourceKey),
+		)
+	} else if req.HTTPRequest.Method == http.MethodPut {
+		res.Details = append(res.Details, putObjectDetails(param)...)
+	}
+	if req.HTTPRequest.Method == http.MethodGet {
+		// Only the host is signed, so Range headers leave the signature valid
+		res.Details = append(res.Details, "Range requests are supported, send Range: bytes=start-end to read part of the file")
+	}
+	if req.HTTPRequest.Method == http.MethodHead {
+		res.Details = append(res.Details, "The metadata is in the response headers: Content-Length, Content-Type, ETag, Last-Modified and x-amz-meta-*")
+	}
+	res.ObjectURL = objectURL(baseURL, param.ObjectBaseURL, param.FileName)
+	if res.PathStyleURL, res.VirtualHostedURL, err = objectURLStyles(svc, param.Bucket, param.FileName); err != nil {
+		return res, err
+	}
+	if param.VersionID != "" {
+		res.Details = append(res.Details, fmt.Sprintf("The URL downloads version %s of the file", param.VersionID))
+		res.ObjectURL = withVersionID(res.ObjectURL, param.VersionID)
+		res.PathStyleURL = withVersionID(res.PathStyleURL, param.VersionID)
+		res.VirtualHostedURL = withVersionID(res.VirtualHostedURL, param.VersionID)
+	}
+
+	return res, nil
+}
+
+// describeTimeout writes a URL lifetime for the Details, in minutes only when it is a whole number of them
+func describeTimeout(timeout time.Duration) string {
+	unit, count := "second", int64(timeout/time.Second)
+	if timeout%time.Minute == 0 {
+		unit, count = "minute", int64(timeout/time.Minute)
+	}
+	if count != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s", count, unit)
+}
+
+// copySource is the x-amz-copy-source value of a key, the bucket and the URL-encoded key
+func copySource(bucket string, key string) string {
+	return bucket + "/" + (&url.URL{Path: key}).EscapedPath()
+}
+
+// withVersionID points an object URL at one version of the object, empty URLs stay empty
+func withVersionID(objectURL string, versionID string) string {
+	if objectURL == "" {
+		return ""
+	}
+	return objectURL + "?versionId=" + url.QueryEscape(versionID)
+}
+
+// requiredHeaders flattens the signed headers, host is left out as clients set it themselves
+func requiredHeaders(signed http.Header) map[string]string {
+	headers := make(map[string]string, len(signed))
+	for name, values := range signed {
+		if strings.EqualFold(name, "Host") {
+			continue
+		}
+		headers[http.CanonicalHeaderKey(name)] = strings.Join(values, ",")
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	return headers
+}
+
+// objectURLStyles returns the object URL in path style and in virtual-hosted style, the latter is
+// empty when the bucket name cannot be a host name, such as a name with dots over HTTPS or an IP endpoint
+func objectURLStyles(svc S3Client, bucket string, key string) (pathStyle string, virtualHosted string, err error) {
+	for _, forcePathStyle := range []bool{true, false} {
+		req, _ := svc.HeadBucketRequest(&s3.HeadBucketInput{
+			Bucket: aws.String(bucket),
+		})
+		// The request owns a copy of the client config
+		req.Config.S3ForcePathStyle = aws.Bool(forcePathStyle)
+		if err := req.Build(); err != nil {
+			return "", "", &PresignError{Op: "failed to resolve bucket URL", Err: err}
+		}
+		u := req.HTTPRequest.URL
+		baseURL := fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, strings.TrimSuffix(u.EscapedPath(), "/"))
+		if forcePathStyle {
+			pathStyle = objectURL(baseURL, "", key)
+		} else if endpoint, ok := strings.CutPrefix(u.Hostname(), bucket+"."); ok && net.ParseIP(endpoint) == nil {
+			virtualHosted = objectURL(baseURL, "", key)
+		}
+	}
+	return pathStyle, virtualHosted, nil
+}
+
+// objectURL addresses a key under the configured object base URL, the bucket base URL otherwise
+func objectURL(bucketBaseURL string, objectBaseURL string, key string) string {
+	if objectBaseURL != "" {
+		return fmt.Sprintf("%s/%s", objectBaseURL, key)
+	}
+	return fmt.Sprintf("%s/%s", bucketBaseURL, key)
+}
 
-	r.Post("/get-upload-url", GetUploadURLHandler)
+// putObjectInput builds the PutObject request whose headers the presigned URL binds
+func putObjectInput(param GeneratePresignedURLParam) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(param.Bucket),
+		Key:         aws.String(param.FileName),
+		ContentType: aws.String(param.ContentType),
+	}
+	if param.ContentLength > 0 {
+		input.ContentLength = aws.Int64(param.ContentLength)
+	}
+	if len(param.Metadata) > 0 {
+		input.Metadata = aws.StringMap(param.Metadata)
+	}
+	if param.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(param.ServerSideEncryption)
+	}
+	if param.SSEKMSKeyId != "" {
+		input.SSEKMSKeyId = aws.String(param.SSEKMSKeyId)
+	}
+	if param.ContentMD5 != "" {
+		input.ContentMD5 = aws.String(param.ContentMD5)
+	}
+	if param.ChecksumAlgorithm != "" {
+		input.ChecksumAlgorithm = aws.String(param.ChecksumAlgorithm)
+	}
+	if len(param.Tags) > 0 {
+		input.Tagging = aws.String(encodeTagging(param.Tags))
+	}
+	if param.ACL != "" {
+		input.ACL = aws.String(param.ACL)
+	}
+	if param.CacheControl != "" {
+		input.CacheControl = aws.String(param.CacheControl)
+	}
+	if param.StorageClass != "" {
+		input.StorageClass = aws.String(param.StorageClass)
+	}
+	if !param.ObjectExpires.IsZero() {
+		input.Expires = aws.Time(param.ObjectExpires)
+	}
+	return input
+}
 
-	http.ListenAndServe(":3000", r)
-	fmt.Println("Server started at http://localhost:3000")
+// putObjectDetails lists the upload limits and the headers the client has to send
+func putObjectDetails(param GeneratePresignedURLParam) []string {
+	details := []string{
+		fmt.Sprintf("The maximum upload size is %d bytes", param.MaxUploadSize),
+	}
+	if param.ContentLength == 0 {
+		details = append(details, fmt.Sprintf("The URL does not bind the content length, only a bucket policy can hold uploads to %d bytes", param.MaxUploadSize))
+	}
+	for _, key := range sortedKeys(param.Metadata) {
+		details = append(details, fmt.Sprintf("Send the header x-amz-meta-%s: %s", strings.ToLower(key), param.Metadata[key]))
+	}
+	if param.ServerSideEncryption != "" {
+		details = append(details, fmt.Sprintf("Send the header x-amz-server-side-encryption: %s", param.ServerSideEncryption))
+	}
+	if param.SSEKMSKeyId != "" {
+		details = append(details, fmt.Sprintf("Send the header x-amz-server-side-encryption-aws-kms-key-id: %s", param.SSEKMSKeyId))
+	}
+	if param.ContentMD5 != "" {
+		details = append(details, fmt.Sprintf("Send the header Content-MD5: %s", param.ContentMD5))
+	}
+	if param.ChecksumAlgorithm != "" {
+		details = append(details, fmt.Sprintf("Send the header x-amz-checksum-%s with the base64 %s checksum of the file", strings.ToLower(param.ChecksumAlgorithm), param.ChecksumAlgorithm))
+	}
+	if len(param.Tags) > 0 {
+		details = append(details, fmt.Sprintf("Send the header x-amz-tagging: %s", encodeTagging(param.Tags)))
+	}
+	if param.ACL != "" {
+		details = append(details, fmt.Sprintf("Send the header x-amz-acl: %s", param.ACL))
+	}
+	if param.CacheControl != "" {
+		details = append(details, fmt.Sprintf("Send the header Cache-Control: %s", param.CacheControl))
+	}
+	if !param.ObjectExpires.IsZero() {
+		details = append(details,
+			fmt.Sprintf("Send the header Expires: %s", param.ObjectExpires.Format(http.TimeFormat)),
+			"Expires only tells caches when the file is stale, a bucket lifecycle rule is what deletes it",
+		)
+	}
+	if param.StorageClass != "" {
+		details = append(details, fmt.Sprintf("Send the header x-amz-storage-class: %s", param.StorageClass))
+	}
+	if param.PreventOverwrite {
+		details = append(details, "Send the header If-None-Match: *, S3 answers 412 Precondition Failed when the file already exists")
+	}
+	return details
 }
 
-// Route GetUploadURL
+// HeadObject reads the metadata of an object, or of one version when versionID is set,
+// failing with a 404 request failure when it is missing
+func HeadObject(ctx context.Context, svc S3Client, bucket string, key string, versionID string) (out *s3.HeadObjectOutput, err error) {
+	ctx, span := tracer.Start(ctx, "HeadObject", trace.WithAttributes(
+		attribute.String("aws.s3.bucket", bucket),
+		attribute.String("aws.s3.key", key),
+	))
+	defer func() { endSpan(span, err) }()
 
-type GeneratePresignedURLBody struct {
-	ContentLength int64 `json:"content_length"`
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	out, err = svc.HeadObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, &PresignError{Op: "failed to read object metadata", Err: err}
+	}
+	return out, nil
 }
 
-type GeneratePresignedURLResponse struct {
-	Method         string    `json:"method"`
-	PreAssignedURL string    `json:"pre_assigned_url"`
-	ExpirationTime time.Time `json:"expiration_time"`
-	FileName       string    `json:"file_name"`
-	Host           string    `json:"host"`
-	Details        []string  `json:"details"`
-	ObjectUrl      string    `json:"object_url"`
+// isNotFound reports whether an AWS error means the object or bucket does not exist
+func isNotFound(err error) bool {
+	var failure awserr.RequestFailure
+	return errors.As(err, &failure) && failure.StatusCode() == http.StatusNotFound
 }
 
-func GetUploadURLHandler(w http.ResponseWriter, r *http.Request) {
-	// Parse the request body
-	var body GeneratePresignedURLBody
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		// Send bad request response
-		SendResponse(w, Error("invalid request body", err), http.StatusBadRequest)
-		return
+type ListObjectsParam struct {
+	Bucket            string
+	Prefix            string
+	Limit             int64
+	ContinuationToken string
+}
+
+func ListObjects(ctx context.Context, svc S3Client, param ListObjectsParam) (res ListObjectsResponse, err error) {
+	ctx, span := tracer.Start(ctx, "ListObjects", trace.WithAttributes(
+		attribute.String("aws.s3.bucket", param.Bucket),
+		attribute.String("aws.s3.prefix", param.Prefix),
+	))
+	defer func() { endSpan(span, err) }()
+
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(param.Bucket),
+		MaxKeys: aws.Int64(param.Limit),
 	}
-	const MAX_UPLOAD_SIZE int64 = 1 * 1024 * 1024 // 1 MB
-	if body.ContentLength <= 0 || body.ContentLength > MAX_UPLOAD_SIZE {
-		SendResponse(w, Error("invalid content length", nil), http.StatusBadRequest)
-		return
+	if param.Prefix != "" {
+		input.Prefix = aws.String(param.Prefix)
 	}
-	r.Body.Close()
-	// Validations - End
-
-	// Generate pre-signed URL
-	fileName := fmt.Sprintf("%s.png", time.Now().Format("2006-01-02-15-04-05"))
-	uploadTimeout := 10 * time.Minute
-	bucketName := os.Getenv("AWS_BUCKET")
-	PreAssignedURL, err := GeneratePresignedURL(GeneratePresignedURLParam{
-		FileName:      fileName,
-		Timout:        uploadTimeout,
-		ContentLength: body.ContentLength,
-		Bucket:        bucketName,
-		ContentType:   "image/png",
-	})
+	if param.ContinuationToken != "" {
+		input.ContinuationToken = aws.String(param.ContinuationToken)
+	}
+	out, err := svc.ListObjectsV2WithContext(ctx, input)
 	if err != nil {
-		SendResponse(w, Error("failed to create AWS session", err), http.StatusInternalServerError)
-		return
+		return ListObjectsResponse{}, &PresignError{Op: "failed to list objects", Err: err}
 	}
 
-	// Send the response
-	SendResponse(w, Success("pre-signed URL generated", GeneratePresignedURLResponse{
-		Method:         PreAssignedURL.Method,
-		PreAssignedURL: PreAssignedURL.PreAssignedURL,
-		ExpirationTime: PreAssignedURL.ExpirationTime,
-		FileName:       PreAssignedURL.FileName,
-		Host:           PreAssignedURL.Host,
-		Details:        PreAssignedURL.Details,
-		ObjectUrl:      PreAssignedURL.ObjectUrl,
-	}), http.StatusOK)
+	res.Objects = make([]ListedObject, 0, len(out.Contents))
+	for _, object := range out.Contents {
+		res.Objects = append(res.Objects, ListedObject{
+			FileName:     aws.StringValue(object.Key),
+			Size:         object.Size,
+			LastModified: object.LastModified,
+		})
+	}
+	if aws.BoolValue(out.IsTruncated) {
+		res.ContinuationToken = aws.StringValue(out.NextContinuationToken)
+	}
+	return res, nil
+}
 
+type CreateMultipartUploadParam struct {
+	FileName             string
+	Bucket               string
+	ContentType          string
+	Metadata             map[string]string
+	ServerSideEncryption string
+	SSEKMSKeyId          string
+	ACL                  string
+	CacheControl         string
+	StorageClass         string
+	ObjectExpires        time.Time
 }
 
-// s3service
+func CreateMultipartUpload(ctx context.Context, svc S3Client, param CreateMultipartUploadParam) (res CreateMultipartUploadResponse, err error) {
+	ctx, span := tracer.Start(ctx, "CreateMultipartUpload", trace.WithAttributes(
+		attribute.String("aws.s3.bucket", param.Bucket),
+		attribute.String("aws.s3.key", param.FileName),
+	))
+	defer func() { endSpan(span, err) }()
 
-type GeneratePresignedURLParam struct {
-	FileName      string
-	Timout        time.Duration
-	ContentLength int64
-	Bucket        string
-	ContentType   string
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(param.Bucket),
+		Key:         aws.String(param.FileName),
+		ContentType: aws.String(param.ContentType),
+	}
+	if len(param.Metadata) > 0 {
+		input.Metadata = aws.StringMap(param.Metadata)
+	}
+	if param.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(param.ServerSideEncryption)
+	}
+	if param.SSEKMSKeyId != "" {
+		input.SSEKMSKeyId = aws.String(param.SSEKMSKeyId)
+	}
+	if param.ACL != "" {
+		input.ACL = aws.String(param.ACL)
+	}
+	if param.CacheControl != "" {
+		input.CacheControl = aws.String(param.CacheControl)
+	}
+	if param.StorageClass != "" {
+		input.StorageClass = aws.String(param.StorageClass)
+	}
+	if !param.ObjectExpires.IsZero() {
+		input.Expires = aws.Time(param.ObjectExpires)
+	}
+
+	out, err := svc.CreateMultipartUploadWithContext(ctx, input)
+	if err != nil {
+		return res, &PresignError{Op: "failed to create multipart upload", Err: err}
+	}
+
+	res.UploadId = aws.StringValue(out.UploadId)
+	res.FileName = param.FileName
+	res.ContentType = param.ContentType
+	res.Details = []string{
+		"Request a pre-signed URL for every part from /multipart/part-url",
+		fmt.Sprintf("Parts are numbered from 1 to %d and all but the last must be at least 5 MB", MAX_PART_NUMBER),
+		"Request the completion URL from /multipart/complete once every part is uploaded",
+	}
+
+	return res, nil
 }
 
-func GeneratePresignedURL(param GeneratePresignedURLParam) (GeneratePresignedURLResponse, error) {
+type GeneratePresignedPartURLParam struct {
+	FileName   string
+	Timout     time.Duration
+	Bucket     string
+	UploadId   string
+	PartNumber int64
+	// ObjectBaseURL replaces the S3 host in ObjectUrl
+	ObjectBaseURL string
+	Clock         Clock
+}
 
-	var res GeneratePresignedURLResponse
+func GeneratePresignedPartURL(ctx context.Context, svc S3Client, param GeneratePresignedPartURLParam) (PresignResult, error) {
 
-	// aws s3
-	region := os.Getenv("AWS_REGION")
+	var res PresignResult
 
-	// Create a new session
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(region)},
-	)
+	// Set the expiration for the pre-signed URL
+	req, _ := svc.UploadPartRequest(&s3.UploadPartInput{
+		Bucket:     aws.String(param.Bucket),
+		Key:        aws.String(param.FileName),
+		UploadId:   aws.String(param.UploadId),
+		PartNumber: aws.Int64(param.PartNumber),
+	})
+	req.SetContext(ctx)
+
+	signedAt := clockNow(param.Clock).Truncate(time.Second)
+	signAt(req, signedAt)
+	urlStr, err := req.Presign(param.Timout)
 	if err != nil {
-		return res, fmt.Errorf("failed to create AWS session")
+		return res, &PresignError{Op: "failed to sign request", Err: err}
 	}
 
-	// Create S3 service client
-	svc := s3.New(sess)
+	// Return the pre-signed URL
+	res.Method = "PUT"
+	res.URL = urlStr
+	res.SigningRegion = credentialScopeRegion(urlStr)
+	res.FileName = param.FileName
+	res.ExpirationTime = signedAt.Add(param.Timout)
+	host, baseURL, err := bucketLocation(svc, param.Bucket)
+	if err != nil {
+		return res, err
+	}
+	res.Host = host
+	res.Details = []string{
+		fmt.Sprintf("Use the pre-signed URL to upload part %d", param.PartNumber),
+		fmt.Sprintf("The URL will expire after %s, at %s", describeTimeout(param.Timout), res.ExpirationTime.Format(time.RFC3339)),
+		"Keep the ETag response header, it is required to complete the upload",
+	}
+	res.ObjectURL = objectURL(baseURL, param.ObjectBaseURL, param.FileName)
+	if res.PathStyleURL, res.VirtualHostedURL, err = objectURLStyles(svc, param.Bucket, param.FileName); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+type GeneratePresignedCompleteURLParam struct {
+	FileName string
+	Timout   time.Duration
+	Bucket   string
+	UploadId string
+	// ObjectBaseURL replaces the S3 host in ObjectUrl
+	ObjectBaseURL string
+	Clock         Clock
+}
+
+func GeneratePresignedCompleteURL(ctx context.Context, svc S3Client, param GeneratePresignedCompleteURLParam) (PresignResult, error) {
+
+	var res PresignResult
 
 	// Set the expiration for the pre-signed URL
-	req, _ := svc.PutObjectRequest(&s3.PutObjectInput{
-		Bucket:        aws.String(param.Bucket),
-		Key:           aws.String(param.FileName),
-		ContentType:   aws.String(param.ContentType),
-		ContentLength: aws.Int64(param.ContentLength),
+	req, _ := svc.CompleteMultipartUploadRequest(&s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(param.Bucket),
+		Key:      aws.String(param.FileName),
+		UploadId: aws.String(param.UploadId),
 	})
+	req.SetContext(ctx)
 
+	signedAt := clockNow(param.Clock).Truncate(time.Second)
+	signAt(req, signedAt)
 	urlStr, err := req.Presign(param.Timout)
 	if err != nil {
-		return res, fmt.Errorf("failed to sign request")
+		return res, &PresignError{Op: "failed to sign request", Err: err}
 	}
 
 	// Return the pre-signed URL
-	res.Method = "PUT"
-	res.PreAssignedURL = urlStr
+	res.Method = "POST"
+	res.URL = urlStr
+	res.SigningRegion = credentialScopeRegion(urlStr)
+	res.FileName = param.FileName
+	res.ExpirationTime = signedAt.Add(param.Timout)
+	host, baseURL, err := bucketLocation(svc, param.Bucket)
+	if err != nil {
+		return res, err
+	}
+	res.Host = host
+	res.Details = []string{
+		"POST a CompleteMultipartUpload XML body listing every PartNumber and ETag to the pre-signed URL",
+		fmt.Sprintf("The URL will expire after %s, at %s", describeTimeout(param.Timout), res.ExpirationTime.Format(time.RFC3339)),
+	}
+	res.ObjectURL = objectURL(baseURL, param.ObjectBaseURL, param.FileName)
+	if res.PathStyleURL, res.VirtualHostedURL, err = objectURLStyles(svc, param.Bucket, param.FileName); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// GeneratePresignedPost builds a SigV4 signed POST policy for browser form uploads
+func GeneratePresignedPost(ctx context.Context, svc S3Client, param GeneratePresignedURLParam) (GeneratePresignedPostResponse, error) {
+
+	var res GeneratePresignedPostResponse
+
+	// Borrow the client's credentials and signing region from a request it builds
+	req, _ := svc.HeadBucketRequest(&s3.HeadBucketInput{
+		Bucket: aws.String(param.Bucket),
+	})
+	creds, err := req.Config.Credentials.GetWithContext(ctx)
+	if err != nil {
+		return res, &PresignError{Op: "failed to load AWS credentials", Err: err}
+	}
+
+	now := clockNow(param.Clock).UTC()
+	region := signingRegion(req)
+	res.SigningRegion = region
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+	credential := fmt.Sprintf("%s/%s/%s/s3/aws4_request", creds.AccessKeyID, date, region)
+	expiration := now.Add(param.Timout)
+
+	fields := map[string]string{
+		"key":              param.FileName,
+		"Content-Type":     param.ContentType,
+		"x-amz-algorithm":  "AWS4-HMAC-SHA256",
+		"x-amz-credential": credential,
+		"x-amz-date":       amzDate,
+	}
+	if creds.SessionToken != "" {
+		fields["x-amz-security-token"] = creds.SessionToken
+	}
+	for key, value := range param.Metadata {
+		fields["x-amz-meta-"+strings.ToLower(key)] = value
+	}
+	if param.ServerSideEncryption != "" {
+		fields["x-amz-server-side-encryption"] = param.ServerSideEncryption
+	}
+	if param.SSEKMSKeyId != "" {
+		fields["x-amz-server-side-encryption-aws-kms-key-id"] = param.SSEKMSKeyId
+	}
+	if len(param.Tags) > 0 {
+		tagging, err := encodePostTagging(param.Tags)
+		if err != nil {
+			return res, &PresignError{Op: "failed to encode tags", Err: err}
+		}
+		fields["tagging"] = tagging
+	}
+	if param.ACL != "" {
+		fields["acl"] = param.ACL
+	}
+	if param.CacheControl != "" {
+		fields["Cache-Control"] = param.CacheControl
+	}
+	if param.StorageClass != "" {
+		fields["x-amz-storage-class"] = param.StorageClass
+	}
+	if !param.ObjectExpires.IsZero() {
+		fields["Expires"] = param.ObjectExpires.Format(http.TimeFormat)
+	}
+
+	// S3 rejects files outside the range itself, the declared length is the upper bound when known
+	minLength := param.MinUploadSize
+	if minLength <= 0 {
+		minLength = DEFAULT_MIN_UPLOAD_SIZE
+	}
+	maxLength := param.ContentLength
+	if maxLength == 0 {
+		maxLength = param.MaxUploadSize
+	}
+	conditions := []interface{}{
+		map[string]string{"bucket": param.Bucket},
+		[]interface{}{"content-length-range", minLength, maxLength},
+	}
+	for name, value := range fields {
+		conditions = append(conditions, map[string]string{name: value})
+	}
+	policy, err := json.Marshal(map[string]interface{}{
+		"expiration": expiration.Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return res, &PresignError{Op: "failed to build POST policy", Err: err}
+	}
+	encodedPolicy := base64.StdEncoding.EncodeToString(policy)
+
+	// Derive the SigV4 signing key and sign the policy
+	signingKey := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	fields["policy"] = encodedPolicy
+	fields["x-amz-signature"] = hex.EncodeToString(hmacSHA256(signingKey, encodedPolicy))
+
+	// Return the pre-signed POST
+	_, baseURL, err := bucketLocation(svc, param.Bucket)
+	if err != nil {
+		return res, err
+	}
+	res.URL = baseURL + "/"
+	res.Fields = fields
+	res.FileName = param.FileName
+	res.ExpirationTime = expiration
+	res.ExpirationUnix = expiration.Unix()
+	res.Details = []string{
+		"Submit a multipart/form-data POST to the URL with every field, followed by the file field",
+		fmt.Sprintf("The policy will expire after %s, at %s", describeTimeout(param.Timout), res.ExpirationTime.Format(time.RFC3339)),
+		fmt.Sprintf("The upload size must be between %d and %d bytes", minLength, maxLength),
+	}
+	res.ObjectUrl = objectURL(baseURL, param.ObjectBaseURL, param.FileName)
+	if res.ObjectUrlPathStyle, res.ObjectUrlVirtualHosted, err = objectURLStyles(svc, param.Bucket, param.FileName); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// localstorage
+
+const DEFAULT_LOCAL_STORAGE_DIR = "./uploads"
+
+const LOCAL_UPLOAD_PATH = "/local-uploads"
+
+// LocalBackend stores uploads on disk behind HMAC signed URLs, for development without AWS
+type LocalBackend struct {
+	Dir     string
+	BaseURL string
+	// Clock checks URL expiry, it must be the clock that presigned them
+	Clock  Clock
+	secret []byte
+}
+
+// NewLocalBackend creates the storage directory and a signing secret that lives as long as the process
+func NewLocalBackend(dir string, baseURL string, clock Clock) (*LocalBackend, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create local storage directory: %w", err)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to create local signing secret: %w", err)
+	}
+	return &LocalBackend{Dir: dir, BaseURL: baseURL, Clock: clock, secret: secret}, nil
+}
+
+// sign binds the key, expiry and the headers the upload must send
+func (b *LocalBackend) sign(key string, expires int64, contentLength int64, contentType string) string {
+	return hex.EncodeToString(hmacSHA256(b.secret, fmt.Sprintf("%s\n%d\n%d\n%s", key, expires, contentLength, contentType)))
+}
+
+func (b *LocalBackend) PresignUpload(ctx context.Context, param GeneratePresignedURLParam) (PresignResult, error) {
+
+	var res PresignResult
+
+	expiration := clockNow(param.Clock).Truncate(time.Second).Add(param.Timout)
+	objectURL := fmt.Sprintf("%s%s/%s", b.BaseURL, LOCAL_UPLOAD_PATH, param.FileName)
+	if !param.DryRun {
+		query := url.Values{}
+		query.Set("expires", strconv.FormatInt(expiration.Unix(), 10))
+		res.SignedHeaders = http.Header{"Content-Type": {param.ContentType}}
+		if param.ContentLength > 0 {
+			query.Set("signature", b.sign(param.FileName, expiration.Unix(), param.ContentLength, param.ContentType))
+			res.SignedHeaders.Set("Content-Length", strconv.FormatInt(param.ContentLength, 10))
+		} else {
+			// Sign the size limit instead, UploadHandler enforces it while reading
+			query.Set("max_size", strconv.FormatInt(param.MaxUploadSize, 10))
+			query.Set("signature", b.sign(param.FileName, expiration.Unix(), -param.MaxUploadSize, param.ContentType))
+		}
+		res.URL = objectURL + "?" + query.Encode()
+	}
+	res.Method = http.MethodPut
 	res.FileName = param.FileName
-	res.ExpirationTime = time.Now().Add(param.Timout)
-	res.Host = fmt.Sprintf("%s.s3.amazonaws.com", param.Bucket)
+	res.ExpirationTime = expiration
+	if u, err := url.Parse(b.BaseURL); err == nil {
+		res.Host = u.Host
+	}
 	res.Details = []string{
 		"Use the pre-signed URL to upload the file",
-		fmt.Sprintf("The URL will expire after %d minutes", param.Timout),
-		fmt.Sprintf("The maximum upload size is %d bytes", param.ContentLength),
+		fmt.Sprintf("The URL will expire after %s, at %s", describeTimeout(param.Timout), res.ExpirationTime.Format(time.RFC3339)),
+		"The file is stored on the local filesystem, for development only",
 	}
-	res.ObjectUrl = fmt.Sprintf("https://%s/%s", res.Host, param.FileName)
+	res.ObjectURL = objectURL
 
 	return res, nil
 }
 
+// localPath maps a URL path under LOCAL_UPLOAD_PATH to a file inside Dir
+func (b *LocalBackend) localPath(r *http.Request) (string, string, error) {
+	key, err := sanitizeKey(chi.URLParam(r, "*"))
+	if err != nil {
+		return "", "", err
+	}
+	return key, filepath.Join(b.Dir, filepath.FromSlash(key)), nil
+}
+
+// UploadHandler stores a PUT made with a URL from PresignUpload
+func (b *LocalBackend) UploadHandler(w http.ResponseWriter, r *http.Request) {
+	key, filePath, err := b.localPath(r)
+	if err != nil {
+		SendRequestError(w, BadRequest("invalid file name", err).forField("file_name"))
+		return
+	}
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil {
+		SendResponse(w, Error("invalid expires", err), http.StatusForbidden)
+		return
+	}
+	if clockNow(b.Clock).Unix() > expires {
+		SendResponse(w, Error("the upload URL has expired", nil), http.StatusForbidden)
+		return
+	}
+	length := r.ContentLength
+	var maxSize int64
+	if value := r.URL.Query().Get("max_size"); value != "" {
+		if maxSize, err = strconv.ParseInt(value, 10, 64); err != nil || maxSize <= 0 {
+			SendResponse(w, Error("invalid max_size", err), http.StatusForbidden)
+			return
+		}
+		// Unknown length URLs are signed with the negated limit
+		length = -maxSize
+	}
+	expected := b.sign(key, expires, length, r.Header.Get("Content-Type"))
+	if !hmac.Equal([]byte(expected), []byte(r.URL.Query().Get("signature"))) {
+		SendResponse(w, Error("the signature does not match the request", nil), http.StatusForbidden)
+		return
+	}
+	// Validations - End
+
+	// Store the file
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		SendResponse(w, Error("failed to store file", err), http.StatusInternalServerError)
+		return
+	}
+	file, err := os.Create(filePath)
+	if err != nil {
+		SendResponse(w, Error("failed to store file", err), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	reader := io.LimitReader(r.Body, r.ContentLength)
+	if maxSize > 0 {
+		reader = http.MaxBytesReader(w, r.Body, maxSize)
+	}
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		os.Remove(filePath)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			SendResponse(w, Error(fmt.Sprintf("the file is larger than %d bytes", maxSize), nil), http.StatusRequestEntityTooLarge)
+			return
+		}
+		SendResponse(w, Error("failed to store file", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Send the response
+	SendResponse(w, Success("file uploaded", map[string]string{"file_name": key}), http.StatusOK)
+}
+
+// DownloadHandler serves files stored by UploadHandler
+func (b *LocalBackend) DownloadHandler(w http.ResponseWriter, r *http.Request) {
+	_, filePath, err := b.localPath(r)
+	if err != nil {
+		SendResponse(w, Error("file not found", err), http.StatusNotFound)
+		return
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		SendResponse(w, Error("file not found", nil), http.StatusNotFound)
+		return
+	}
+	http.ServeFile(w, r, filePath)
+}
+
 // Helper functions
 
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
 func SendResponse(w http.ResponseWriter, response interface{}, status int) {
+	if envelope, ok := response.(map[string]interface{}); ok {
+		// Tie the envelope to the server logs of the request
+		if id := w.Header().Get(REQUEST_ID_HEADER); id != "" {
+			envelope["request_id"] = id
+		}
+		if _, ok := envelope["code"]; !ok && envelope["success"] == false {
+			envelope["code"] = statusErrorCode(status)
+		}
+	}
+	requestID := w.Header().Get(REQUEST_ID_HEADER)
+	// Encode before writing anything so a failure can still change the status
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(response)
+	if err == nil && responseFieldStyle(w) == JSON_FIELD_STYLE_CAMEL {
+		// The response types are tagged in snake_case, their keys are renamed after encoding
+		var decoded interface{}
+		decoder := json.NewDecoder(&buf)
+		decoder.UseNumber()
+		if err = decoder.Decode(&decoded); err == nil {
+			buf.Reset()
+			err = json.NewEncoder(&buf).Encode(camelCaseKeys(decoded))
+		}
+	}
+	if err != nil {
+		slog.Error("failed to encode response", "request_id", requestID, "status", status, "error", err)
+		buf.Reset()
+		buf.WriteString(`{"message":"failed to encode response","success":false}` + "\n")
+		status = http.StatusInternalServerError
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(response)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		// The status is already sent, so the client only sees a truncated body
+		slog.Error("failed to write response", "request_id", requestID, "status", status, "error", err)
+	}
+}
+
+// SendPresignError logs the full error chain and only tells the client which step failed,
+// and answers 504 when the request ran out of its REQUEST_TIMEOUT_SECONDS budget
+func SendPresignError(w http.ResponseWriter, r *http.Request, err error) {
+	LogPresignError(r, err)
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		res := Error("the request took longer than the server allows, try again", nil)
+		res["code"] = ERROR_CODE_TIMEOUT
+		SendResponse(w, res, http.StatusGatewayTimeout)
+		return
+	}
+	res := Error(PresignErrorMessage(err), nil)
+	res["code"] = ERROR_CODE_AWS_ERROR
+	SendResponse(w, res, http.StatusInternalServerError)
+}
+
+func LogPresignError(r *http.Request, err error) {
+	slog.Error("presign failed", "request_id", middleware.GetReqID(r.Context()), "error", err)
+}
+
+// PresignErrorMessage is the client-safe description of a presign failure
+func PresignErrorMessage(err error) string {
+	var presignErr *PresignError
+	if errors.As(err, &presignErr) {
+		return presignErr.Op
+	}
+	return "failed to generate pre-signed URL"
+}
+
+// Error codes are the stable code field of error responses, clients branch on them instead of the message
+const (
+	ERROR_CODE_INVALID_REQUEST          = "INVALID_REQUEST"
+	ERROR_CODE_INVALID_BODY             = "INVALID_BODY"
+	ERROR_CODE_INVALID_FIELDS           = "INVALID_FIELDS"
+	ERROR_CODE_INVALID_CONTENT_LENGTH   = "INVALID_CONTENT_LENGTH"
+	ERROR_CODE_UNSUPPORTED_CONTENT_TYPE = "UNSUPPORTED_CONTENT_TYPE"
+	ERROR_CODE_CONTENT_TYPE_MISMATCH    = "CONTENT_TYPE_MISMATCH"
+	ERROR_CODE_INVALID_FILE_NAME        = "INVALID_FILE_NAME"
+	ERROR_CODE_INVALID_EXPIRATION       = "INVALID_EXPIRATION"
+	ERROR_CODE_BATCH_TOO_LARGE          = "BATCH_TOO_LARGE"
+	ERROR_CODE_IDEMPOTENCY_KEY_REUSED   = "IDEMPOTENCY_KEY_REUSED"
+	ERROR_CODE_UPLOAD_MISMATCH          = "UPLOAD_MISMATCH"
+	ERROR_CODE_UNAUTHORIZED             = "UNAUTHORIZED"
+	ERROR_CODE_FORBIDDEN                = "FORBIDDEN"
+	ERROR_CODE_NOT_FOUND                = "NOT_FOUND"
+	ERROR_CODE_METHOD_NOT_ALLOWED       = "METHOD_NOT_ALLOWED"
+	ERROR_CODE_PAYLOAD_TOO_LARGE        = "PAYLOAD_TOO_LARGE"
+	ERROR_CODE_UNSUPPORTED_MEDIA_TYPE   = "UNSUPPORTED_MEDIA_TYPE"
+	ERROR_CODE_RATE_LIMITED             = "RATE_LIMITED"
+	ERROR_CODE_UNAVAILABLE              = "UNAVAILABLE"
+	ERROR_CODE_NOT_IMPLEMENTED          = "NOT_IMPLEMENTED"
+	ERROR_CODE_AWS_ERROR                = "AWS_ERROR"
+	ERROR_CODE_TIMEOUT                  = "TIMEOUT"
+	ERROR_CODE_INTERNAL_ERROR           = "INTERNAL_ERROR"
+)
+
+// fieldErrorCodes are the codes of the validation failures clients most often handle
+var fieldErrorCodes = map[string]string{
+	"content_length":     ERROR_CODE_INVALID_CONTENT_LENGTH,
+	"content_type":       ERROR_CODE_UNSUPPORTED_CONTENT_TYPE,
+	"file_name":          ERROR_CODE_INVALID_FILE_NAME,
+	"expires_in_seconds": ERROR_CODE_INVALID_EXPIRATION,
+}
+
+// statusErrorCode is the code of an error that has none of its own
+func statusErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ERROR_CODE_INVALID_REQUEST
+	case http.StatusUnauthorized:
+		return ERROR_CODE_UNAUTHORIZED
+	case http.StatusForbidden:
+		return ERROR_CODE_FORBIDDEN
+	case http.StatusNotFound:
+		return ERROR_CODE_NOT_FOUND
+	case http.StatusMethodNotAllowed:
+		return ERROR_CODE_METHOD_NOT_ALLOWED
+	case http.StatusRequestEntityTooLarge:
+		return ERROR_CODE_PAYLOAD_TOO_LARGE
+	case http.StatusUnsupportedMediaType:
+		return ERROR_CODE_UNSUPPORTED_MEDIA_TYPE
+	case http.StatusTooManyRequests:
+		return ERROR_CODE_RATE_LIMITED
+	case http.StatusServiceUnavailable:
+		return ERROR_CODE_UNAVAILABLE
+	case http.StatusNotImplemented:
+		return ERROR_CODE_NOT_IMPLEMENTED
+	case http.StatusGatewayTimeout:
+		return ERROR_CODE_TIMEOUT
+	}
+	if status >= 500 {
+		return ERROR_CODE_INTERNAL_ERROR
+	}
+	return ERROR_CODE_INVALID_REQUEST
+}
+
+// RequestError is a client error reported with its own status code
+type RequestError struct {
+	Status  int
+	Message string
+	Err     error
+	// Code overrides the code derived from the field and the status
+	Code string
+	// Field is the request field at fault, Fields lists every invalid field
+	Field  string
+	Fields []FieldError
+}
+
+// FieldError is one entry of the errors array of a validation failure
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func BadRequest(message string, err error) *RequestError {
+	return &RequestError{Status: http.StatusBadRequest, Message: message, Err: err}
+}
+
+// forField names the request field the error is about
+func (e *RequestError) forField(field string) *RequestError {
+	e.Field = field
+	return e
+}
+
+// withCode sets the code the error is reported with
+func (e *RequestError) withCode(code string) *RequestError {
+	e.Code = code
+	return e
+}
+
+// code is the explicit code, else the code of the field, else the code of the status
+func (e *RequestError) code() string {
+	if e.Code != "" {
+		return e.Code
+	}
+	if code, ok := fieldErrorCodes[e.Field]; ok {
+		return code
+	}
+	return statusErrorCode(e.Status)
+}
+
+// joinFieldErrors folds field errors into one, a single problem keeps its own status
+func joinFieldErrors(problems []*RequestError) *RequestError {
+	if len(problems) == 0 {
+		return nil
+	}
+	var fields []FieldError
+	for _, problem := range problems {
+		if len(problem.Fields) > 0 {
+			// Already joined, its fields are merged in
+			fields = append(fields, problem.Fields...)
+			continue
+		}
+		field := FieldError{Field: problem.Field, Code: problem.code(), Message: problem.Message}
+		if problem.Err != nil {
+			field.Message += ": " + problem.Err.Error()
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) == 1 {
+		reqErr := *problems[0]
+		reqErr.Fields = fields
+		return &reqErr
+	}
+	return &RequestError{
+		Status:  http.StatusBadRequest,
+		Message: fmt.Sprintf("%d fields are invalid", len(fields)),
+		Code:    ERROR_CODE_INVALID_FIELDS,
+		Fields:  fields,
+	}
+}
+
+// Response is the error envelope of a RequestError
+func (e *RequestError) Response() map[string]interface{} {
+	res := Error(e.Message, e.Err)
+	res["code"] = e.code()
+	if len(e.Fields) > 0 {
+		res["errors"] = e.Fields
+	}
+	return res
+}
+
+func SendRequestError(w http.ResponseWriter, reqErr *RequestError) {
+	SendResponse(w, reqErr.Response(), reqErr.Status)
 }
 
 func Error(message string, err error) map[string]interface{} {
@@ -0,0 +1,3884 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/go-chi/chi/middleware"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// fakeS3 is an S3Client that never reaches AWS. The embedded client only builds and signs
+// requests, which is local, and the calls that would be sent to S3 are answered from memory.
+type fakeS3 struct {
+	*s3.S3
+
+	mu      sync.Mutex
+	objects map[string]*s3.HeadObjectOutput
+	// calls counts the operations that would have reached S3
+	calls map[string]int
+	// multipartInputs are the CreateMultipartUpload calls received
+	multipartInputs []*s3.CreateMultipartUploadInput
+	// headBucketErr fails HeadBucket, as an unreachable or missing bucket does
+	headBucketErr error
+	// delay holds every call until it passes or the request context ends
+	delay time.Duration
+}
+
+var _ S3Client = (*fakeS3)(nil)
+
+func newFakeS3(t testing.TB, config Config) *fakeS3 {
+	t.Helper()
+	svc, err := newS3Client(config)
+	if err != nil {
+		t.Fatalf("newS3Client: %v", err)
+	}
+	return &fakeS3{S3: svc, objects: map[string]*s3.HeadObjectOutput{}, calls: map[string]int{}}
+}
+
+// putObject stores an object the fake then reports through HeadObject and ListObjectsV2
+func (f *fakeS3) putObject(bucket string, key string, size int64, contentType string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[bucket+"/"+key] = &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(size),
+		ContentType:   aws.String(contentType),
+		ETag:          aws.String(`"` + strconv.Itoa(len(f.objects)) + `"`),
+		LastModified:  aws.Time(time.Date(2024, 4, 9, 12, 0, 0, 0, time.UTC)),
+	}
+}
+
+func (f *fakeS3) callCount(operation string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[operation]
+}
+
+// call records an operation and waits out the delay
+func (f *fakeS3) call(ctx aws.Context, operation string) error {
+	f.mu.Lock()
+	f.calls[operation]++
+	delay := f.delay
+	f.mu.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+	}
+}
+
+func notFoundError() error {
+	return awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), http.StatusNotFound, "fake-request-id")
+}
+
+func (f *fakeS3) HeadBucketWithContext(ctx aws.Context, input *s3.HeadBucketInput, _ ...request.Option) (*s3.HeadBucketOutput, error) {
+	if err := f.call(ctx, "HeadBucket"); err != nil {
+		return nil, err
+	}
+	if f.headBucketErr != nil {
+		return nil, f.headBucketErr
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *fakeS3) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, _ ...request.Option) (*s3.HeadObjectOutput, error) {
+	if err := f.call(ctx, "HeadObject"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object, ok := f.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)]
+	if !ok {
+		return nil, notFoundError()
+	}
+	return object, nil
+}
+
+func (f *fakeS3) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, _ ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	if err := f.call(ctx, "CreateMultipartUpload"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.multipartInputs = append(f.multipartInputs, input)
+	return &s3.CreateMultipartUploadOutput{
+		Bucket:   input.Bucket,
+		Key:      input.Key,
+		UploadId: aws.String("upload-" + strconv.Itoa(len(f.multipartInputs))),
+	}, nil
+}
+
+// ListObjectsV2WithContext pages through the stored keys in order, the continuation token is the next index
+func (f *fakeS3) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, _ ...request.Option) (*s3.ListObjectsV2Output, error) {
+	if err := f.call(ctx, "ListObjectsV2"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	bucketPrefix := aws.StringValue(input.Bucket) + "/"
+	var keys []string
+	for name := range f.objects {
+		if key, ok := strings.CutPrefix(name, bucketPrefix); ok && strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start := 0
+	if input.ContinuationToken != nil {
+		index, err := strconv.Atoi(*input.ContinuationToken)
+		if err != nil || index > len(keys) {
+			return nil, awserr.NewRequestFailure(awserr.New("InvalidArgument", "bad continuation token", nil), http.StatusBadRequest, "fake-request-id")
+		}
+		start = index
+	}
+	end := len(keys)
+	if limit := int(aws.Int64Value(input.MaxKeys)); limit > 0 && start+limit < end {
+		end = start + limit
+	}
+
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(end < len(keys))}
+	for _, key := range keys[start:end] {
+		object := f.objects[bucketPrefix+key]
+		out.Contents = append(out.Contents, &s3.Object{Key: aws.String(key), Size: object.ContentLength, LastModified: object.LastModified})
+	}
+	if end < len(keys) {
+		out.NextContinuationToken = aws.String(strconv.Itoa(end))
+	}
+	return out, nil
+}
+
+// setTestEnv clears every variable listed in example.env, so the developer's environment
+// can't leak into a test, then applies the test defaults and env on top
+func setTestEnv(t testing.TB, env map[string]string) {
+	t.Helper()
+	file, err := os.Open("example.env")
+	if err != nil {
+		t.Fatalf("failed to open example.env: %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if name, _, ok := strings.Cut(scanner.Text(), "="); ok {
+			t.Setenv(name, "")
+		}
+	}
+
+	defaults := map[string]string{
+		"AWS_REGION":            "us-east-1",
+		"AWS_BUCKET":            "test-bucket",
+		"AWS_ACCESS_KEY_ID":     "AKIDTEST",
+		"AWS_SECRET_ACCESS_KEY": "test-secret",
+		// High enough that only the rate limit tests hit it
+		"RATE_LIMIT_PER_SECOND": "1000",
+		"RATE_LIMIT_BURST":      "1000",
+	}
+	for name, value := range defaults {
+		t.Setenv(name, value)
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+}
+
+// newTestConfig loads the configuration from the test environment
+func newTestConfig(t testing.TB, env map[string]string) Config {
+	t.Helper()
+	setTestEnv(t, env)
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	return config
+}
+
+// newTestServer wires a Server the way main does, without the background goroutines,
+// around a fakeS3 that tests reach through testS3
+func newTestServer(t testing.TB, env map[string]string) *Server {
+	t.Helper()
+	config := newTestConfig(t, env)
+	svc := newFakeS3(t, config)
+	storage, err := newStorageBackend(config, svc, SystemClock{})
+	if err != nil {
+		t.Fatalf("newStorageBackend: %v", err)
+	}
+	regions := NewRegionClients(config, svc)
+	buckets, err := newBucketTargets(config, regions, storage)
+	if err != nil {
+		t.Fatalf("newBucketTargets: %v", err)
+	}
+	server := &Server{Config: config, S3: svc, Storage: storage, Buckets: buckets, Regions: regions, Clock: SystemClock{}}
+	server.Idempotency = NewMemoryIdempotencyStore(SystemClock{})
+	server.Keys = newKeyStrategy(config)
+	if config.WebhookURL != "" {
+		server.Webhook = NewWebhook(config.WebhookURL)
+	}
+	server.setUploadsEnabled(config.UploadsEnabled)
+	return server
+}
+
+// testS3 is the fake behind a server built by newTestServer
+func testS3(server *Server) *fakeS3 {
+	return server.S3.(*fakeS3)
+}
+
+// setClock swaps the clock of the server and of everything that compares times with it
+func setClock(server *Server, clock Clock) {
+	server.Clock = clock
+	if store, ok := server.Idempotency.(*MemoryIdempotencyStore); ok {
+		store.Clock = clock
+	}
+	if local, ok := server.Storage.(*LocalBackend); ok {
+		local.Clock = clock
+	}
+}
+
+// newTestRouter is newTestServer behind the production routes
+func newTestRouter(t testing.TB, env map[string]string) (*Server, http.Handler) {
+	t.Helper()
+	server := newTestServer(t, env)
+	return server, newRouter(server, server.Config)
+}
+
+// doRequest sends body, a string or a value encoded as JSON, to the handler
+func doRequest(t testing.TB, handler http.Handler, method string, target string, body interface{}, headers ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader *bytes.Reader
+	switch body := body.(type) {
+	case nil:
+		reader = bytes.NewReader(nil)
+	case string:
+		reader = bytes.NewReader([]byte(body))
+	default:
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("failed to encode body: %v", err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeJSON decodes the response body into a generic JSON value
+func decodeJSON(t testing.TB, rec *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &decoded); err != nil {
+		t.Fatalf("response is not a JSON object: %v: %s", err, rec.Body.String())
+	}
+	return decoded
+}
+
+// decodeData decodes the data of a Success envelope into v
+func decodeData(t testing.TB, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	var envelope struct {
+		Success bool            `json:"success"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("response is not a JSON envelope: %v: %s", err, rec.Body.String())
+	}
+	if !envelope.Success {
+		t.Fatalf("response is not a success: %s", rec.Body.String())
+	}
+	if err := json.Unmarshal(envelope.Data, v); err != nil {
+		t.Fatalf("failed to decode data: %v: %s", err, envelope.Data)
+	}
+}
+
+// expectStatus fails the test when the response has another status
+func expectStatus(t testing.TB, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, status, rec.Body.String())
+	}
+}
+
+func TestRouteFallbacksAreJSON(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		status int
+		code   string
+	}{
+		{"unknown path", http.MethodGet, "/does-not-exist", http.StatusNotFound, ERROR_CODE_NOT_FOUND},
+		{"wrong method", http.MethodGet, "/get-upload-url", http.StatusMethodNotAllowed, ERROR_CODE_METHOD_NOT_ALLOWED},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, router, tt.method, tt.target, nil)
+			expectStatus(t, rec, tt.status)
+			if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", contentType)
+			}
+			res := decodeJSON(t, rec)
+			if res["success"] != false || res["code"] != tt.code {
+				t.Errorf("body = %v, want success false and code %s", res, tt.code)
+			}
+		})
+	}
+}
+
+func TestGeneratePresignedURLWithFakeS3(t *testing.T) {
+	config := newTestConfig(t, nil)
+	svc := newFakeS3(t, config)
+
+	res, err := GeneratePresignedURL(context.Background(), svc, GeneratePresignedURLParam{
+		FileName:      "photo.png",
+		Timout:        DEFAULT_EXPIRATION,
+		ContentLength: 1234,
+		Bucket:        config.Bucket,
+		ContentType:   "image/png",
+	})
+	if err != nil {
+		t.Fatalf("GeneratePresignedURL: %v", err)
+	}
+	u, err := url.Parse(res.URL)
+	if err != nil {
+		t.Fatalf("invalid pre-signed URL %q: %v", res.URL, err)
+	}
+	if u.Host != "test-bucket.s3.amazonaws.com" || u.Path != "/photo.png" {
+		t.Errorf("URL = %s, want the photo.png key on the test bucket", res.URL)
+	}
+	if u.Query().Get("X-Amz-Signature") == "" {
+		t.Errorf("URL %s is not signed", res.URL)
+	}
+	if res.Method != http.MethodPut {
+		t.Errorf("Method = %s, want PUT", res.Method)
+	}
+	// Signing is local, nothing was sent to S3
+	if len(svc.calls) != 0 {
+		t.Errorf("S3 calls = %v, want none", svc.calls)
+	}
+}
+
+func TestMaxUploadSizeFromEnv(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"MAX_UPLOAD_SIZE_BYTES": strconv.Itoa(5 * 1024 * 1024)})
+
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 4 * 1024 * 1024})
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 6 * 1024 * 1024})
+	expectStatus(t, rec, http.StatusBadRequest)
+	if res := decodeJSON(t, rec); res["code"] != ERROR_CODE_INVALID_CONTENT_LENGTH {
+		t.Errorf("code = %v, want %s", res["code"], ERROR_CODE_INVALID_CONTENT_LENGTH)
+	}
+}
+
+func TestMaxUploadSizeFallback(t *testing.T) {
+	for _, value := range []string{"", "five", "-1"} {
+		config := newTestConfig(t, map[string]string{"MAX_UPLOAD_SIZE_BYTES": value})
+		if config.MaxUploadSize != DEFAULT_MAX_UPLOAD_SIZE {
+			t.Errorf("MAX_UPLOAD_SIZE_BYTES=%q: MaxUploadSize = %d, want %d", value, config.MaxUploadSize, DEFAULT_MAX_UPLOAD_SIZE)
+		}
+	}
+}
+
+// fixedClock is a Clock stopped at one instant
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+// testNow is the instant of the tests that fix the clock
+var testNow = time.Date(2024, 4, 9, 19, 39, 12, 0, time.UTC)
+
+func TestPresignDetailsExpiration(t *testing.T) {
+	config := newTestConfig(t, nil)
+	res, err := GeneratePresignedURL(context.Background(), newFakeS3(t, config), GeneratePresignedURLParam{
+		FileName:      "photo.png",
+		Timout:        10 * time.Minute,
+		ContentLength: 1234,
+		Bucket:        config.Bucket,
+		ContentType:   "image/png",
+		Clock:         fixedClock(testNow),
+	})
+	if err != nil {
+		t.Fatalf("GeneratePresignedURL: %v", err)
+	}
+	details := strings.Join(res.Details, "\n")
+	if !strings.Contains(details, "10 minutes") {
+		t.Errorf("Details = %q, want them to mention 10 minutes", details)
+	}
+	if !strings.Contains(details, "2024-04-09T19:49:12Z") {
+		t.Errorf("Details = %q, want them to mention the expiration time", details)
+	}
+}
+
+func BenchmarkGetUploadURL(b *testing.B) {
+	server := newTestServer(b, nil)
+	handler := http.HandlerFunc(server.GetUploadURLHandler)
+	body := `{"content_length":1234}`
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec := doRequest(b, handler, http.MethodPost, "/get-upload-url", body)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+}
+
+// BenchmarkGetUploadURLClientPerRequest is the baseline of a session and client built for every request
+func BenchmarkGetUploadURLClientPerRequest(b *testing.B) {
+	server := newTestServer(b, nil)
+	body := `{"content_length":1234}`
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		svc, err := newS3Client(server.Config)
+		if err != nil {
+			b.Fatalf("newS3Client: %v", err)
+		}
+		server.S3 = svc
+		server.Storage = &S3Backend{S3: svc}
+		rec := doRequest(b, http.HandlerFunc(server.GetUploadURLHandler), http.MethodPost, "/get-upload-url", body)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	server, router := newTestRouter(t, nil)
+
+	rec := doRequest(t, router, http.MethodGet, "/healthz", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if res := decodeJSON(t, rec); res["status"] != "ok" {
+		t.Errorf("body = %v, want status ok", res)
+	}
+
+	testS3(server).headBucketErr = awserr.NewRequestFailure(awserr.New("Forbidden", "Access Denied for arn:aws:iam::123456789012:user/presigner", nil), http.StatusForbidden, "fake-request-id")
+	rec = doRequest(t, router, http.MethodGet, "/healthz", nil)
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	res := decodeJSON(t, rec)
+	if res["message"] != "S3 is unreachable" {
+		t.Errorf("message = %v, want S3 is unreachable", res["message"])
+	}
+	if strings.Contains(rec.Body.String(), "123456789012") || res["error"] != nil {
+		t.Errorf("body leaks the AWS error: %s", rec.Body.String())
+	}
+}
+
+func TestLivezSkipsS3(t *testing.T) {
+	server, router := newTestRouter(t, nil)
+	testS3(server).headBucketErr = notFoundError()
+
+	rec := doRequest(t, router, http.MethodGet, "/livez", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if calls := testS3(server).callCount("HeadBucket"); calls != 0 {
+		t.Errorf("HeadBucket calls = %d, want 0", calls)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Run("all present", func(t *testing.T) {
+		config := newTestConfig(t, nil)
+		if config.Region != "us-east-1" || config.Bucket != "test-bucket" {
+			t.Errorf("Region, Bucket = %q, %q, want us-east-1, test-bucket", config.Region, config.Bucket)
+		}
+	})
+
+	t.Run("several missing", func(t *testing.T) {
+		setTestEnv(t, map[string]string{"AWS_REGION": "", "AWS_BUCKET": ""})
+		_, err := loadConfig()
+		if err == nil {
+			t.Fatal("loadConfig succeeded without AWS_REGION and AWS_BUCKET")
+		}
+		for _, name := range []string{"AWS_REGION", "AWS_BUCKET"} {
+			if !strings.Contains(err.Error(), name) {
+				t.Errorf("error %q does not name %s", err, name)
+			}
+		}
+	})
+}
+
+// presignUpload posts body to /get-upload-url and decodes the issued URL
+func presignUpload(t testing.TB, router http.Handler, body interface{}, headers ...string) GeneratePresignedURLResponse {
+	t.Helper()
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", body, headers...)
+	expectStatus(t, rec, http.StatusOK)
+	var res GeneratePresignedURLResponse
+	decodeData(t, rec, &res)
+	return res
+}
+
+func TestSanitizeKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		want  string
+		valid bool
+	}{
+		{"users/42/avatar.png", "users/42/avatar.png", true},
+		{"/leading/slash.png", "leading/slash.png", true},
+		{"../etc/passwd", "", false},
+		{"users/../../secret.png", "", false},
+		{"users/..hidden.png", "", false},
+		{"users//avatar.png", "", false},
+		{"users/./avatar.png", "", false},
+		{"spaces are bad.png", "", false},
+		{"", "", false},
+		{strings.Repeat("a", MAX_KEY_LENGTH+1), "", false},
+	}
+	for _, tt := range tests {
+		got, err := sanitizeKey(tt.key)
+		if tt.valid && (err != nil || got != tt.want) {
+			t.Errorf("sanitizeKey(%q) = %q, %v, want %q", tt.key, got, err, tt.want)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("sanitizeKey(%q) = %q, want an error", tt.key, got)
+		}
+	}
+}
+
+func TestUploadFileName(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "file_name": "users/42/avatar.png"})
+	if res.FileName != "users/42/avatar.png" {
+		t.Errorf("FileName = %q, want users/42/avatar.png", res.FileName)
+	}
+	if !strings.Contains(res.PreAssignedURL, "/users/42/avatar.png?") {
+		t.Errorf("URL %s does not target the requested key", res.PreAssignedURL)
+	}
+	if res.RequiredHeaders["Content-Type"] != "image/png" {
+		t.Errorf("Content-Type = %q, want image/png from the extension", res.RequiredHeaders["Content-Type"])
+	}
+
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234, "file_name": "../../etc/passwd.png"})
+	expectStatus(t, rec, http.StatusBadRequest)
+	if res := decodeJSON(t, rec); res["code"] != ERROR_CODE_INVALID_FILE_NAME {
+		t.Errorf("code = %v, want %s", res["code"], ERROR_CODE_INVALID_FILE_NAME)
+	}
+}
+
+// errNoCredentials is returned by failingProvider
+var errNoCredentials = errors.New("no credentials for the test")
+
+// failingProvider is a credentials.Provider that never resolves
+type failingProvider struct{}
+
+func (failingProvider) Retrieve() (credentials.Value, error) {
+	return credentials.Value{}, errNoCredentials
+}
+
+func (failingProvider) IsExpired() bool {
+	return true
+}
+
+func TestPresignErrorKeepsCause(t *testing.T) {
+	config := newTestConfig(t, nil)
+	config.CredentialsProvider = func(*session.Session) credentials.Provider { return failingProvider{} }
+	svc := newFakeS3(t, config)
+
+	_, err := GeneratePresignedURL(context.Background(), svc, GeneratePresignedURLParam{
+		FileName:      "photo.png",
+		Timout:        DEFAULT_EXPIRATION,
+		ContentLength: 1234,
+		Bucket:        config.Bucket,
+		ContentType:   "image/png",
+	})
+	if err == nil {
+		t.Fatal("GeneratePresignedURL signed without credentials")
+	}
+	var presignErr *PresignError
+	if !errors.As(err, &presignErr) || presignErr.Op != "failed to sign request" {
+		t.Errorf("error %v is not the failed signing PresignError", err)
+	}
+	if !errors.Is(err, errNoCredentials) {
+		t.Errorf("error %v lost the credentials error", err)
+	}
+	if message := PresignErrorMessage(err); message != "failed to sign request" {
+		t.Errorf("PresignErrorMessage = %q, want only the failed step", message)
+	}
+}
+
+func TestRunShutsDownGracefully(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a port: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		SendResponse(w, Success("done", nil), http.StatusOK)
+	})
+	done := make(chan error, 1)
+	go func() { done <- run(&http.Server{Addr: addr, Handler: handler}) }()
+
+	// run handles signals once it is listening
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server never listened on %s: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	inFlight := make(chan int, 1)
+	go func() {
+		res, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			inFlight <- 0
+			return
+		}
+		res.Body.Close()
+		inFlight <- res.StatusCode
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("failed to signal: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run = %v, want a clean shutdown", err)
+		}
+	case <-time.After(SHUTDOWN_TIMEOUT):
+		t.Fatal("server did not shut down within the grace period")
+	}
+	if status := <-inFlight; status != http.StatusOK {
+		t.Errorf("in-flight request status = %d, want it to finish with 200", status)
+	}
+}
+
+func TestResolveListenAddr(t *testing.T) {
+	tests := []struct {
+		listenAddr string
+		port       string
+		want       string
+		valid      bool
+	}{
+		{"", "", DEFAULT_LISTEN_ADDR, true},
+		{"", "8080", ":8080", true},
+		{"127.0.0.1:9000", "8080", "127.0.0.1:9000", true},
+		{"[::1]:3000", "", "[::1]:3000", true},
+		{"localhost", "", "", false},
+		{"", "http", "", false},
+		{"", "70000", "", false},
+		{":-1", "", "", false},
+	}
+	for _, tt := range tests {
+		got, err := resolveListenAddr(tt.listenAddr, tt.port)
+		if tt.valid && (err != nil || got != tt.want) {
+			t.Errorf("resolveListenAddr(%q, %q) = %q, %v, want %q", tt.listenAddr, tt.port, got, err, tt.want)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("resolveListenAddr(%q, %q) = %q, want an error", tt.listenAddr, tt.port, got)
+		}
+	}
+}
+
+func TestAllowedContentTypes(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowed     string
+		contentType string
+		status      int
+	}{
+		{"allowed", "image/png,application/pdf", "application/pdf", http.StatusOK},
+		{"disallowed", "image/png,application/pdf", "image/jpeg", http.StatusUnsupportedMediaType},
+		{"empty config allows png", "", "image/png", http.StatusOK},
+		{"empty config rejects others", "", "application/pdf", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, router := newTestRouter(t, map[string]string{"ALLOWED_CONTENT_TYPES": tt.allowed})
+			rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234, "content_type": tt.contentType})
+			expectStatus(t, rec, tt.status)
+		})
+	}
+}
+
+func TestDescribeTimeout(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    string
+	}{
+		{10 * time.Minute, "10 minutes"},
+		{time.Minute, "1 minute"},
+		{90 * time.Second, "90 seconds"},
+		{MAX_EXPIRATION, "10080 minutes"},
+	}
+	for _, tt := range tests {
+		if got := describeTimeout(tt.timeout); got != tt.want {
+			t.Errorf("describeTimeout(%s) = %q, want %q", tt.timeout, got, tt.want)
+		}
+	}
+}
+
+func TestUploadExpiresInSeconds(t *testing.T) {
+	server, router := newTestRouter(t, nil)
+	setClock(server, fixedClock(testNow))
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "expires_in_seconds": 90})
+	if want := testNow.Add(90 * time.Second); !res.ExpirationTime.Equal(want) {
+		t.Errorf("ExpirationTime = %s, want %s", res.ExpirationTime, want)
+	}
+	if details := strings.Join(res.Details, "\n"); !strings.Contains(details, "expire after 90 seconds") {
+		t.Errorf("Details = %q, want the 90 second lifetime", details)
+	}
+
+	for _, seconds := range []int64{30, int64(MAX_EXPIRATION/time.Second) + 1, -5} {
+		rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234, "expires_in_seconds": seconds})
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"ALLOWED_ORIGINS": "https://app.example.com"})
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		return doRequest(t, router, http.MethodOptions, "/get-upload-url", nil,
+			"Origin", origin,
+			"Access-Control-Request-Method", http.MethodPost,
+			"Access-Control-Request-Headers", "Content-Type, Authorization",
+		)
+	}
+
+	rec := preflight("https://app.example.com")
+	if origin := rec.Header().Get("Access-Control-Allow-Origin"); origin != "https://app.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the allowed origin", origin)
+	}
+	if methods := rec.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(methods, http.MethodPost) {
+		t.Errorf("Access-Control-Allow-Methods = %q, want POST", methods)
+	}
+	if headers := strings.ToLower(rec.Header().Get("Access-Control-Allow-Headers")); !strings.Contains(headers, "content-type") || !strings.Contains(headers, "authorization") {
+		t.Errorf("Access-Control-Allow-Headers = %q, want Content-Type and Authorization", headers)
+	}
+
+	rec = preflight("https://evil.example.com")
+	if origin := rec.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("Access-Control-Allow-Origin = %q for a disallowed origin, want none", origin)
+	}
+}
+
+func TestCORSDeniedByDefault(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234}, "Origin", "https://app.example.com")
+	if origin := rec.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("Access-Control-Allow-Origin = %q without ALLOWED_ORIGINS, want none", origin)
+	}
+}
+
+func TestCustomEndpointPathStyle(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{
+		"AWS_ENDPOINT":            "http://localhost:9000",
+		"AWS_S3_FORCE_PATH_STYLE": "true",
+	})
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "file_name": "photo.png"})
+	if res.Host != "localhost:9000" {
+		t.Errorf("Host = %q, want the custom endpoint", res.Host)
+	}
+	if res.ObjectUrl != "http://localhost:9000/test-bucket/photo.png" {
+		t.Errorf("ObjectUrl = %q, want the path-style URL on the custom endpoint", res.ObjectUrl)
+	}
+	if !strings.HasPrefix(res.PreAssignedURL, "http://localhost:9000/test-bucket/photo.png?") {
+		t.Errorf("URL = %q, want the path-style URL on the custom endpoint", res.PreAssignedURL)
+	}
+}
+
+func TestRegionalHosts(t *testing.T) {
+	tests := []struct {
+		region    string
+		bucket    string
+		host      string
+		objectURL string
+	}{
+		{"us-east-1", "test-bucket", "test-bucket.s3.amazonaws.com", "https://test-bucket.s3.amazonaws.com/photo.png"},
+		{"eu-central-1", "test-bucket", "test-bucket.s3.eu-central-1.amazonaws.com", "https://test-bucket.s3.eu-central-1.amazonaws.com/photo.png"},
+		// TLS certificates don't cover dotted bucket names, so they are addressed path-style
+		{"eu-central-1", "assets.example.com", "s3.eu-central-1.amazonaws.com", "https://s3.eu-central-1.amazonaws.com/assets.example.com/photo.png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.region+" "+tt.bucket, func(t *testing.T) {
+			config := newTestConfig(t, map[string]string{"AWS_REGION": tt.region, "AWS_BUCKET": tt.bucket})
+			res, err := GeneratePresignedURL(context.Background(), newFakeS3(t, config), GeneratePresignedURLParam{
+				FileName:      "photo.png",
+				Timout:        DEFAULT_EXPIRATION,
+				ContentLength: 1234,
+				Bucket:        tt.bucket,
+				ContentType:   "image/png",
+			})
+			if err != nil {
+				t.Fatalf("GeneratePresignedURL: %v", err)
+			}
+			if res.Host != tt.host {
+				t.Errorf("Host = %q, want %q", res.Host, tt.host)
+			}
+			if res.ObjectURL != tt.objectURL {
+				t.Errorf("ObjectURL = %q, want %q", res.ObjectURL, tt.objectURL)
+			}
+			if !strings.HasPrefix(res.URL, tt.objectURL+"?") {
+				t.Errorf("URL = %q, want it to start with the object URL", res.URL)
+			}
+		})
+	}
+}
+
+// containsDetail reports whether one of the details contains substr
+func containsDetail(details []string, substr string) bool {
+	for _, detail := range details {
+		if strings.Contains(detail, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestUploadMetadata(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "metadata": map[string]string{"owner-id": "42"}})
+	if value := res.RequiredHeaders["X-Amz-Meta-Owner-Id"]; value != "42" {
+		t.Errorf("required headers = %v, want X-Amz-Meta-Owner-Id: 42", res.RequiredHeaders)
+	}
+	if !strings.Contains(strings.Join(res.SignedHeaders, ";"), "x-amz-meta-owner-id") {
+		t.Errorf("signed headers = %v, want x-amz-meta-owner-id", res.SignedHeaders)
+	}
+	if !containsDetail(res.Details, "x-amz-meta-owner-id: 42") {
+		t.Errorf("Details = %q, want the metadata header", res.Details)
+	}
+
+	for _, metadata := range []map[string]string{
+		{"owner id": "42"},
+		{"owner": "line\nbreak"},
+		{"owner": strings.Repeat("x", MAX_METADATA_SIZE)},
+	} {
+		rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234, "metadata": metadata})
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+}
+
+func TestUploadEncryption(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "server_side_encryption": "AES256"})
+	if value := res.RequiredHeaders["X-Amz-Server-Side-Encryption"]; value != "AES256" {
+		t.Errorf("required headers = %v, want x-amz-server-side-encryption: AES256", res.RequiredHeaders)
+	}
+
+	res = presignUpload(t, router, map[string]interface{}{"content_length": 1234, "server_side_encryption": "aws:kms", "kms_key_id": "alias/uploads"})
+	if value := res.RequiredHeaders["X-Amz-Server-Side-Encryption"]; value != "aws:kms" {
+		t.Errorf("required headers = %v, want x-amz-server-side-encryption: aws:kms", res.RequiredHeaders)
+	}
+	if value := res.RequiredHeaders["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"]; value != "alias/uploads" {
+		t.Errorf("required headers = %v, want the KMS key id", res.RequiredHeaders)
+	}
+	if !containsDetail(res.Details, "x-amz-server-side-encryption-aws-kms-key-id: alias/uploads") {
+		t.Errorf("Details = %q, want the KMS key header", res.Details)
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"content_length": 1234, "server_side_encryption": "AES256", "kms_key_id": "alias/uploads"},
+		{"content_length": 1234, "kms_key_id": "alias/uploads"},
+		{"content_length": 1234, "server_side_encryption": "rot13"},
+	} {
+		rec := doRequest(t, router, http.MethodPost, "/get-upload-url", body)
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+}
+
+// batchItem is one entry of the /get-upload-urls response
+type batchItem struct {
+	Success bool                         `json:"success"`
+	Code    string                       `json:"code"`
+	Data    GeneratePresignedURLResponse `json:"data"`
+}
+
+func TestUploadBatchPartialFailure(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-urls", []map[string]interface{}{
+		{"file_name": "one.png", "content_length": 1234},
+		{"file_name": "../two.png", "content_length": 1234},
+		{"file_name": "three.png", "content_length": 0},
+		{"file_name": "four.png", "content_length": 1234},
+	})
+	expectStatus(t, rec, http.StatusOK)
+	var items []batchItem
+	decodeData(t, rec, &items)
+	if len(items) != 4 {
+		t.Fatalf("got %d items, want 4", len(items))
+	}
+	for i, want := range []bool{true, false, false, true} {
+		if items[i].Success != want {
+			t.Errorf("item %d success = %v, want %v", i, items[i].Success, want)
+		}
+	}
+	if items[0].Data.FileName != "one.png" || items[3].Data.FileName != "four.png" {
+		t.Errorf("file names = %q, %q, want one.png and four.png", items[0].Data.FileName, items[3].Data.FileName)
+	}
+	if items[1].Code != ERROR_CODE_INVALID_FILE_NAME || items[2].Code != ERROR_CODE_INVALID_CONTENT_LENGTH {
+		t.Errorf("codes = %q, %q, want the file name and content length codes", items[1].Code, items[2].Code)
+	}
+}
+
+func TestUploadBatchMaxSize(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"MAX_BATCH_SIZE": "2"})
+
+	item := map[string]interface{}{"content_length": 1234}
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-urls", []map[string]interface{}{item, item, item})
+	expectStatus(t, rec, http.StatusBadRequest)
+	if res := decodeJSON(t, rec); res["code"] != ERROR_CODE_BATCH_TOO_LARGE {
+		t.Errorf("code = %v, want %s", res["code"], ERROR_CODE_BATCH_TOO_LARGE)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		forwarded  []string
+		trustProxy bool
+		want       string
+	}{
+		{"remote address", nil, false, "192.0.2.1"},
+		{"forwarded ignored without a proxy", []string{"203.0.113.7"}, false, "192.0.2.1"},
+		{"single entry", []string{"203.0.113.7"}, true, "203.0.113.7"},
+		{"spoofed entries before the proxy's", []string{"10.0.0.1, 198.51.100.9, 203.0.113.7"}, true, "203.0.113.7"},
+		{"repeated headers", []string{"10.0.0.1", "203.0.113.7"}, true, "203.0.113.7"},
+		{"empty last entry", []string{"203.0.113.7,"}, true, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "192.0.2.1:4321"
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if got := clientIP(req, tt.trustProxy); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{
+		"RATE_LIMIT_PER_SECOND": "0.01",
+		"RATE_LIMIT_BURST":      "2",
+		"TRUST_PROXY_HEADERS":   "true",
+	})
+	body := map[string]interface{}{"content_length": 1234}
+
+	for i := 0; i < 2; i++ {
+		// A client rotating a spoofed X-Forwarded-For entry still shares the proxy's last entry
+		rec := doRequest(t, router, http.MethodPost, "/get-upload-url", body, "X-Forwarded-For", fmt.Sprintf("10.0.0.%d, 203.0.113.7", i))
+		expectStatus(t, rec, http.StatusOK)
+	}
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", body, "X-Forwarded-For", "10.0.0.9, 203.0.113.7")
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	if retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || retryAfter <= 0 {
+		t.Errorf("Retry-After = %q, want a positive number of seconds", rec.Header().Get("Retry-After"))
+	}
+	if res := decodeJSON(t, rec); res["code"] != ERROR_CODE_RATE_LIMITED {
+		t.Errorf("code = %v, want %s", res["code"], ERROR_CODE_RATE_LIMITED)
+	}
+
+	// Other clients have their own budget
+	rec = doRequest(t, router, http.MethodPost, "/get-upload-url", body, "X-Forwarded-For", "203.0.113.8")
+	expectStatus(t, rec, http.StatusOK)
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"API_KEYS": "key-one,key-two"})
+	body := map[string]interface{}{"content_length": 1234}
+
+	tests := []struct {
+		name    string
+		headers []string
+		status  int
+		message string
+	}{
+		{"bearer key", []string{"Authorization", "Bearer key-one"}, http.StatusOK, ""},
+		{"X-API-Key", []string{"X-API-Key", "key-two"}, http.StatusOK, ""},
+		{"invalid key", []string{"Authorization", "Bearer key-three"}, http.StatusUnauthorized, "invalid API key"},
+		{"key prefix", []string{"X-API-Key", "key-on"}, http.StatusUnauthorized, "invalid API key"},
+		{"missing key", nil, http.StatusUnauthorized, "missing API key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, router, http.MethodPost, "/get-upload-url", body, tt.headers...)
+			expectStatus(t, rec, tt.status)
+			if tt.message != "" {
+				if res := decodeJSON(t, rec); res["message"] != tt.message || res["code"] != ERROR_CODE_UNAUTHORIZED {
+					t.Errorf("body = %v, want %q with code %s", res, tt.message, ERROR_CODE_UNAUTHORIZED)
+				}
+			}
+		})
+	}
+
+	for _, path := range []string{"/healthz", "/livez"} {
+		rec := doRequest(t, router, http.MethodGet, path, nil)
+		expectStatus(t, rec, http.StatusOK)
+	}
+}
+
+// presign posts body to a presign route and decodes the issued URL
+func presign(t testing.TB, router http.Handler, path string, body interface{}) GeneratePresignedURLResponse {
+	t.Helper()
+	rec := doRequest(t, router, http.MethodPost, path, body)
+	expectStatus(t, rec, http.StatusOK)
+	var res GeneratePresignedURLResponse
+	decodeData(t, rec, &res)
+	return res
+}
+
+func TestDeleteURL(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	res := presign(t, router, "/get-delete-url", map[string]interface{}{"file_name": "users/42/avatar.png"})
+	if res.Method != http.MethodDelete {
+		t.Errorf("Method = %q, want DELETE", res.Method)
+	}
+	u, err := url.Parse(res.PreAssignedURL)
+	if err != nil || u.Path != "/users/42/avatar.png" || u.Query().Get("X-Amz-Signature") == "" {
+		t.Errorf("URL = %q, want a signed URL for users/42/avatar.png", res.PreAssignedURL)
+	}
+	if !containsDetail(res.Details, "DELETE request") {
+		t.Errorf("Details = %q, want the DELETE instruction", res.Details)
+	}
+
+	rec := doRequest(t, router, http.MethodPost, "/get-delete-url", map[string]interface{}{"file_name": "../secret.png"})
+	expectStatus(t, rec, http.StatusNotFound)
+}
+
+func TestUploadContentMD5(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+	checksum := "XUFAKrxLKna5cZ2REBfFkg==" // MD5 of "hello"
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 5, "content_md5": checksum})
+	if value := res.RequiredHeaders["Content-Md5"]; value != checksum {
+		t.Errorf("required headers = %v, want Content-MD5: %s", res.RequiredHeaders, checksum)
+	}
+	if !strings.Contains(strings.Join(res.SignedHeaders, ";"), "content-md5") {
+		t.Errorf("signed headers = %v, want content-md5", res.SignedHeaders)
+	}
+	if !containsDetail(res.Details, "Content-MD5: "+checksum) {
+		t.Errorf("Details = %q, want the Content-MD5 header", res.Details)
+	}
+
+	res = presignUpload(t, router, map[string]interface{}{"content_length": 5})
+	if _, ok := res.RequiredHeaders["Content-Md5"]; ok {
+		t.Errorf("required headers = %v, want no Content-MD5 without a checksum", res.RequiredHeaders)
+	}
+
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 5, "content_md5": "not-a-digest"})
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+func TestMultipartUpload(t *testing.T) {
+	server, router := newTestRouter(t, nil)
+	fake := testS3(server)
+
+	rec := doRequest(t, router, http.MethodPost, "/multipart/create", map[string]interface{}{"file_name": "big.png", "metadata": map[string]string{"owner": "42"}})
+	expectStatus(t, rec, http.StatusOK)
+	var created CreateMultipartUploadResponse
+	decodeData(t, rec, &created)
+	if created.UploadId != "upload-1" || created.FileName != "big.png" || created.ContentType != "image/png" {
+		t.Errorf("created = %+v, want upload-1 for big.png as image/png", created)
+	}
+	if len(fake.multipartInputs) != 1 || aws.StringValue(fake.multipartInputs[0].Bucket) != "test-bucket" || aws.StringValue(fake.multipartInputs[0].Metadata["owner"]) != "42" {
+		t.Errorf("CreateMultipartUpload inputs = %v, want one call for test-bucket with the metadata", fake.multipartInputs)
+	}
+
+	part := presign(t, router, "/multipart/part-url", map[string]interface{}{"file_name": "big.png", "upload_id": created.UploadId, "part_number": 3})
+	u, err := url.Parse(part.PreAssignedURL)
+	if err != nil || part.Method != http.MethodPut || u.Query().Get("partNumber") != "3" || u.Query().Get("uploadId") != created.UploadId {
+		t.Errorf("part URL = %s %s, want a PUT of part 3 of %s", part.Method, part.PreAssignedURL, created.UploadId)
+	}
+	for _, partNumber := range []int{0, MAX_PART_NUMBER + 1} {
+		rec := doRequest(t, router, http.MethodPost, "/multipart/part-url", map[string]interface{}{"file_name": "big.png", "upload_id": created.UploadId, "part_number": partNumber})
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+	rec = doRequest(t, router, http.MethodPost, "/multipart/part-url", map[string]interface{}{"file_name": "big.png", "part_number": 1})
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	complete := presign(t, router, "/multipart/complete", map[string]interface{}{"file_name": "big.png", "upload_id": created.UploadId})
+	u, err = url.Parse(complete.PreAssignedURL)
+	if err != nil || complete.Method != http.MethodPost || u.Query().Get("uploadId") != created.UploadId {
+		t.Errorf("complete URL = %s %s, want a POST for %s", complete.Method, complete.PreAssignedURL, created.UploadId)
+	}
+
+	// Only the create call reaches S3, the part and complete URLs are signed locally
+	if calls := fake.callCount("CreateMultipartUpload"); calls != 1 || len(fake.calls) != 1 {
+		t.Errorf("S3 calls = %v, want a single CreateMultipartUpload", fake.calls)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"API_KEYS": "key-one"})
+	auth := []string{"X-API-Key", "key-one"}
+
+	for i := 0; i < 2; i++ {
+		presignUpload(t, router, map[string]interface{}{"content_length": 1234}, auth...)
+	}
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 0}, auth...)
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	// The metrics need no API key
+	rec = doRequest(t, router, http.MethodGet, "/metrics", nil)
+	expectStatus(t, rec, http.StatusOK)
+	scrape := rec.Body.String()
+	for _, want := range []string{
+		`presign_requests_total{route="/get-upload-url"} 3`,
+		`presign_failures_total{reason="validation",route="/get-upload-url"} 1`,
+		`presign_duration_seconds_count{route="/get-upload-url"} 3`,
+	} {
+		if !strings.Contains(scrape, want) {
+			t.Errorf("metrics are missing %s", want)
+		}
+	}
+}
+
+func TestEncodeTagging(t *testing.T) {
+	got := encodeTagging(map[string]string{"project": "gallery", "retention": "30 days", "team": "a&b"})
+	if want := "project=gallery&retention=30+days&team=a%26b"; got != want {
+		t.Errorf("encodeTagging = %q, want %q", got, want)
+	}
+}
+
+func TestUploadTags(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "tags": map[string]string{"project": "gallery", "lifecycle": "temp"}})
+	if value := res.RequiredHeaders["X-Amz-Tagging"]; value != "lifecycle=temp&project=gallery" {
+		t.Errorf("required headers = %v, want x-amz-tagging: lifecycle=temp&project=gallery", res.RequiredHeaders)
+	}
+	if !strings.Contains(strings.Join(res.SignedHeaders, ";"), "x-amz-tagging") {
+		t.Errorf("signed headers = %v, want x-amz-tagging", res.SignedHeaders)
+	}
+	if !containsDetail(res.Details, "x-amz-tagging: lifecycle=temp&project=gallery") {
+		t.Errorf("Details = %q, want the tagging header", res.Details)
+	}
+
+	tooMany := map[string]string{}
+	for i := 0; i <= MAX_TAGS; i++ {
+		tooMany[fmt.Sprintf("tag%d", i)] = "x"
+	}
+	for _, tags := range []map[string]string{
+		tooMany,
+		{strings.Repeat("k", MAX_TAG_KEY_LENGTH+1): "x"},
+		{"key": strings.Repeat("v", MAX_TAG_VALUE_LENGTH+1)},
+		{"aws:reserved": "x"},
+		{"bad<key>": "x"},
+	} {
+		rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234, "tags": tags})
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+}
+
+func TestGeneratePresignedURLOperations(t *testing.T) {
+	config := newTestConfig(t, nil)
+	svc := newFakeS3(t, config)
+
+	tests := []struct {
+		operation string
+		method    string
+	}{
+		{"", http.MethodPut},
+		{OperationPut, http.MethodPut},
+		{OperationGet, http.MethodGet},
+		{OperationDelete, http.MethodDelete},
+		{OperationHead, http.MethodHead},
+		{OperationCopy, http.MethodPut},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.operation, func(t *testing.T) {
+			res, err := GeneratePresignedURL(context.Background(), svc, GeneratePresignedURLParam{
+				Operation:     tt.operation,
+				FileName:      "photo.png",
+				CopySourceKey: "original.png",
+				Timout:        DEFAULT_EXPIRATION,
+				Bucket:        config.Bucket,
+				ContentType:   "image/png",
+			})
+			if err != nil {
+				t.Fatalf("GeneratePresignedURL: %v", err)
+			}
+			if res.Method != tt.method {
+				t.Errorf("Method = %q, want %q", res.Method, tt.method)
+			}
+			u, err := url.Parse(res.URL)
+			if err != nil || u.Scheme != "https" || u.Path != "/photo.png" || u.Query().Get("X-Amz-Signature") == "" {
+				t.Errorf("URL = %q, want a signed URL for photo.png", res.URL)
+			}
+		})
+	}
+
+	_, err := GeneratePresignedURL(context.Background(), svc, GeneratePresignedURLParam{Operation: "patch", FileName: "photo.png", Timout: DEFAULT_EXPIRATION, Bucket: config.Bucket})
+	if err == nil {
+		t.Error("GeneratePresignedURL accepted an unknown operation")
+	}
+}
+
+func TestBodyLimits(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"MAX_BODY_SIZE_BYTES": "256"})
+
+	oversized := fmt.Sprintf(`{"content_length":1234,"file_name":"%s.png"}`, strings.Repeat("a", 300))
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", oversized)
+	expectStatus(t, rec, http.StatusRequestEntityTooLarge)
+	if res := decodeJSON(t, rec); res["code"] != ERROR_CODE_PAYLOAD_TOO_LARGE {
+		t.Errorf("code = %v, want %s", res["code"], ERROR_CODE_PAYLOAD_TOO_LARGE)
+	}
+
+	rec = doRequest(t, router, http.MethodPost, "/get-upload-url", `{"content_length":1234,"contnet_type":"image/png"}`)
+	expectStatus(t, rec, http.StatusBadRequest)
+	if res := decodeJSON(t, rec); res["message"] != `unknown field "contnet_type"` {
+		t.Errorf("message = %v, want the unknown field named", res["message"])
+	}
+}
+
+func TestBucketAlias(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{
+		"BUCKETS": `{"tenant-a": {"bucket": "tenant-a-uploads", "region": "eu-west-1", "prefix": "a"}}`,
+	})
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "file_name": "photo.png", "bucket_alias": "tenant-a"})
+	if res.Host != "tenant-a-uploads.s3.eu-west-1.amazonaws.com" || res.FileName != "a/photo.png" {
+		t.Errorf("Host, FileName = %q, %q, want the tenant-a bucket in eu-west-1 under a/", res.Host, res.FileName)
+	}
+
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234, "bucket_alias": "tenant-b"})
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	res = presignUpload(t, router, map[string]interface{}{"content_length": 1234, "file_name": "photo.png"})
+	if res.Host != "test-bucket.s3.amazonaws.com" || res.FileName != "photo.png" {
+		t.Errorf("Host, FileName = %q, %q, want the default bucket", res.Host, res.FileName)
+	}
+}
+
+// fakeAssumeRoler is an STS client answering AssumeRole with credentials that live for lifetime
+type fakeAssumeRoler struct {
+	inputs   []*sts.AssumeRoleInput
+	lifetime time.Duration
+}
+
+func (f *fakeAssumeRoler) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	f.inputs = append(f.inputs, input)
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String(fmt.Sprintf("ASIAROLE%d", len(f.inputs))),
+		SecretAccessKey: aws.String("role-secret"),
+		SessionToken:    aws.String("role-token"),
+		Expiration:      aws.Time(time.Now().Add(f.lifetime)),
+	}}, nil
+}
+
+func TestAssumeRoleCredentials(t *testing.T) {
+	config := newTestConfig(t, map[string]string{
+		"AWS_ROLE_ARN":          "arn:aws:iam::123456789012:role/presigner",
+		"AWS_ROLE_SESSION_NAME": "presign-test",
+	})
+
+	client := &fakeAssumeRoler{lifetime: time.Hour}
+	creds := assumeRoleCredentials(client, config)
+	for i := 0; i < 2; i++ {
+		value, err := creds.Get()
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if value.AccessKeyID != "ASIAROLE1" || value.SessionToken != "role-token" {
+			t.Errorf("credentials = %+v, want the assumed role's", value)
+		}
+	}
+	if len(client.inputs) != 1 {
+		t.Fatalf("AssumeRole calls = %d, want 1 while the credentials are cached", len(client.inputs))
+	}
+	if input := client.inputs[0]; aws.StringValue(input.RoleArn) != config.RoleARN || aws.StringValue(input.RoleSessionName) != "presign-test" {
+		t.Errorf("AssumeRole input = %v, want the configured role and session name", input)
+	}
+
+	// Credentials inside the expiry window are renewed before use
+	client = &fakeAssumeRoler{lifetime: ROLE_CREDENTIALS_EXPIRY_WINDOW / 2}
+	creds = assumeRoleCredentials(client, config)
+	creds.Get()
+	if value, _ := creds.Get(); value.AccessKeyID != "ASIAROLE2" || len(client.inputs) != 2 {
+		t.Errorf("AssumeRole calls = %d, want the expiring credentials renewed", len(client.inputs))
+	}
+}
+
+func TestUploadACL(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "acl": "bucket-owner-full-control"})
+	if value := res.RequiredHeaders["X-Amz-Acl"]; value != "bucket-owner-full-control" {
+		t.Errorf("required headers = %v, want x-amz-acl: bucket-owner-full-control", res.RequiredHeaders)
+	}
+	if !containsDetail(res.Details, "x-amz-acl: bucket-owner-full-control") {
+		t.Errorf("Details = %q, want the ACL header", res.Details)
+	}
+
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234, "acl": "world-writable"})
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+func TestDefaultACL(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"AWS_DEFAULT_ACL": "private"})
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234})
+	if value := res.RequiredHeaders["X-Amz-Acl"]; value != "private" {
+		t.Errorf("required headers = %v, want the default x-amz-acl: private", res.RequiredHeaders)
+	}
+
+	setTestEnv(t, map[string]string{"AWS_DEFAULT_ACL": "world-writable"})
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "AWS_DEFAULT_ACL") {
+		t.Errorf("loadConfig = %v, want the invalid AWS_DEFAULT_ACL reported", err)
+	}
+}
+
+func TestRequiredHeaders(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "content_type": "image/png"})
+	if res.RequiredHeaders["Content-Type"] != "image/png" || res.RequiredHeaders["Content-Length"] != "1234" {
+		t.Errorf("required headers = %v, want Content-Type: image/png and Content-Length: 1234", res.RequiredHeaders)
+	}
+	if _, ok := res.RequiredHeaders["Host"]; ok {
+		t.Errorf("required headers = %v, want Host left to the HTTP client", res.RequiredHeaders)
+	}
+}
+
+// flakyCall fails with err until it has been called failures times
+type flakyCall struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *flakyCall) call() error {
+	f.calls++
+	if f.calls <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+func TestWithRetry(t *testing.T) {
+	throttled := awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), http.StatusServiceUnavailable, "fake-request-id")
+
+	flaky := &flakyCall{failures: 2, err: throttled}
+	if err := withRetry(context.Background(), 3, flaky.call); err != nil || flaky.calls != 3 {
+		t.Errorf("withRetry = %v after %d calls, want success on the third", err, flaky.calls)
+	}
+
+	flaky = &flakyCall{failures: 5, err: throttled}
+	if err := withRetry(context.Background(), 2, flaky.call); err == nil || flaky.calls != 3 {
+		t.Errorf("withRetry = %v after %d calls, want a failure after 3", err, flaky.calls)
+	}
+
+	forbidden := awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "fake-request-id")
+	flaky = &flakyCall{failures: 2, err: forbidden}
+	if err := withRetry(context.Background(), 3, flaky.call); err == nil || flaky.calls != 1 {
+		t.Errorf("withRetry = %v after %d calls, want permanent errors returned at once", err, flaky.calls)
+	}
+
+	flaky = &flakyCall{failures: 1, err: throttled}
+	if err := withRetry(context.Background(), 0, flaky.call); err == nil || flaky.calls != 1 {
+		t.Errorf("withRetry = %v after %d calls, want no retries with a max of 0", err, flaky.calls)
+	}
+}
+
+func TestMaxRetriesFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", DEFAULT_MAX_RETRIES},
+		{"0", 0},
+		{"5", 5},
+		{"-1", DEFAULT_MAX_RETRIES},
+		{"many", DEFAULT_MAX_RETRIES},
+	}
+	for _, tt := range tests {
+		if config := newTestConfig(t, map[string]string{"AWS_MAX_RETRIES": tt.value}); config.MaxRetries != tt.want {
+			t.Errorf("AWS_MAX_RETRIES=%q: MaxRetries = %d, want %d", tt.value, config.MaxRetries, tt.want)
+		}
+	}
+}
+
+func TestUploadRedirect(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	rec := doRequest(t, router, http.MethodGet, "/upload-redirect?content_length=1234&file_name=photo.png", nil)
+	expectStatus(t, rec, http.StatusTemporaryRedirect)
+	location := rec.Header().Get("Location")
+	if !strings.HasPrefix(location, "https://test-bucket.s3.amazonaws.com/photo.png?") || !strings.Contains(location, "X-Amz-Signature=") {
+		t.Errorf("Location = %q, want the pre-signed URL", location)
+	}
+
+	for _, query := range []string{"content_length=abc", "content_length=0", "content_length=1234&file_name=../x.png"} {
+		rec := doRequest(t, router, http.MethodGet, "/upload-redirect?"+query, nil)
+		expectStatus(t, rec, http.StatusBadRequest)
+		if location := rec.Header().Get("Location"); location != "" {
+			t.Errorf("%s: Location = %q, want none for an invalid request", query, location)
+		}
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	config := newTestConfig(t, nil)
+	svc := newFakeS3(t, config)
+	svc.delay = 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := HeadObject(ctx, svc, config.Bucket, "photo.png", "")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("HeadObject took %s after the context was canceled", elapsed)
+	}
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) || awsErr.Code() != request.CanceledErrorCode {
+		t.Errorf("HeadObject = %v, want a canceled request error", err)
+	}
+
+	// Retries stop as soon as the context is done
+	flaky := &flakyCall{failures: 10, err: awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), http.StatusServiceUnavailable, "fake-request-id")}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := withRetry(canceled, 10, flaky.call); err == nil || flaky.calls != 1 {
+		t.Errorf("withRetry = %v after %d calls, want it to give up on a canceled context", err, flaky.calls)
+	}
+}
+
+func TestRequestTimeoutDeadline(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"REQUEST_TIMEOUT_SECONDS": "30"})
+
+	before := time.Now()
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234})
+	expectStatus(t, rec, http.StatusOK)
+	deadline, err := time.Parse(time.RFC3339, rec.Header().Get(REQUEST_DEADLINE_HEADER))
+	if err != nil {
+		t.Fatalf("%s = %q, want an RFC3339 time", REQUEST_DEADLINE_HEADER, rec.Header().Get(REQUEST_DEADLINE_HEADER))
+	}
+	if deadline.Before(before.Add(29*time.Second)) || deadline.After(before.Add(31*time.Second)) {
+		t.Errorf("deadline = %s, want about 30 seconds after %s", deadline, before)
+	}
+}
+
+func TestRequestTimeoutSlowS3(t *testing.T) {
+	server := newTestServer(t, nil)
+	// Shorter than REQUEST_TIMEOUT_SECONDS can express, to keep the test fast
+	server.Config.RequestTimeout = 50 * time.Millisecond
+	router := newRouter(server, server.Config)
+	svc := testS3(server)
+	svc.putObject("test-bucket", "photo.png", 1234, "image/png")
+	svc.delay = 5 * time.Second
+
+	start := time.Now()
+	rec := doRequest(t, router, http.MethodPost, "/get-download-url", map[string]interface{}{"file_name": "photo.png", "verify_exists": true})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %s, want it stopped at the deadline", elapsed)
+	}
+	expectStatus(t, rec, http.StatusGatewayTimeout)
+	if res := decodeJSON(t, rec); res["success"] != false || res["code"] != ERROR_CODE_TIMEOUT {
+		t.Errorf("response = %v, want a JSON %s error", res, ERROR_CODE_TIMEOUT)
+	}
+	if svc.callCount("HeadObject") != 1 {
+		t.Errorf("HeadObject calls = %d, want 1 without retries past the deadline", svc.callCount("HeadObject"))
+	}
+}
+
+func TestExpirationUnix(t *testing.T) {
+	server, router := newTestRouter(t, nil)
+	setClock(server, fixedClock(testNow))
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "expires_in_seconds": 3600})
+	if !time.Unix(res.ExpirationUnix, 0).Equal(res.ExpirationTime) {
+		t.Errorf("expiration_unix %d and expiration_time %s are different instants", res.ExpirationUnix, res.ExpirationTime)
+	}
+	if want := testNow.Add(time.Hour).Unix(); res.ExpirationUnix != want {
+		t.Errorf("expiration_unix = %d, want %d", res.ExpirationUnix, want)
+	}
+}
+
+func TestUploadDryRun(t *testing.T) {
+	server, router := newTestRouter(t, nil)
+	// Credentials that can't resolve prove the dry run never signs
+	config := server.Config
+	config.CredentialsProvider = func(*session.Session) credentials.Provider { return failingProvider{} }
+	fake := newFakeS3(t, config)
+	server.S3 = fake
+	server.Storage = &S3Backend{S3: fake}
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "file_name": "photo.png", "dry_run": true})
+	if res.PreAssignedURL != "" {
+		t.Errorf("PreAssignedURL = %q, want none for a dry run", res.PreAssignedURL)
+	}
+	if res.FileName != "photo.png" || res.Host != "test-bucket.s3.amazonaws.com" || res.ObjectUrl != "https://test-bucket.s3.amazonaws.com/photo.png" || res.Method != http.MethodPut {
+		t.Errorf("response = %+v, want the would-be key, host, object URL and method", res)
+	}
+	if len(fake.calls) != 0 {
+		t.Errorf("S3 calls = %v, want none", fake.calls)
+	}
+
+	// Validation still runs
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 0, "dry_run": true})
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+func TestCompression(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	// A batch response is well over COMPRESSION_MIN_SIZE
+	batch := []map[string]interface{}{{"content_length": 1234}, {"content_length": 1234}, {"content_length": 1234}}
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-urls", batch, "Accept-Encoding", "gzip")
+	expectStatus(t, rec, http.StatusOK)
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", encoding)
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", contentType)
+	}
+	reader, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("body is not gzip: %v", err)
+	}
+	var res map[string]interface{}
+	if err := json.NewDecoder(reader).Decode(&res); err != nil || res["success"] != true {
+		t.Errorf("decompressed body = %v, %v, want the JSON envelope", res, err)
+	}
+
+	// Small responses are sent as they are, without any Content-Encoding
+	rec = doRequest(t, router, http.MethodGet, "/livez", nil, "Accept-Encoding", "gzip")
+	expectStatus(t, rec, http.StatusOK)
+	if encoding, ok := rec.Header()["Content-Encoding"]; ok {
+		t.Errorf("Content-Encoding = %q for a small response, want none", encoding)
+	}
+	if res := decodeJSON(t, rec); res["status"] != "ok" {
+		t.Errorf("body = %v, want the plain JSON", res)
+	}
+
+	// Clients that don't accept gzip get plain JSON
+	rec = doRequest(t, router, http.MethodPost, "/get-upload-urls", batch)
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != "" {
+		t.Errorf("Content-Encoding = %q without Accept-Encoding, want none", encoding)
+	}
+	decodeJSON(t, rec)
+}
+
+func TestCompressThreshold(t *testing.T) {
+	body := strings.Repeat("a", 100)
+	handler := Compress(COMPRESSION_LEVEL, 64)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		// Written in pieces, the body crosses the threshold on the third
+		for i := 0; i < len(body); i += 25 {
+			w.Write([]byte(body[i : i+25]))
+		}
+	}))
+	rec := doRequest(t, handler, http.MethodGet, "/", nil, "Accept-Encoding", "gzip")
+	expectStatus(t, rec, http.StatusCreated)
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", encoding)
+	}
+	reader, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("body is not gzip: %v", err)
+	}
+	if decoded, err := io.ReadAll(reader); err != nil || string(decoded) != body {
+		t.Errorf("decompressed body = %q, %v, want the whole body", decoded, err)
+	}
+}
+
+func TestMaxUploadSizes(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{
+		"ALLOWED_CONTENT_TYPES": "image/png,application/pdf",
+		"MAX_UPLOAD_SIZE_BYTES": "1000",
+		"MAX_UPLOAD_SIZES":      `{"application/pdf": 5000}`,
+	})
+
+	tests := []struct {
+		name          string
+		contentType   string
+		contentLength int
+		status        int
+		limit         string
+	}{
+		{"custom limit", "application/pdf", 4000, http.StatusOK, ""},
+		{"over the custom limit", "application/pdf", 6000, http.StatusBadRequest, "between 1 and 5000 bytes for application/pdf"},
+		{"fallback limit", "image/png", 1000, http.StatusOK, ""},
+		{"over the fallback limit", "image/png", 4000, http.StatusBadRequest, "between 1 and 1000 bytes for image/png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": tt.contentLength, "content_type": tt.contentType})
+			expectStatus(t, rec, tt.status)
+			if tt.limit != "" {
+				if res := decodeJSON(t, rec); !strings.Contains(fmt.Sprint(res["message"]), tt.limit) {
+					t.Errorf("message = %v, want it to name the limit %q", res["message"], tt.limit)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadVerifyExists(t *testing.T) {
+	server, router := newTestRouter(t, nil)
+	fake := testS3(server)
+	fake.putObject("test-bucket", "reports/april.pdf", 2048, "application/pdf")
+
+	res := presign(t, router, "/get-download-url", map[string]interface{}{"file_name": "reports/april.pdf", "verify_exists": true})
+	if res.ObjectSize == nil || *res.ObjectSize != 2048 {
+		t.Errorf("ObjectSize = %v, want 2048", res.ObjectSize)
+	}
+	if res.LastModified == nil || !res.LastModified.Equal(time.Date(2024, 4, 9, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("LastModified = %v, want the stored time", res.LastModified)
+	}
+
+	rec := doRequest(t, router, http.MethodPost, "/get-download-url", map[string]interface{}{"file_name": "reports/may.pdf", "verify_exists": true})
+	expectStatus(t, rec, http.StatusNotFound)
+	if calls := fake.callCount("HeadObject"); calls != 2 {
+		t.Errorf("HeadObject calls = %d, want 2", calls)
+	}
+
+	// Without verify_exists the URL is signed without asking S3
+	res = presign(t, router, "/get-download-url", map[string]interface{}{"file_name": "reports/may.pdf"})
+	if res.ObjectSize != nil {
+		t.Errorf("ObjectSize = %v, want none without verify_exists", *res.ObjectSize)
+	}
+	if calls := fake.callCount("HeadObject"); calls != 2 {
+		t.Errorf("HeadObject calls = %d, want no more without verify_exists", calls)
+	}
+}
+
+func TestObjectBaseURL(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"OBJECT_BASE_URL": "https://cdn.example.com"})
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "file_name": "images/logo.png"})
+	if res.ObjectUrl != "https://cdn.example.com/images/logo.png" {
+		t.Errorf("ObjectUrl = %q, want the CDN URL", res.ObjectUrl)
+	}
+	if strings.Contains(res.PreAssignedURL, "cdn.example.com") {
+		t.Errorf("PreAssignedURL = %q, want it to target S3", res.PreAssignedURL)
+	}
+	if u, err := url.Parse(res.PreAssignedURL); err != nil || !strings.Contains(u.Host, "amazonaws.com") {
+		t.Errorf("PreAssignedURL = %q, want the S3 host", res.PreAssignedURL)
+	}
+
+	_, router = newTestRouter(t, nil)
+	res = presignUpload(t, router, map[string]interface{}{"content_length": 1234, "file_name": "images/logo.png"})
+	if u, err := url.Parse(res.ObjectUrl); err != nil || !strings.Contains(u.Host, "amazonaws.com") || u.Path != "/images/logo.png" {
+		t.Errorf("ObjectUrl = %q, want the S3 host without OBJECT_BASE_URL", res.ObjectUrl)
+	}
+}
+
+func TestGenerateFileNameUnique(t *testing.T) {
+	// Every name is generated in the same second, only the suffix tells them apart
+	now := time.Date(2024, 4, 9, 19, 39, 12, 0, time.UTC)
+	seen := map[string]bool{}
+	for i := 0; i < 10000; i++ {
+		name := generateFileName(DEFAULT_KEY_TIME_LAYOUT, now, "image/png")
+		if seen[name] {
+			t.Fatalf("generated %q twice after %d names", name, i)
+		}
+		seen[name] = true
+		if !strings.HasSuffix(name, ".png") {
+			t.Fatalf("name = %q, want the .png extension", name)
+		}
+	}
+
+	name := generateFileName("20060102", now, "application/pdf")
+	if !strings.HasPrefix(name, "20240409-") || !strings.HasSuffix(name, ".pdf") {
+		t.Errorf("name = %q, want the custom layout and the .pdf extension", name)
+	}
+}
+
+func TestPresignTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	_, router := newTestRouter(t, nil)
+	handler := otelhttp.NewHandler(router, "signed-urls-go")
+	rec := doRequest(t, handler, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234, "file_name": "images/logo.png"})
+	expectStatus(t, rec, http.StatusOK)
+
+	var presignSpan, serverSpan sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "GeneratePresignedURL":
+			presignSpan = span
+		case "signed-urls-go":
+			serverSpan = span
+		}
+	}
+	if presignSpan == nil || serverSpan == nil {
+		t.Fatalf("spans = %v, want the server and GeneratePresignedURL spans", recorder.Ended())
+	}
+	if presignSpan.Parent().SpanID() != serverSpan.SpanContext().SpanID() {
+		t.Errorf("GeneratePresignedURL parent = %v, want the server span", presignSpan.Parent().SpanID())
+	}
+
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range presignSpan.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	want := map[attribute.Key]string{
+		"aws.s3.bucket":   "test-bucket",
+		"aws.s3.key":      "images/logo.png",
+		"presign.outcome": "success",
+	}
+	for key, value := range want {
+		if got := attributes[key].Emit(); got != value {
+			t.Errorf("attribute %s = %q, want %q", key, got, value)
+		}
+	}
+	if got := attributes["presign.content_length"].AsInt64(); got != 1234 {
+		t.Errorf("attribute presign.content_length = %d, want 1234", got)
+	}
+}
+
+func TestDownloadFilename(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	res := presign(t, router, "/get-download-url", map[string]interface{}{"file_name": "reports/april.pdf", "download_filename": "April report.pdf"})
+	u, err := url.Parse(res.PreAssignedURL)
+	if err != nil {
+		t.Fatalf("invalid URL %q: %v", res.PreAssignedURL, err)
+	}
+	if disposition := u.Query().Get("response-content-disposition"); disposition != `attachment; filename="April report.pdf"` {
+		t.Errorf("response-content-disposition = %q, want the attachment filename", disposition)
+	}
+	if !strings.Contains(u.Query().Get("X-Amz-SignedHeaders"), "host") || u.Query().Get("X-Amz-Signature") == "" {
+		t.Errorf("URL = %q, want it signed", res.PreAssignedURL)
+	}
+
+	for _, name := range []string{"report.pdf\r\nSet-Cookie: a=b", "tab\there.pdf", strings.Repeat("a", MAX_DOWNLOAD_FILENAME_LENGTH+1)} {
+		rec := doRequest(t, router, http.MethodPost, "/get-download-url", map[string]interface{}{"file_name": "reports/april.pdf", "download_filename": name})
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+}
+
+func TestUploadCacheControl(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"AWS_DEFAULT_CACHE_CONTROL": "public, max-age=60"})
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "cache_control": "public, max-age=31536000, immutable"})
+	if value := res.RequiredHeaders["Cache-Control"]; value != "public, max-age=31536000, immutable" {
+		t.Errorf("required headers = %v, want the requested Cache-Control", res.RequiredHeaders)
+	}
+	if !strings.Contains(strings.Join(res.SignedHeaders, ";"), "cache-control") {
+		t.Errorf("signed headers = %v, want cache-control", res.SignedHeaders)
+	}
+	if !containsDetail(res.Details, "Cache-Control: public, max-age=31536000, immutable") {
+		t.Errorf("Details = %q, want the Cache-Control header", res.Details)
+	}
+
+	// The env default applies when the body doesn't set one
+	res = presignUpload(t, router, map[string]interface{}{"content_length": 1234})
+	if value := res.RequiredHeaders["Cache-Control"]; value != "public, max-age=60" {
+		t.Errorf("required headers = %v, want AWS_DEFAULT_CACHE_CONTROL", res.RequiredHeaders)
+	}
+
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234, "cache_control": "max-age=60\r\nX-Evil: 1"})
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+func TestStorageBackends(t *testing.T) {
+	backends := []struct {
+		name string
+		env  map[string]string
+		host string
+	}{
+		{"s3", nil, "test-bucket.s3.amazonaws.com"},
+		{"local", map[string]string{"STORAGE_BACKEND": "local", "LOCAL_STORAGE_DIR": t.TempDir(), "LOCAL_BASE_URL": "http://localhost:8080"}, "localhost:8080"},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			server, router := newTestRouter(t, backend.env)
+
+			res := presignUpload(t, router, map[string]interface{}{"content_length": 5, "file_name": "notes/hello.png", "content_type": "image/png"})
+			u, err := url.Parse(res.PreAssignedURL)
+			if err != nil || u.Host != backend.host {
+				t.Fatalf("PreAssignedURL = %q, want the %s host", res.PreAssignedURL, backend.host)
+			}
+			if res.Method != http.MethodPut {
+				t.Errorf("Method = %q, want PUT", res.Method)
+			}
+
+			rec := doRequest(t, router, http.MethodGet, "/healthz", nil)
+			expectStatus(t, rec, http.StatusOK)
+			if backend.name == "local" {
+				if calls := testS3(server).callCount("HeadBucket"); calls != 0 {
+					t.Errorf("HeadBucket calls = %d, want none for the local backend", calls)
+				}
+			}
+		})
+	}
+}
+
+func TestLocalBackendUpload(t *testing.T) {
+	dir := t.TempDir()
+	_, router := newTestRouter(t, map[string]string{"STORAGE_BACKEND": "local", "LOCAL_STORAGE_DIR": dir, "LOCAL_BASE_URL": "http://localhost:8080"})
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 5, "file_name": "notes/hello.png", "content_type": "image/png"})
+	u, err := url.Parse(res.PreAssignedURL)
+	if err != nil {
+		t.Fatalf("invalid URL %q: %v", res.PreAssignedURL, err)
+	}
+	req := httptest.NewRequest(http.MethodPut, u.RequestURI(), strings.NewReader("hello"))
+	req.Header.Set("Content-Type", "image/png")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code >= 300 {
+		t.Fatalf("upload status = %d: %s", rec.Code, rec.Body.String())
+	}
+	if data, err := os.ReadFile(dir + "/notes/hello.png"); err != nil || string(data) != "hello" {
+		t.Errorf("stored file = %q, %v, want hello", data, err)
+	}
+
+	// Tampering with the signed query is refused
+	query := u.Query()
+	query.Set("expires", strconv.FormatInt(time.Now().Add(time.Hour*24).Unix(), 10))
+	req = httptest.NewRequest(http.MethodPut, u.Path+"?"+query.Encode(), strings.NewReader("hello"))
+	req.Header.Set("Content-Type", "image/png")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code < 400 {
+		t.Errorf("tampered upload status = %d, want a rejection", rec.Code)
+	}
+
+	// The expiry is checked against the clock that signed the URL
+	t.Run("server clock", func(t *testing.T) {
+		server, router := newTestRouter(t, map[string]string{"STORAGE_BACKEND": "local", "LOCAL_STORAGE_DIR": t.TempDir(), "LOCAL_BASE_URL": "http://localhost:8080"})
+		setClock(server, fixedClock(testNow))
+		res := presignUpload(t, router, map[string]interface{}{"content_length": 5, "file_name": "hello.png", "content_type": "image/png"})
+		u, err := url.Parse(res.PreAssignedURL)
+		if err != nil {
+			t.Fatalf("invalid URL %q: %v", res.PreAssignedURL, err)
+		}
+		put := func() int {
+			req := httptest.NewRequest(http.MethodPut, u.RequestURI(), strings.NewReader("hello"))
+			req.Header.Set("Content-Type", "image/png")
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			return rec.Code
+		}
+		if code := put(); code >= 300 {
+			t.Errorf("upload status = %d, want success under the signing clock", code)
+		}
+		setClock(server, fixedClock(res.ExpirationTime.Add(time.Second)))
+		if code := put(); code < 400 {
+			t.Errorf("upload after expiry status = %d, want a rejection", code)
+		}
+	})
+}
+
+func TestLocalBackendDownloadNeedsAPIKey(t *testing.T) {
+	dir := t.TempDir()
+	_, router := newTestRouter(t, map[string]string{"STORAGE_BACKEND": "local", "LOCAL_STORAGE_DIR": dir, "API_KEYS": "key-one"})
+	if err := os.WriteFile(dir+"/hello.png", []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := doRequest(t, router, http.MethodGet, LOCAL_UPLOAD_PATH+"/hello.png", nil)
+	expectStatus(t, rec, http.StatusUnauthorized)
+
+	rec = doRequest(t, router, http.MethodGet, LOCAL_UPLOAD_PATH+"/hello.png", nil, "X-API-Key", "key-one")
+	expectStatus(t, rec, http.StatusOK)
+	if rec.Body.String() != "hello" {
+		t.Errorf("body = %q, want hello", rec.Body.String())
+	}
+}
+
+func TestLocalBackendRejectsS3Routes(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"STORAGE_BACKEND": "local", "LOCAL_STORAGE_DIR": t.TempDir()})
+
+	routes := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodPost, "/get-upload-post"},
+		{http.MethodPost, "/get-download-url"},
+		{http.MethodPost, "/get-delete-url"},
+		{http.MethodPost, "/get-head-url"},
+		{http.MethodPost, "/get-copy-url"},
+		{http.MethodPost, "/confirm-upload"},
+		{http.MethodGet, "/objects"},
+		{http.MethodPost, "/multipart/create"},
+		{http.MethodPost, "/multipart/part-url"},
+		{http.MethodPost, "/multipart/complete"},
+	}
+	for _, route := range routes {
+		t.Run(route.path, func(t *testing.T) {
+			var body interface{}
+			if route.method == http.MethodPost {
+				body = map[string]interface{}{"file_name": "notes/hello.txt"}
+			}
+			rec := doRequest(t, router, route.method, route.path, body)
+			expectStatus(t, rec, http.StatusNotImplemented)
+			if res := decodeJSON(t, rec); res["code"] != ERROR_CODE_NOT_IMPLEMENTED || !strings.Contains(fmt.Sprint(res["message"]), "STORAGE_BACKEND=s3") {
+				t.Errorf("body = %v, want the NOT_IMPLEMENTED error naming STORAGE_BACKEND", res)
+			}
+		})
+	}
+}
+
+func TestSignatureVersion(t *testing.T) {
+	for _, version := range []string{"", SIGNATURE_VERSION_4} {
+		svc, err := newS3Client(newTestConfig(t, map[string]string{"AWS_SIGNATURE_VERSION": version}))
+		if err != nil {
+			t.Fatalf("newS3Client: %v", err)
+		}
+		req, _ := svc.PutObjectRequest(&s3.PutObjectInput{Bucket: aws.String("test-bucket"), Key: aws.String("a.png")})
+		signed, err := req.Presign(time.Hour)
+		if err != nil || !strings.Contains(signed, "X-Amz-Signature=") {
+			t.Errorf("version %q signed %q, %v, want SigV4", version, signed, err)
+		}
+	}
+
+	svc, err := newS3Client(newTestConfig(t, map[string]string{"AWS_SIGNATURE_VERSION": SIGNATURE_VERSION_2}))
+	if err != nil {
+		t.Fatalf("newS3Client: %v", err)
+	}
+	req, _ := svc.PutObjectRequest(&s3.PutObjectInput{Bucket: aws.String("test-bucket"), Key: aws.String("a.png"), ContentType: aws.String("image/png")})
+	signed, err := req.Presign(time.Hour)
+	if err != nil {
+		t.Fatalf("Presign: %v", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("invalid URL %q: %v", signed, err)
+	}
+	query := u.Query()
+	if query.Get("X-Amz-Signature") != "" || query.Get("AWSAccessKeyId") != "AKIDTEST" {
+		t.Fatalf("URL = %q, want a SigV2 URL", signed)
+	}
+	mac := hmac.New(sha1.New, []byte("test-secret"))
+	mac.Write([]byte("PUT\n\nimage/png\n" + query.Get("Expires") + "\n/test-bucket/a.png"))
+	if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); query.Get("Signature") != want {
+		t.Errorf("Signature = %q, want %q", query.Get("Signature"), want)
+	}
+
+	setTestEnv(t, map[string]string{"AWS_SIGNATURE_VERSION": "v3"})
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "AWS_SIGNATURE_VERSION") {
+		t.Errorf("loadConfig error = %v, want AWS_SIGNATURE_VERSION rejected", err)
+	}
+}
+
+func TestValidationErrorsArray(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"MAX_UPLOAD_SIZE_BYTES": "1000"})
+
+	tests := []struct {
+		path string
+		body map[string]interface{}
+		want map[string]string
+	}{
+		{
+			"/get-upload-url",
+			map[string]interface{}{"content_length": 5000, "content_type": "application/x-msdownload", "file_name": "../etc/passwd"},
+			map[string]string{
+				"content_length": ERROR_CODE_INVALID_CONTENT_LENGTH,
+				"content_type":   ERROR_CODE_UNSUPPORTED_CONTENT_TYPE,
+				"file_name":      ERROR_CODE_INVALID_FILE_NAME,
+			},
+		},
+		{
+			"/multipart/create",
+			map[string]interface{}{"file_name": "../etc/passwd", "metadata": map[string]string{"bad key": "x"}, "acl": "world-writable"},
+			map[string]string{
+				"file_name": ERROR_CODE_INVALID_FILE_NAME,
+				"metadata":  ERROR_CODE_INVALID_REQUEST,
+				"acl":       ERROR_CODE_INVALID_REQUEST,
+			},
+		},
+		{
+			"/multipart/part-url",
+			map[string]interface{}{"file_name": "../etc/passwd", "part_number": 0, "expires_in_seconds": 1},
+			map[string]string{
+				"file_name":          ERROR_CODE_INVALID_FILE_NAME,
+				"upload_id":          ERROR_CODE_INVALID_REQUEST,
+				"part_number":        ERROR_CODE_INVALID_REQUEST,
+				"expires_in_seconds": ERROR_CODE_INVALID_EXPIRATION,
+			},
+		},
+		{
+			"/multipart/complete",
+			map[string]interface{}{"file_name": "../etc/passwd"},
+			map[string]string{
+				"file_name": ERROR_CODE_INVALID_FILE_NAME,
+				"upload_id": ERROR_CODE_INVALID_REQUEST,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := doRequest(t, router, http.MethodPost, tt.path, tt.body)
+			expectStatus(t, rec, http.StatusBadRequest)
+			var res struct {
+				Code   string       `json:"code"`
+				Errors []FieldError `json:"errors"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatalf("invalid body: %v: %s", err, rec.Body.String())
+			}
+			if res.Code != ERROR_CODE_INVALID_FIELDS {
+				t.Errorf("code = %q, want %q", res.Code, ERROR_CODE_INVALID_FIELDS)
+			}
+			codes := map[string]string{}
+			for _, fieldErr := range res.Errors {
+				codes[fieldErr.Field] = fieldErr.Code
+				if fieldErr.Message == "" {
+					t.Errorf("field %s has no message", fieldErr.Field)
+				}
+			}
+			if len(codes) != len(tt.want) {
+				t.Errorf("errors = %+v, want %d fields", res.Errors, len(tt.want))
+			}
+			for field, code := range tt.want {
+				if codes[field] != code {
+					t.Errorf("errors = %+v, want %s reported as %s", res.Errors, field, code)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadPreventOverwrite(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "prevent_overwrite": true})
+	if value := res.RequiredHeaders["If-None-Match"]; value != "*" {
+		t.Errorf("required headers = %v, want If-None-Match: *", res.RequiredHeaders)
+	}
+	if !strings.Contains(strings.Join(res.SignedHeaders, ";"), "if-none-match") {
+		t.Errorf("signed headers = %v, want if-none-match", res.SignedHeaders)
+	}
+	if !containsDetail(res.Details, "If-None-Match: *") {
+		t.Errorf("Details = %q, want the If-None-Match header", res.Details)
+	}
+
+	res = presignUpload(t, router, map[string]interface{}{"content_length": 1234})
+	if _, ok := res.RequiredHeaders["If-None-Match"]; ok {
+		t.Errorf("required headers = %v, want no If-None-Match by default", res.RequiredHeaders)
+	}
+}
+
+func TestUploadsEnabledToggle(t *testing.T) {
+	server, router := newTestRouter(t, nil)
+	upload := map[string]interface{}{"content_length": 1234}
+
+	presignUpload(t, router, upload)
+
+	server.reloadUploadsEnabled(map[string]string{"UPLOADS_ENABLED": "false"})
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", upload)
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	if res := decodeJSON(t, rec); !strings.Contains(fmt.Sprint(res["message"]), "maintenance") {
+		t.Errorf("body = %v, want the maintenance message", res)
+	}
+	// Downloads keep working
+	presign(t, router, "/get-download-url", map[string]interface{}{"file_name": "reports/april.pdf"})
+
+	// Without an entry in .env or the environment the setting stays as it is
+	server.reloadUploadsEnabled(map[string]string{})
+	rec = doRequest(t, router, http.MethodPost, "/get-upload-url", upload)
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+
+	// The environment applies when .env has no entry
+	t.Setenv("UPLOADS_ENABLED", "true")
+	server.reloadUploadsEnabled(nil)
+	presignUpload(t, router, upload)
+
+	// .env wins over the environment
+	server.reloadUploadsEnabled(map[string]string{"UPLOADS_ENABLED": "false"})
+	rec = doRequest(t, router, http.MethodPost, "/get-upload-url", upload)
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+
+	// Startup copied UPLOADS_ENABLED=false from .env, the operator then set it to true and deleted the line
+	t.Setenv("UPLOADS_ENABLED", "false")
+	server.EnvFromFile = map[string]bool{"UPLOADS_ENABLED": true}
+	server.reloadUploadsEnabled(map[string]string{"UPLOADS_ENABLED": "true"})
+	presignUpload(t, router, upload)
+	server.reloadUploadsEnabled(map[string]string{})
+	presignUpload(t, router, upload)
+	server.EnvFromFile = nil
+
+	// Any boolean spelling turns uploads back on, a typo keeps them off
+	server.reloadUploadsEnabled(map[string]string{"UPLOADS_ENABLED": "TRUE"})
+	presignUpload(t, router, upload)
+	for _, value := range []string{"0", "FALSE", "off", "disabled"} {
+		server.reloadUploadsEnabled(map[string]string{"UPLOADS_ENABLED": value})
+		rec = doRequest(t, router, http.MethodPost, "/get-upload-url", upload)
+		expectStatus(t, rec, http.StatusServiceUnavailable)
+	}
+}
+
+func TestUploadsEnabledConfig(t *testing.T) {
+	tests := []struct {
+		value   string
+		enabled bool
+		invalid bool
+	}{
+		{"", true, false},
+		{"true", true, false},
+		{"1", true, false},
+		{"false", false, false},
+		{"FALSE", false, false},
+		{"0", false, false},
+		// Not a boolean, so not silently on
+		{"off", false, true},
+		{"no", false, true},
+	}
+	for _, tt := range tests {
+		t.Run("UPLOADS_ENABLED="+tt.value, func(t *testing.T) {
+			setTestEnv(t, map[string]string{"UPLOADS_ENABLED": tt.value})
+			config, err := loadConfig()
+			if tt.invalid {
+				if err == nil || !strings.Contains(err.Error(), "invalid UPLOADS_ENABLED") {
+					t.Errorf("loadConfig error = %v, want UPLOADS_ENABLED rejected", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if config.UploadsEnabled != tt.enabled {
+				t.Errorf("UploadsEnabled = %v, want %v", config.UploadsEnabled, tt.enabled)
+			}
+		})
+	}
+}
+
+func TestUploadQRCode(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url?format=qr", map[string]interface{}{"content_length": 1234})
+	expectStatus(t, rec, http.StatusOK)
+	if contentType := rec.Header().Get("Content-Type"); contentType != "image/png" {
+		t.Errorf("Content-Type = %q, want image/png", contentType)
+	}
+	img, err := png.Decode(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("body is not a PNG: %v", err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() == 0 || bounds.Dy() == 0 {
+		t.Errorf("image size = %v, want a nonzero image", bounds)
+	}
+
+	// The JSON validation still applies
+	rec = doRequest(t, router, http.MethodPost, "/get-upload-url?format=qr", map[string]interface{}{"content_length": -1})
+	expectStatus(t, rec, http.StatusBadRequest)
+	decodeJSON(t, rec)
+
+	rec = doRequest(t, router, http.MethodPost, "/get-upload-url?format=svg", map[string]interface{}{"content_length": 1234})
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+func TestMalformedBody(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	tests := []struct {
+		name    string
+		body    string
+		message string
+	}{
+		{"empty", "", "request body is empty"},
+		{"truncated", `{"content_length": 12`, "request body is truncated JSON"},
+		{"syntax error", `{"content_length": 12,}`, "malformed JSON at byte 23"},
+		{"wrong field type", `{"content_length": "12"}`, `field "content_length" must be of type integer, got string`},
+		{"wrong body type", `[1, 2]`, "request body must be a JSON object, got array"},
+		{"unknown field", `{"content_lenght": 12}`, `unknown field "content_lenght"`},
+		{"trailing value", `{"content_length": 12} {}`, "single JSON value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, router, http.MethodPost, "/get-upload-url", tt.body)
+			expectStatus(t, rec, http.StatusBadRequest)
+			res := decodeJSON(t, rec)
+			if !strings.Contains(fmt.Sprint(res["message"]), tt.message) {
+				t.Errorf("message = %v, want %q", res["message"], tt.message)
+			}
+			if res["code"] != ERROR_CODE_INVALID_BODY {
+				t.Errorf("code = %v, want %s", res["code"], ERROR_CODE_INVALID_BODY)
+			}
+		})
+	}
+}
+
+func TestListObjectsPages(t *testing.T) {
+	server, router := newTestRouter(t, nil)
+	fake := testS3(server)
+	for _, key := range []string{"gallery/a.png", "gallery/b.png", "gallery/c.png", "gallery/d.png", "gallery/e.png", "private/f.png"} {
+		fake.putObject("test-bucket", key, 100, "image/png")
+	}
+
+	var names []string
+	token := ""
+	pages := 0
+	for {
+		target := "/objects?prefix=gallery/&limit=2"
+		if token != "" {
+			target += "&continuation_token=" + url.QueryEscape(token)
+		}
+		rec := doRequest(t, router, http.MethodGet, target, nil)
+		expectStatus(t, rec, http.StatusOK)
+		var res ListObjectsResponse
+		decodeData(t, rec, &res)
+		pages++
+		if len(res.Objects) > 2 {
+			t.Fatalf("page %d has %d objects, want at most the limit 2", pages, len(res.Objects))
+		}
+		for _, object := range res.Objects {
+			names = append(names, object.FileName)
+			if object.Size == nil || *object.Size != 100 || object.LastModified == nil {
+				t.Errorf("object = %+v, want its size and last-modified time", object)
+			}
+		}
+		if res.ContinuationToken == "" {
+			break
+		}
+		token = res.ContinuationToken
+	}
+	if pages != 3 {
+		t.Errorf("pages = %d, want 3", pages)
+	}
+	if want := "gallery/a.png,gallery/b.png,gallery/c.png,gallery/d.png,gallery/e.png"; strings.Join(names, ",") != want {
+		t.Errorf("listed %v, want %s", names, want)
+	}
+
+	for _, target := range []string{"/objects?limit=0", "/objects?limit=1001", "/objects?limit=ten", "/objects?prefix=../private/"} {
+		rec := doRequest(t, router, http.MethodGet, target, nil)
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+}
+
+func TestUploadStorageClass(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"AWS_DEFAULT_STORAGE_CLASS": "STANDARD_IA"})
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "storage_class": "GLACIER_IR"})
+	if value := res.RequiredHeaders["X-Amz-Storage-Class"]; value != "GLACIER_IR" {
+		t.Errorf("required headers = %v, want x-amz-storage-class: GLACIER_IR", res.RequiredHeaders)
+	}
+	if !containsDetail(res.Details, "GLACIER_IR") {
+		t.Errorf("Details = %q, want the storage class header", res.Details)
+	}
+	if u, err := url.Parse(res.PreAssignedURL); err != nil || !strings.Contains(u.Query().Get("X-Amz-SignedHeaders"), "x-amz-storage-class") {
+		t.Errorf("URL = %q, want x-amz-storage-class signed", res.PreAssignedURL)
+	}
+
+	res = presignUpload(t, router, map[string]interface{}{"content_length": 1234})
+	if value := res.RequiredHeaders["X-Amz-Storage-Class"]; value != "STANDARD_IA" {
+		t.Errorf("required headers = %v, want the AWS_DEFAULT_STORAGE_CLASS", res.RequiredHeaders)
+	}
+
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234, "storage_class": "COLD"})
+	expectStatus(t, rec, http.StatusBadRequest)
+	if res := decodeJSON(t, rec); !strings.Contains(fmt.Sprint(res["message"]), "storage_class") {
+		t.Errorf("body = %v, want the storage_class error", res)
+	}
+}
+
+func TestUploadExamples(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"ALLOWED_CONTENT_TYPES": "image/png,image/jpeg"})
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "file_name": "images/logo.png", "include_examples": true})
+	if !strings.HasPrefix(res.CurlExample, "curl -X PUT") || !strings.Contains(res.CurlExample, shellQuote(res.PreAssignedURL)) {
+		t.Errorf("curl example = %q, want the PUT and the URL", res.CurlExample)
+	}
+	if !strings.Contains(res.CurlExample, "-H 'Content-Type: image/png'") {
+		t.Errorf("curl example = %q, want the Content-Type header", res.CurlExample)
+	}
+	if !strings.Contains(res.FetchExample, jsString(res.PreAssignedURL)) || !strings.Contains(res.FetchExample, `method: "PUT"`) {
+		t.Errorf("fetch example = %q, want the PUT and the URL", res.FetchExample)
+	}
+	if !strings.Contains(res.FetchExample, `"Content-Type": "image/png"`) || strings.Contains(res.FetchExample, "Content-Length") {
+		t.Errorf("fetch example = %q, want Content-Type and no Content-Length", res.FetchExample)
+	}
+
+	// The snippets follow the headers the URL requires
+	res = presignUpload(t, router, map[string]interface{}{"content_length": 1234, "file_name": "images/a.jpg", "content_type": "image/jpeg", "cache_control": "no-cache", "include_examples": true})
+	if !strings.Contains(res.CurlExample, "-H 'Content-Type: image/jpeg'") || !strings.Contains(res.CurlExample, "-H 'Cache-Control: no-cache'") {
+		t.Errorf("curl example = %q, want the JPEG Content-Type and the Cache-Control", res.CurlExample)
+	}
+
+	res = presignUpload(t, router, map[string]interface{}{"content_length": 1234})
+	if res.CurlExample != "" || res.FetchExample != "" {
+		t.Errorf("examples = %q, %q, want none without include_examples", res.CurlExample, res.FetchExample)
+	}
+}
+
+func TestUploadUnknownLength(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"MAX_UPLOAD_SIZE_BYTES": "1000"})
+
+	res := presignUpload(t, router, map[string]interface{}{"allow_unknown_length": true})
+	if _, ok := res.RequiredHeaders["Content-Length"]; ok {
+		t.Errorf("required headers = %v, want no Content-Length", res.RequiredHeaders)
+	}
+	u, err := url.Parse(res.PreAssignedURL)
+	if err != nil || strings.Contains(u.Query().Get("X-Amz-SignedHeaders"), "content-length") {
+		t.Errorf("URL = %q, want content-length unsigned", res.PreAssignedURL)
+	}
+	if !containsDetail(res.Details, "1000 bytes") {
+		t.Errorf("Details = %q, want the size limit noted", res.Details)
+	}
+
+	// Without the flag the length is still required
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{})
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	// A known length is still bound when the flag is set
+	res = presignUpload(t, router, map[string]interface{}{"allow_unknown_length": true, "content_length": 500})
+	if value := res.RequiredHeaders["Content-Length"]; value != "500" {
+		t.Errorf("required headers = %v, want Content-Length: 500", res.RequiredHeaders)
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234}, REQUEST_ID_HEADER, "trace-abc-123")
+	expectStatus(t, rec, http.StatusOK)
+	if id := rec.Header().Get(REQUEST_ID_HEADER); id != "trace-abc-123" {
+		t.Errorf("%s = %q, want the incoming ID", REQUEST_ID_HEADER, id)
+	}
+	if res := decodeJSON(t, rec); res["request_id"] != "trace-abc-123" {
+		t.Errorf("request_id = %v, want the incoming ID in the envelope", res["request_id"])
+	}
+
+	// Errors carry a generated ID when the client sends none
+	rec = doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": -1})
+	expectStatus(t, rec, http.StatusBadRequest)
+	id := rec.Header().Get(REQUEST_ID_HEADER)
+	if id == "" {
+		t.Fatalf("%s is empty, want a generated ID", REQUEST_ID_HEADER)
+	}
+	if res := decodeJSON(t, rec); res["request_id"] != id {
+		t.Errorf("request_id = %v, want the generated %q", res["request_id"], id)
+	}
+	rec = doRequest(t, router, http.MethodGet, "/livez", nil)
+	if other := rec.Header().Get(REQUEST_ID_HEADER); other == "" || other == id {
+		t.Errorf("%s = %q, want a new ID for every request", REQUEST_ID_HEADER, other)
+	}
+}
+
+func TestHeadURL(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	res := presign(t, router, "/get-head-url", map[string]interface{}{"file_name": "reports/april.pdf"})
+	if res.Method != http.MethodHead {
+		t.Errorf("Method = %q, want HEAD", res.Method)
+	}
+	u, err := url.Parse(res.PreAssignedURL)
+	if err != nil || u.Path != "/reports/april.pdf" || u.Query().Get("X-Amz-Signature") == "" {
+		t.Errorf("URL = %q, want a signed URL for reports/april.pdf", res.PreAssignedURL)
+	}
+	if !containsDetail(res.Details, "HEAD request") {
+		t.Errorf("Details = %q, want the HEAD instruction", res.Details)
+	}
+
+	rec := doRequest(t, router, http.MethodPost, "/get-head-url", map[string]interface{}{"file_name": "../secret.pdf"})
+	expectStatus(t, rec, http.StatusNotFound)
+}
+
+func TestPresignedURLResponseMapping(t *testing.T) {
+	server := newTestServer(t, map[string]string{"MAX_URL_LENGTH": "100"})
+	signed := "https://test-bucket.s3.amazonaws.com/a.png?X-Amz-SignedHeaders=content-length%3Bcontent-type%3Bhost&X-Amz-Signature=abc"
+	result := PresignResult{
+		Method:           http.MethodPut,
+		URL:              signed,
+		ExpirationTime:   testNow,
+		FileName:         "a.png",
+		Host:             "test-bucket.s3.amazonaws.com",
+		Details:          []string{"Use the pre-signed URL to upload the file"},
+		ObjectURL:        "https://cdn.example.com/a.png",
+		PathStyleURL:     "https://s3.amazonaws.com/test-bucket/a.png",
+		VirtualHostedURL: "https://test-bucket.s3.amazonaws.com/a.png",
+		SignedHeaders:    http.Header{"Content-Length": {"1234"}, "Content-Type": {"image/png"}, "Host": {"test-bucket.s3.amazonaws.com"}},
+		SigningRegion:    "us-east-1",
+	}
+
+	res := server.presignedURLResponse(result)
+	if res.Method != result.Method || res.PreAssignedURL != signed || res.FileName != "a.png" || res.Host != result.Host {
+		t.Errorf("response = %+v, want the method, URL, file name and host copied", res)
+	}
+	if !res.ExpirationTime.Equal(testNow) || res.ExpirationUnix != testNow.Unix() {
+		t.Errorf("expiration = %v, %d, want %v", res.ExpirationTime, res.ExpirationUnix, testNow)
+	}
+	if res.ObjectUrl != result.ObjectURL || res.ObjectUrlPathStyle != result.PathStyleURL || res.ObjectUrlVirtualHosted != result.VirtualHostedURL {
+		t.Errorf("object URLs = %q, %q, %q, want the result URLs", res.ObjectUrl, res.ObjectUrlPathStyle, res.ObjectUrlVirtualHosted)
+	}
+	// Host is signed but never set by clients
+	if len(res.RequiredHeaders) != 2 || res.RequiredHeaders["Content-Length"] != "1234" || res.RequiredHeaders["Content-Type"] != "image/png" {
+		t.Errorf("required headers = %v, want Content-Length and Content-Type", res.RequiredHeaders)
+	}
+	if strings.Join(res.SignedHeaders, ";") != "content-length;content-type;host" {
+		t.Errorf("signed headers = %v, want them read from the URL", res.SignedHeaders)
+	}
+	if res.SigningRegion != "us-east-1" || len(res.Details) != 1 {
+		t.Errorf("response = %+v, want the signing region and details", res)
+	}
+	if len(res.Warnings) != 1 || !strings.Contains(res.Warnings[0], "over the 100") {
+		t.Errorf("warnings = %v, want the URL length warning", res.Warnings)
+	}
+}
+
+func TestAllowedBuckets(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		server := newTestServer(t, nil)
+		if reqErr := server.checkBucket("test-bucket"); reqErr != nil {
+			t.Errorf("checkBucket(AWS_BUCKET) = %v, want it allowed", reqErr)
+		}
+		if reqErr := server.checkBucket("someone-elses-bucket"); reqErr == nil || reqErr.Status != http.StatusForbidden {
+			t.Errorf("checkBucket(other) = %v, want 403", reqErr)
+		}
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		_, router := newTestRouter(t, map[string]string{
+			"ALLOWED_BUCKETS": "test-bucket,archive-bucket",
+			"BUCKETS":         `{"archive": {"bucket": "archive-bucket"}}`,
+		})
+		res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "bucket_alias": "archive"})
+		if res.Host != "archive-bucket.s3.amazonaws.com" {
+			t.Errorf("Host = %q, want the archive bucket", res.Host)
+		}
+	})
+
+	t.Run("disallowed", func(t *testing.T) {
+		_, router := newTestRouter(t, map[string]string{"ALLOWED_BUCKETS": "archive-bucket"})
+		rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234})
+		expectStatus(t, rec, http.StatusForbidden)
+		if res := decodeJSON(t, rec); res["code"] != ERROR_CODE_FORBIDDEN {
+			t.Errorf("code = %v, want %s", res["code"], ERROR_CODE_FORBIDDEN)
+		}
+		rec = doRequest(t, router, http.MethodPost, "/get-download-url", map[string]interface{}{"file_name": "a.png"})
+		expectStatus(t, rec, http.StatusForbidden)
+	})
+
+	t.Run("alias outside the list", func(t *testing.T) {
+		setTestEnv(t, map[string]string{
+			"ALLOWED_BUCKETS": "test-bucket",
+			"BUCKETS":         `{"archive": {"bucket": "archive-bucket"}}`,
+		})
+		if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "not in ALLOWED_BUCKETS") {
+			t.Errorf("loadConfig error = %v, want the alias rejected", err)
+		}
+	})
+}
+
+func TestUploadWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var events []UploadIssuedEvent
+	attempts := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		// The first delivery fails, the retry gets through
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var event UploadIssuedEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("webhook payload is not JSON: %v", err)
+		}
+		events = append(events, event)
+	}))
+	defer hook.Close()
+
+	server, router := newTestRouter(t, map[string]string{"WEBHOOK_URL": hook.URL})
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "file_name": "images/logo.png"}, REQUEST_ID_HEADER, "webhook-test")
+	server.Webhook.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 2 || len(events) != 1 {
+		t.Fatalf("attempts = %d, events = %v, want one event delivered on the retry", attempts, events)
+	}
+	event := events[0]
+	if event.Event != EVENT_UPLOAD_ISSUED || event.FileName != "images/logo.png" || event.Bucket != "test-bucket" || event.ContentType != "image/png" {
+		t.Errorf("event = %+v, want the issued upload", event)
+	}
+	if event.RequestID != "webhook-test" || !event.ExpirationTime.Equal(res.ExpirationTime) {
+		t.Errorf("event = %+v, want the request ID and the URL expiry %v", event, res.ExpirationTime)
+	}
+}
+
+func TestDownloadResponseContentType(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	res := presign(t, router, "/get-download-url", map[string]interface{}{"file_name": "videos/intro.bin", "response_content_type": "video/mp4"})
+	u, err := url.Parse(res.PreAssignedURL)
+	if err != nil {
+		t.Fatalf("invalid URL %q: %v", res.PreAssignedURL, err)
+	}
+	if contentType := u.Query().Get("response-content-type"); contentType != "video/mp4" {
+		t.Errorf("response-content-type = %q, want video/mp4", contentType)
+	}
+	// Only host is signed, so players can send Range
+	if signedHeaders := u.Query().Get("X-Amz-SignedHeaders"); signedHeaders != "host" {
+		t.Errorf("X-Amz-SignedHeaders = %q, want host only", signedHeaders)
+	}
+	if !containsDetail(res.Details, "Range") {
+		t.Errorf("Details = %q, want range support documented", res.Details)
+	}
+
+	rec := doRequest(t, router, http.MethodPost, "/get-download-url", map[string]interface{}{"file_name": "videos/intro.bin", "response_content_type": "not a type"})
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+func TestFixedClockExpiration(t *testing.T) {
+	server, router := newTestRouter(t, nil)
+	setClock(server, fixedClock(testNow))
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "expires_in_seconds": 300})
+	if want := testNow.Add(300 * time.Second); !res.ExpirationTime.Equal(want) {
+		t.Errorf("ExpirationTime = %v, want %v", res.ExpirationTime, want)
+	}
+	u, err := url.Parse(res.PreAssignedURL)
+	if err != nil {
+		t.Fatalf("invalid URL %q: %v", res.PreAssignedURL, err)
+	}
+	// The signature is dated by the same clock
+	if date := u.Query().Get("X-Amz-Date"); date != testNow.Format("20060102T150405Z") {
+		t.Errorf("X-Amz-Date = %q, want the fixed time", date)
+	}
+	if expires := u.Query().Get("X-Amz-Expires"); expires != "300" {
+		t.Errorf("X-Amz-Expires = %q, want 300", expires)
+	}
+
+	// Generated names use the clock too
+	res = presignUpload(t, router, map[string]interface{}{"content_length": 1234})
+	if !strings.HasPrefix(res.FileName, testNow.Format(DEFAULT_KEY_TIME_LAYOUT)) {
+		t.Errorf("FileName = %q, want it dated %s", res.FileName, testNow.Format(DEFAULT_KEY_TIME_LAYOUT))
+	}
+}
+
+// fakeIdentityClient answers GetCallerIdentity with err, or with account when err is nil
+type fakeIdentityClient struct {
+	account string
+	err     error
+}
+
+func (c *fakeIdentityClient) GetCallerIdentityWithContext(aws.Context, *sts.GetCallerIdentityInput, ...request.Option) (*sts.GetCallerIdentityOutput, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &sts.GetCallerIdentityOutput{Account: aws.String(c.account)}, nil
+}
+
+func TestCredentialsCheck(t *testing.T) {
+	server, router := newTestRouter(t, nil)
+	identity := &fakeIdentityClient{err: awserr.New("ExpiredToken", "The security token included in the request is expired for arn:aws:iam::123456789012:user/presigner", nil)}
+	server.Credentials = &CredentialsCheck{Client: identity}
+
+	rec := doRequest(t, router, http.MethodGet, "/healthz", nil)
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	if res := decodeJSON(t, rec); res["message"] != "AWS credentials have not been checked yet" {
+		t.Errorf("message = %v, want the pending check", res["message"])
+	}
+
+	status := server.Credentials.Check(context.Background())
+	if status.Valid || status.CheckedAt.IsZero() || !strings.Contains(status.Error, "ExpiredToken") {
+		t.Errorf("status = %+v, want an invalid, checked status with the error", status)
+	}
+	rec = doRequest(t, router, http.MethodGet, "/healthz", nil)
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	res := decodeJSON(t, rec)
+	if res["message"] != "AWS credentials are invalid" {
+		t.Errorf("message = %v, want the invalid credentials", res["message"])
+	}
+	if credentials, _ := res["credentials"].(map[string]interface{}); credentials["valid"] != false || credentials["checked_at"] == nil {
+		t.Errorf("credentials = %v, want the last checked status", res["credentials"])
+	}
+	if strings.Contains(rec.Body.String(), "123456789012") {
+		t.Errorf("body leaks the AWS error: %s", rec.Body.String())
+	}
+
+	// Readiness comes back once the credentials work again
+	identity.err = nil
+	identity.account = "123456789012"
+	server.Credentials.Check(context.Background())
+	rec = doRequest(t, router, http.MethodGet, "/healthz", nil)
+	expectStatus(t, rec, http.StatusOK)
+}
+
+func TestUploadFormBody(t *testing.T) {
+	server, router := newTestRouter(t, nil)
+	setClock(server, fixedClock(testNow))
+
+	jsonRec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{
+		"content_length":     1234,
+		"file_name":          "images/logo.png",
+		"expires_in_seconds": 300,
+		"cache_control":      "no-cache",
+	})
+	expectStatus(t, jsonRec, http.StatusOK)
+
+	form := url.Values{"content_length": {"1234"}, "file_name": {"images/logo.png"}, "expires_in_seconds": {"300"}, "cache_control": {"no-cache"}}
+	req := httptest.NewRequest(http.MethodPost, "/get-upload-url", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	formRec := httptest.NewRecorder()
+	router.ServeHTTP(formRec, req)
+	expectStatus(t, formRec, http.StatusOK)
+
+	var fromJSON, fromForm GeneratePresignedURLResponse
+	decodeData(t, jsonRec, &fromJSON)
+	decodeData(t, formRec, &fromForm)
+	encodedJSON, _ := json.Marshal(fromJSON)
+	encodedForm, _ := json.Marshal(fromForm)
+	if !bytes.Equal(encodedJSON, encodedForm) {
+		t.Errorf("form response = %s, want the JSON response %s", encodedForm, encodedJSON)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/get-upload-url", strings.NewReader("content_length: 1234"))
+	req.Header.Set("Content-Type", "text/yaml")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	expectStatus(t, rec, http.StatusUnsupportedMediaType)
+}
+
+// postPolicyConditions decodes the conditions of a presigned POST policy
+func postPolicyConditions(t testing.TB, res GeneratePresignedPostResponse) []interface{} {
+	t.Helper()
+	decoded, err := base64.StdEncoding.DecodeString(res.Fields["policy"])
+	if err != nil {
+		t.Fatalf("policy is not base64: %v", err)
+	}
+	var policy struct {
+		Conditions []interface{} `json:"conditions"`
+	}
+	if err := json.Unmarshal(decoded, &policy); err != nil {
+		t.Fatalf("policy is not JSON: %v: %s", err, decoded)
+	}
+	return policy.Conditions
+}
+
+func TestPostPolicyContentLengthRange(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"MIN_UPLOAD_SIZE_BYTES": "10", "MAX_UPLOAD_SIZE_BYTES": "5000"})
+
+	tests := []struct {
+		name string
+		body map[string]interface{}
+		want string
+	}{
+		{"declared length", map[string]interface{}{"content_length": 2000}, "[content-length-range 10 2000]"},
+		{"unknown length", map[string]interface{}{"allow_unknown_length": true}, "[content-length-range 10 5000]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, router, http.MethodPost, "/get-upload-post", tt.body)
+			expectStatus(t, rec, http.StatusOK)
+			var res GeneratePresignedPostResponse
+			decodeData(t, rec, &res)
+			var ranges []string
+			for _, condition := range postPolicyConditions(t, res) {
+				if list, ok := condition.([]interface{}); ok && len(list) == 3 && list[0] == "content-length-range" {
+					ranges = append(ranges, fmt.Sprint(list))
+				}
+			}
+			if len(ranges) != 1 || ranges[0] != tt.want {
+				t.Errorf("content-length-range conditions = %v, want %s", ranges, tt.want)
+			}
+		})
+	}
+
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-post", map[string]interface{}{"content_length": 5})
+	expectStatus(t, rec, http.StatusBadRequest)
+}
+
+func TestRegionConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		region  string
+		problem string
+	}{
+		{"valid", map[string]string{"AWS_REGION": "eu-central-1"}, "eu-central-1", ""},
+		{"gov cloud", map[string]string{"AWS_REGION": "us-gov-west-1"}, "us-gov-west-1", ""},
+		{"invalid format", map[string]string{"AWS_REGION": "Frankfurt"}, "", `invalid AWS_REGION: "Frankfurt" is not an AWS region`},
+		{"fallback", map[string]string{"AWS_REGION": "", "DEFAULT_AWS_REGION": "ap-southeast-2"}, "ap-southeast-2", ""},
+		{"invalid fallback", map[string]string{"AWS_REGION": "", "DEFAULT_AWS_REGION": "eu_west_1"}, "", "invalid DEFAULT_AWS_REGION"},
+		{"missing", map[string]string{"AWS_REGION": ""}, "", "AWS_REGION (or DEFAULT_AWS_REGION)"},
+		{"custom endpoint", map[string]string{"AWS_REGION": "garage", "AWS_ENDPOINT": "http://localhost:3900"}, "garage", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestEnv(t, tt.env)
+			config, err := loadConfig()
+			if tt.problem != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.problem) {
+					t.Errorf("loadConfig error = %v, want %q", err, tt.problem)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if config.Region != tt.region {
+				t.Errorf("Region = %q, want %q", config.Region, tt.region)
+			}
+		})
+	}
+}
+
+func TestObjectURLStyles(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           map[string]string
+		objectURL     string
+		pathStyle     string
+		virtualHosted string
+	}{
+		{
+			"aws",
+			map[string]string{"AWS_REGION": "eu-west-1", "AWS_BUCKET": "media-assets"},
+			"https://media-assets.s3.eu-west-1.amazonaws.com/photos/a.png",
+			"https://s3.eu-west-1.amazonaws.com/media-assets/photos/a.png",
+			"https://media-assets.s3.eu-west-1.amazonaws.com/photos/a.png",
+		},
+		{
+			"path style endpoint",
+			map[string]string{"AWS_BUCKET": "media-assets", "AWS_ENDPOINT": "http://127.0.0.1:9000", "AWS_S3_FORCE_PATH_STYLE": "true"},
+			"http://127.0.0.1:9000/media-assets/photos/a.png",
+			"http://127.0.0.1:9000/media-assets/photos/a.png",
+			// An IP address has no bucket subdomains
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, router := newTestRouter(t, tt.env)
+			res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "file_name": "photos/a.png"})
+			if res.ObjectUrl != tt.objectURL {
+				t.Errorf("object_url = %q, want %q", res.ObjectUrl, tt.objectURL)
+			}
+			if res.ObjectUrlPathStyle != tt.pathStyle {
+				t.Errorf("object_url_path_style = %q, want %q", res.ObjectUrlPathStyle, tt.pathStyle)
+			}
+			if res.ObjectUrlVirtualHosted != tt.virtualHosted {
+				t.Errorf("object_url_virtual_hosted = %q, want %q", res.ObjectUrlVirtualHosted, tt.virtualHosted)
+			}
+		})
+	}
+}
+
+func TestRefreshUploadURL(t *testing.T) {
+	server, router := newTestRouter(t, map[string]string{"AWS_KEY_PREFIX": "uploads/"})
+	setClock(server, fixedClock(testNow))
+
+	issued := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "file_name": "photo.png", "expires_in_seconds": 300})
+	if issued.FileName != "uploads/photo.png" {
+		t.Fatalf("FileName = %q, want uploads/photo.png", issued.FileName)
+	}
+
+	// Later, the client asks for a fresh URL for the same key
+	setClock(server, fixedClock(testNow.Add(4*time.Minute)))
+	refreshed := presign(t, router, "/refresh-upload-url", map[string]interface{}{"file_name": issued.FileName, "content_length": 1234, "expires_in_seconds": 300})
+	if refreshed.FileName != issued.FileName {
+		t.Errorf("FileName = %q, want the original %q", refreshed.FileName, issued.FileName)
+	}
+	if want := testNow.Add(9 * time.Minute); !refreshed.ExpirationTime.Equal(want) {
+		t.Errorf("ExpirationTime = %v, want renewed to %v", refreshed.ExpirationTime, want)
+	}
+	if refreshed.PreAssignedURL == issued.PreAssignedURL {
+		t.Error("refreshed URL is the original URL, want a new signature")
+	}
+	if u, err := url.Parse(refreshed.PreAssignedURL); err != nil || u.Path != "/uploads/photo.png" {
+		t.Errorf("URL = %q, want it for uploads/photo.png", refreshed.PreAssignedURL)
+	}
+
+	for _, name := range []string{"../uploads/photo.png", "elsewhere/photo.png"} {
+		rec := doRequest(t, router, http.MethodPost, "/refresh-upload-url", map[string]interface{}{"file_name": name, "content_length": 1234})
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+}
+
+func TestGlobalRateLimit(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{
+		"RATE_LIMIT_PER_SECOND":        "0.01",
+		"RATE_LIMIT_BURST":             "2",
+		"GLOBAL_RATE_LIMIT_PER_SECOND": "0.01",
+		"GLOBAL_RATE_LIMIT_BURST":      "3",
+		"TRUST_PROXY_HEADERS":          "true",
+	})
+	body := map[string]interface{}{"content_length": 1234}
+
+	// Every client is within its own budget, together they drain the server's
+	for i := 0; i < 3; i++ {
+		rec := doRequest(t, router, http.MethodPost, "/get-upload-url", body, "X-Forwarded-For", fmt.Sprintf("203.0.113.%d", i))
+		expectStatus(t, rec, http.StatusOK)
+	}
+	for i := 3; i < 6; i++ {
+		rec := doRequest(t, router, http.MethodPost, "/get-upload-url", body, "X-Forwarded-For", fmt.Sprintf("203.0.113.%d", i))
+		expectStatus(t, rec, http.StatusServiceUnavailable)
+		if retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || retryAfter <= 0 {
+			t.Errorf("Retry-After = %q, want a positive number of seconds", rec.Header().Get("Retry-After"))
+		}
+	}
+
+	// A client over its own budget gets 429, the per IP limit runs before the global one
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", body, "X-Forwarded-For", "203.0.113.0")
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	rec = doRequest(t, router, http.MethodPost, "/get-upload-url", body, "X-Forwarded-For", "203.0.113.0")
+	expectStatus(t, rec, http.StatusTooManyRequests)
+}
+
+func TestUploadChecksumAlgorithm(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "checksum_algorithm": "SHA256"})
+	if u, err := url.Parse(res.PreAssignedURL); err != nil || u.Query().Get("X-Amz-Sdk-Checksum-Algorithm") != "SHA256" {
+		t.Errorf("URL = %q, want X-Amz-Sdk-Checksum-Algorithm=SHA256 signed in the query", res.PreAssignedURL)
+	}
+	if !containsDetail(res.Details, "x-amz-checksum-sha256") {
+		t.Errorf("Details = %q, want the x-amz-checksum-sha256 header", res.Details)
+	}
+
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234, "checksum_algorithm": "MD4"})
+	expectStatus(t, rec, http.StatusBadRequest)
+	if res := decodeJSON(t, rec); !strings.Contains(fmt.Sprint(res["message"]), "checksum_algorithm") {
+		t.Errorf("body = %v, want the checksum_algorithm error", res)
+	}
+}
+
+// failingWriter accepts the headers and fails every body write, as a closed connection does
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingWriter) Write([]byte) (int, error) {
+	return 0, syscall.EPIPE
+}
+
+// captureLogs sends the default logger to a buffer for the rest of the test
+func captureLogs(t testing.TB) *bytes.Buffer {
+	t.Helper()
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &logs
+}
+
+func TestSendResponseErrorsAreLogged(t *testing.T) {
+	logs := captureLogs(t)
+
+	w := failingWriter{httptest.NewRecorder()}
+	w.Header().Set(REQUEST_ID_HEADER, "write-test")
+	SendResponse(w, Success("ok", nil), http.StatusOK)
+	if !strings.Contains(logs.String(), "failed to write response") || !strings.Contains(logs.String(), "request_id=write-test") {
+		t.Errorf("logs = %q, want the write failure with the request ID", logs.String())
+	}
+
+	// An encoding failure is logged and still answered, with a 500
+	logs.Reset()
+	rec := httptest.NewRecorder()
+	rec.Header().Set(REQUEST_ID_HEADER, "encode-test")
+	SendResponse(rec, map[string]interface{}{"value": math.NaN()}, http.StatusOK)
+	expectStatus(t, rec, http.StatusInternalServerError)
+	if !strings.Contains(logs.String(), "failed to encode response") || !strings.Contains(logs.String(), "request_id=encode-test") {
+		t.Errorf("logs = %q, want the encoding failure with the request ID", logs.String())
+	}
+	if res := decodeJSON(t, rec); res["success"] != false {
+		t.Errorf("body = %v, want the error envelope", res)
+	}
+}
+
+func TestDownloadVersionID(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+	versionID := "3HL4kqtJlcpXroDTDmJ+rmSpXd3dIbrHY+MTRCxf3vjVBH40Nr8X8gdRQBpUMLUo"
+
+	res := presign(t, router, "/get-download-url", map[string]interface{}{"file_name": "reports/april.pdf", "version_id": versionID})
+	u, err := url.Parse(res.PreAssignedURL)
+	if err != nil {
+		t.Fatalf("invalid URL %q: %v", res.PreAssignedURL, err)
+	}
+	if got := u.Query().Get("versionId"); got != versionID {
+		t.Errorf("versionId = %q, want %q in the signed query", got, versionID)
+	}
+	if object, err := url.Parse(res.ObjectUrl); err != nil || object.Query().Get("versionId") != versionID {
+		t.Errorf("ObjectUrl = %q, want the version", res.ObjectUrl)
+	}
+
+	for _, versionID := range []string{"has space", strings.Repeat("a", MAX_VERSION_ID_LENGTH+1)} {
+		rec := doRequest(t, router, http.MethodPost, "/get-download-url", map[string]interface{}{"file_name": "reports/april.pdf", "version_id": versionID})
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+}
+
+func TestAllowedExtensions(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{
+		"ALLOWED_CONTENT_TYPES": "application/octet-stream",
+		"ALLOWED_EXTENSIONS":    ".zip,.tar",
+	})
+
+	tests := []struct {
+		name     string
+		fileName string
+		status   int
+	}{
+		{"allowed", "backups/site.zip", http.StatusOK},
+		{"case insensitive", "backups/SITE.TAR", http.StatusOK},
+		{"disallowed", "backups/run.exe", http.StatusBadRequest},
+		{"no extension", "backups/site", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234, "file_name": tt.fileName, "content_type": "application/octet-stream"})
+			expectStatus(t, rec, tt.status)
+			if tt.status == http.StatusBadRequest {
+				if res := decodeJSON(t, rec); res["code"] != ERROR_CODE_INVALID_FILE_NAME {
+					t.Errorf("code = %v, want %s", res["code"], ERROR_CODE_INVALID_FILE_NAME)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	server, router := newTestRouter(t, map[string]string{"MAX_UPLOAD_SIZE_BYTES": "1000", "STRICT_CONTENT_TYPE": "true"})
+
+	tests := []struct {
+		name   string
+		body   interface{}
+		status int
+		code   string
+	}{
+		{"content length", map[string]interface{}{"content_length": 5000}, http.StatusBadRequest, ERROR_CODE_INVALID_CONTENT_LENGTH},
+		{"content type", map[string]interface{}{"content_length": 100, "content_type": "text/html"}, http.StatusUnsupportedMediaType, ERROR_CODE_UNSUPPORTED_CONTENT_TYPE},
+		{"content type mismatch", map[string]interface{}{"content_length": 100, "file_name": "a.png", "content_type": "image/jpeg"}, http.StatusBadRequest, ERROR_CODE_CONTENT_TYPE_MISMATCH},
+		{"file name", map[string]interface{}{"content_length": 100, "file_name": "../a.png"}, http.StatusBadRequest, ERROR_CODE_INVALID_FILE_NAME},
+		{"expiration", map[string]interface{}{"content_length": 100, "expires_in_seconds": 1}, http.StatusBadRequest, ERROR_CODE_INVALID_EXPIRATION},
+		{"several fields", map[string]interface{}{"content_length": 5000, "file_name": "../a.png"}, http.StatusBadRequest, ERROR_CODE_INVALID_FIELDS},
+		{"body", "{", http.StatusBadRequest, ERROR_CODE_INVALID_BODY},
+		{"other field", map[string]interface{}{"content_length": 100, "acl": "world-writable"}, http.StatusBadRequest, ERROR_CODE_INVALID_REQUEST},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, router, http.MethodPost, "/get-upload-url", tt.body)
+			expectStatus(t, rec, tt.status)
+			res := decodeJSON(t, rec)
+			if res["code"] != tt.code {
+				t.Errorf("code = %v, want %s", res["code"], tt.code)
+			}
+			if message, _ := res["message"].(string); message == "" {
+				t.Errorf("body = %v, want a message for humans", res)
+			}
+		})
+	}
+
+	// A field is reported with the same code on every route
+	routes := []struct {
+		name string
+		path string
+		body map[string]interface{}
+		code string
+	}{
+		{"multipart create file name", "/multipart/create", map[string]interface{}{"file_name": "../a.png"}, ERROR_CODE_INVALID_FILE_NAME},
+		{"multipart create metadata", "/multipart/create", map[string]interface{}{"file_name": "a.png", "metadata": map[string]string{"bad key": "x"}}, ERROR_CODE_INVALID_REQUEST},
+		{"part file name", "/multipart/part-url", map[string]interface{}{"file_name": "../a.png", "upload_id": "upload-1", "part_number": 1}, ERROR_CODE_INVALID_FILE_NAME},
+		{"part upload id", "/multipart/part-url", map[string]interface{}{"file_name": "a.png", "part_number": 1}, ERROR_CODE_INVALID_REQUEST},
+		{"part number", "/multipart/part-url", map[string]interface{}{"file_name": "a.png", "upload_id": "upload-1", "part_number": 0}, ERROR_CODE_INVALID_REQUEST},
+		{"part expiration", "/multipart/part-url", map[string]interface{}{"file_name": "a.png", "upload_id": "upload-1", "part_number": 1, "expires_in_seconds": 1}, ERROR_CODE_INVALID_EXPIRATION},
+		{"complete file name", "/multipart/complete", map[string]interface{}{"file_name": "../a.png", "upload_id": "upload-1"}, ERROR_CODE_INVALID_FILE_NAME},
+		{"complete expiration", "/multipart/complete", map[string]interface{}{"file_name": "a.png", "upload_id": "upload-1", "expires_in_seconds": 1}, ERROR_CODE_INVALID_EXPIRATION},
+		{"download filename", "/get-download-url", map[string]interface{}{"file_name": "a.png", "download_filename": "a\nb.png"}, ERROR_CODE_INVALID_REQUEST},
+	}
+	for _, tt := range routes {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doRequest(t, router, http.MethodPost, tt.path, tt.body)
+			expectStatus(t, rec, http.StatusBadRequest)
+			if res := decodeJSON(t, rec); res["code"] != tt.code {
+				t.Errorf("code = %v, want %s", res["code"], tt.code)
+			}
+		})
+	}
+
+	t.Run("local upload file name", func(t *testing.T) {
+		_, local := newTestRouter(t, map[string]string{"STORAGE_BACKEND": "local", "LOCAL_STORAGE_DIR": t.TempDir()})
+		rec := doRequest(t, local, http.MethodPut, LOCAL_UPLOAD_PATH+"/a@b.png", "hello")
+		expectStatus(t, rec, http.StatusBadRequest)
+		if res := decodeJSON(t, rec); res["code"] != ERROR_CODE_INVALID_FILE_NAME {
+			t.Errorf("code = %v, want %s", res["code"], ERROR_CODE_INVALID_FILE_NAME)
+		}
+	})
+
+	t.Run("aws error", func(t *testing.T) {
+		config := server.Config
+		config.CredentialsProvider = func(*session.Session) credentials.Provider { return failingProvider{} }
+		svc := newFakeS3(t, config)
+		server.S3 = svc
+		server.Storage = &S3Backend{S3: svc}
+		rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 100})
+		expectStatus(t, rec, http.StatusInternalServerError)
+		if res := decodeJSON(t, rec); res["code"] != ERROR_CODE_AWS_ERROR {
+			t.Errorf("code = %v, want %s", res["code"], ERROR_CODE_AWS_ERROR)
+		}
+	})
+}
+
+func TestCopyURL(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	res := presign(t, router, "/get-copy-url", map[string]interface{}{"source_key": "drafts/report_v1.pdf", "destination_key": "published/report.pdf"})
+	if res.Method != http.MethodPut {
+		t.Errorf("Method = %q, want PUT", res.Method)
+	}
+	if source := res.RequiredHeaders["X-Amz-Copy-Source"]; source != "test-bucket/drafts/report_v1.pdf" {
+		t.Errorf("required headers = %v, want the copy source", res.RequiredHeaders)
+	}
+	u, err := url.Parse(res.PreAssignedURL)
+	if err != nil || u.Path != "/published/report.pdf" || !strings.Contains(u.Query().Get("X-Amz-SignedHeaders"), "x-amz-copy-source") {
+		t.Errorf("URL = %q, want the destination with x-amz-copy-source signed", res.PreAssignedURL)
+	}
+	if !containsDetail(res.Details, "x-amz-copy-source") {
+		t.Errorf("Details = %q, want the copy source header", res.Details)
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"source_key": "../secret.pdf", "destination_key": "published/report.pdf"},
+		{"source_key": "drafts/report.pdf", "destination_key": "../report.pdf"},
+	} {
+		rec := doRequest(t, router, http.MethodPost, "/get-copy-url", body)
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+}
+
+func TestUploadObjectExpires(t *testing.T) {
+	server, router := newTestRouter(t, nil)
+	setClock(server, fixedClock(testNow))
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "expires_at": "2024-05-01T00:00:00+02:00"})
+	if value := res.RequiredHeaders["Expires"]; value != "Tue, 30 Apr 2024 22:00:00 GMT" {
+		t.Errorf("required headers = %v, want the Expires header in UTC", res.RequiredHeaders)
+	}
+	if !containsDetail(res.Details, "Expires: Tue, 30 Apr 2024 22:00:00 GMT") {
+		t.Errorf("Details = %q, want the Expires header", res.Details)
+	}
+	// The object Expires header doesn't change when the URL expires
+	if !res.ExpirationTime.Equal(testNow.Add(DEFAULT_EXPIRATION)) {
+		t.Errorf("ExpirationTime = %v, want the default URL expiry", res.ExpirationTime)
+	}
+
+	for _, expiresAt := range []string{"2024-04-01T00:00:00Z", testNow.Format(time.RFC3339), "next tuesday"} {
+		rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234, "expires_at": expiresAt})
+		expectStatus(t, rec, http.StatusBadRequest)
+	}
+
+	// OBJECT_EXPIRES_AFTER_DAYS applies when the body sets none
+	server, router = newTestRouter(t, map[string]string{"OBJECT_EXPIRES_AFTER_DAYS": "30"})
+	setClock(server, fixedClock(testNow))
+	res = presignUpload(t, router, map[string]interface{}{"content_length": 1234})
+	if value := res.RequiredHeaders["Expires"]; value != testNow.AddDate(0, 0, 30).Format(http.TimeFormat) {
+		t.Errorf("required headers = %v, want Expires 30 days out", res.RequiredHeaders)
+	}
+}
+
+func TestRecovererAnswersJSON(t *testing.T) {
+	logs := captureLogs(t)
+	handler := middleware.RequestID(RequestIDHeader(Recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var counts map[string]int
+		counts["uploads"]++
+	}))))
+
+	rec := doRequest(t, handler, http.MethodGet, "/", nil, REQUEST_ID_HEADER, "panic-test")
+	expectStatus(t, rec, http.StatusInternalServerError)
+	res := decodeJSON(t, rec)
+	if res["success"] != false || res["code"] != ERROR_CODE_INTERNAL_ERROR || res["request_id"] != "panic-test" {
+		t.Errorf("body = %v, want the JSON 500 envelope", res)
+	}
+	if strings.Contains(rec.Body.String(), "nil map") {
+		t.Errorf("body leaks the panic: %s", rec.Body.String())
+	}
+	if !strings.Contains(logs.String(), "request panicked") || !strings.Contains(logs.String(), "assignment to entry in nil map") || !strings.Contains(logs.String(), "stack=") {
+		t.Errorf("logs = %q, want the panic and its stack", logs.String())
+	}
+
+	// The abort panic net/http relies on goes through
+	abort := Recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", v)
+		}
+	}()
+	doRequest(t, abort, http.MethodGet, "/", nil)
+}
+
+func TestSessionOptionsProfile(t *testing.T) {
+	awsConfig := &aws.Config{Region: aws.String("us-east-1")}
+
+	options := sessionOptions(newTestConfig(t, nil), awsConfig)
+	if options.Profile != "" || options.SharedConfigState != session.SharedConfigStateFromEnv {
+		t.Errorf("options = %+v, want the default chain without AWS_PROFILE", options)
+	}
+
+	options = sessionOptions(newTestConfig(t, map[string]string{"AWS_PROFILE": "staging", "AWS_SHARED_CONFIG_FILES": "/etc/aws/config, /etc/aws/extra"}), awsConfig)
+	if options.Profile != "staging" || options.SharedConfigState != session.SharedConfigEnable {
+		t.Errorf("options = %+v, want the staging profile with shared config enabled", options)
+	}
+	if strings.Join(options.SharedConfigFiles, ",") != "/etc/aws/config,/etc/aws/extra" {
+		t.Errorf("SharedConfigFiles = %v, want both files", options.SharedConfigFiles)
+	}
+
+	// The profile's keys sign the URLs
+	file := t.TempDir() + "/config"
+	profile := "[profile staging]\naws_access_key_id = AKIDSTAGING\naws_secret_access_key = staging-secret\n"
+	if err := os.WriteFile(file, []byte(profile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := newTestConfig(t, map[string]string{"AWS_ACCESS_KEY_ID": "", "AWS_SECRET_ACCESS_KEY": "", "AWS_PROFILE": "staging", "AWS_SHARED_CONFIG_FILES": file})
+	svc, err := newS3Client(config)
+	if err != nil {
+		t.Fatalf("newS3Client: %v", err)
+	}
+	creds, err := svc.Config.Credentials.Get()
+	if err != nil || creds.AccessKeyID != "AKIDSTAGING" {
+		t.Errorf("credentials = %q, %v, want the staging profile keys", creds.AccessKeyID, err)
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	server, router := newTestRouter(t, map[string]string{"MAX_BATCH_SIZE": "3", "MAX_BATCH_BYTES": "5000"})
+
+	tests := []struct {
+		name    string
+		lengths []int64
+		message string
+	}{
+		{"within both limits", []int64{2000, 3000}, ""},
+		{"empty", nil, "between 1 and 3 items"},
+		{"too many items", []int64{1, 1, 1, 1}, "between 1 and 3 items"},
+		{"too many bytes", []int64{2000, 3001}, "at most 5000 bytes"},
+		{"overflowing lengths", []int64{math.MaxInt64, math.MaxInt64}, "at most 5000 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqErr := server.checkBatch(tt.lengths)
+			if tt.message == "" {
+				if reqErr != nil {
+					t.Errorf("checkBatch = %v, want the batch accepted", reqErr.Message)
+				}
+				return
+			}
+			if reqErr == nil || reqErr.Status != http.StatusBadRequest || !strings.Contains(reqErr.Message, tt.message) {
+				t.Errorf("checkBatch = %+v, want a 400 saying %q", reqErr, tt.message)
+			}
+		})
+	}
+
+	batch := []map[string]interface{}{{"content_length": 3000}, {"content_length": 3000}}
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-urls", batch)
+	expectStatus(t, rec, http.StatusBadRequest)
+	if res := decodeJSON(t, rec); res["code"] != ERROR_CODE_BATCH_TOO_LARGE {
+		t.Errorf("code = %v, want %s", res["code"], ERROR_CODE_BATCH_TOO_LARGE)
+	}
+}
+
+func TestSignedHeaders(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+
+	res := presignUpload(t, router, map[string]interface{}{"content_length": 1234})
+	signed := map[string]bool{}
+	for _, name := range res.SignedHeaders {
+		signed[name] = true
+	}
+	for _, name := range []string{"host", "content-type", "content-length"} {
+		if !signed[name] {
+			t.Errorf("signed headers = %v, want %s", res.SignedHeaders, name)
+		}
+	}
+	u, err := url.Parse(res.PreAssignedURL)
+	if err != nil || strings.Join(res.SignedHeaders, ";") != u.Query().Get("X-Amz-SignedHeaders") {
+		t.Errorf("signed headers = %v, want the X-Amz-SignedHeaders of %q", res.SignedHeaders, res.PreAssignedURL)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	_, router := newTestRouter(t, map[string]string{"API_KEYS": "secret-key"})
+
+	// Unauthenticated even when API keys are required
+	rec := doRequest(t, router, http.MethodGet, "/version", nil)
+	expectStatus(t, rec, http.StatusOK)
+	res := decodeJSON(t, rec)
+	if res["version"] != Version {
+		t.Errorf("version = %v, want %q", res["version"], Version)
+	}
+	if commit, _ := res["commit"].(string); commit == "" {
+		t.Errorf("commit = %v, want a revision or unknown", res["commit"])
+	}
+	if res["go_version"] != runtime.Version() {
+		t.Errorf("go_version = %v, want %s", res["go_version"], runtime.Version())
+	}
+
+	previous := Commit
+	Commit = "0123abc"
+	t.Cleanup(func() { Commit = previous })
+	rec = doRequest(t, router, http.MethodGet, "/version", nil)
+	if res := decodeJSON(t, rec); res["commit"] != "0123abc" {
+		t.Errorf("commit = %v, want the -ldflags value", res["commit"])
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+	body := map[string]interface{}{"content_length": 1234}
+
+	first := doRequest(t, router, http.MethodPost, "/get-upload-url", body, IDEMPOTENCY_KEY_HEADER, "retry-1")
+	expectStatus(t, first, http.StatusOK)
+	if first.Header().Get(IDEMPOTENT_REPLAYED_HEADER) != "" {
+		t.Errorf("%s set on the first request", IDEMPOTENT_REPLAYED_HEADER)
+	}
+
+	// A retry with the same key and body gets the upload already issued
+	retry := doRequest(t, router, http.MethodPost, "/get-upload-url", body, IDEMPOTENCY_KEY_HEADER, "retry-1")
+	expectStatus(t, retry, http.StatusOK)
+	if retry.Header().Get(IDEMPOTENT_REPLAYED_HEADER) != "true" {
+		t.Errorf("%s = %q, want true", IDEMPOTENT_REPLAYED_HEADER, retry.Header().Get(IDEMPOTENT_REPLAYED_HEADER))
+	}
+	var issued, replayed GeneratePresignedURLResponse
+	decodeData(t, first, &issued)
+	decodeData(t, retry, &replayed)
+	if replayed.PreAssignedURL != issued.PreAssignedURL || replayed.FileName != issued.FileName || !replayed.ExpirationTime.Equal(issued.ExpirationTime) {
+		t.Errorf("replayed upload = %+v, want %+v", replayed, issued)
+	}
+
+	// Another key issues another upload
+	other := doRequest(t, router, http.MethodPost, "/get-upload-url", body, IDEMPOTENCY_KEY_HEADER, "retry-2")
+	expectStatus(t, other, http.StatusOK)
+	var another GeneratePresignedURLResponse
+	decodeData(t, other, &another)
+	if another.PreAssignedURL == issued.PreAssignedURL {
+		t.Error("a different key replayed the first upload")
+	}
+
+	// The same key with a different body is a client error, not a replay
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 4321}, IDEMPOTENCY_KEY_HEADER, "retry-1")
+	expectStatus(t, rec, http.StatusUnprocessableEntity)
+	if res := decodeJSON(t, rec); res["code"] != ERROR_CODE_IDEMPOTENCY_KEY_REUSED {
+		t.Errorf("code = %v, want %s", res["code"], ERROR_CODE_IDEMPOTENCY_KEY_REUSED)
+	}
+
+	t.Run("server clock", func(t *testing.T) {
+		server, router := newTestRouter(t, nil)
+		setClock(server, fixedClock(testNow))
+
+		first := doRequest(t, router, http.MethodPost, "/get-upload-url", body, IDEMPOTENCY_KEY_HEADER, "clock-1")
+		expectStatus(t, first, http.StatusOK)
+		retry := doRequest(t, router, http.MethodPost, "/get-upload-url", body, IDEMPOTENCY_KEY_HEADER, "clock-1")
+		if retry.Header().Get(IDEMPOTENT_REPLAYED_HEADER) != "true" {
+			t.Errorf("retry under the server clock was not replayed")
+		}
+
+		// Once the server clock passes the TTL the key issues a new upload
+		setClock(server, fixedClock(testNow.Add(server.Config.IdempotencyTTL+time.Second)))
+		late := doRequest(t, router, http.MethodPost, "/get-upload-url", body, IDEMPOTENCY_KEY_HEADER, "clock-1")
+		expectStatus(t, late, http.StatusOK)
+		if late.Header().Get(IDEMPOTENT_REPLAYED_HEADER) != "" {
+			t.Errorf("retry after the TTL was replayed")
+		}
+	})
+}
+
+func TestConfirmUpload(t *testing.T) {
+	server, router := newTestRouter(t, nil)
+	svc := testS3(server)
+	svc.putObject("test-bucket", "photos/cat.png", 1234, "image/png")
+
+	rec := doRequest(t, router, http.MethodPost, "/confirm-upload", map[string]interface{}{"file_name": "photos/cat.png", "content_type": "image/png", "content_length": 1234})
+	expectStatus(t, rec, http.StatusOK)
+	var confirmed ConfirmUploadResponse
+	decodeData(t, rec, &confirmed)
+	if confirmed.Size != 1234 || confirmed.ContentType != "image/png" || confirmed.ETag == "" {
+		t.Errorf("confirmed = %+v, want the stored size, type and etag", confirmed)
+	}
+	if confirmed.ObjectUrl != "https://test-bucket.s3.amazonaws.com/photos/cat.png" {
+		t.Errorf("ObjectUrl = %q, want the object in test-bucket", confirmed.ObjectUrl)
+	}
+	if svc.callCount("HeadObject") != 1 {
+		t.Errorf("HeadObject calls = %d, want 1", svc.callCount("HeadObject"))
+	}
+
+	rec = doRequest(t, router, http.MethodPost, "/confirm-upload", map[string]interface{}{"file_name": "photos/cat.png", "content_length": 99})
+	expectStatus(t, rec, http.StatusConflict)
+	if res := decodeJSON(t, rec); res["code"] != ERROR_CODE_UPLOAD_MISMATCH {
+		t.Errorf("code = %v, want %s", res["code"], ERROR_CODE_UPLOAD_MISMATCH)
+	}
+
+	rec = doRequest(t, router, http.MethodPost, "/confirm-upload", map[string]interface{}{"file_name": "photos/missing.png"})
+	expectStatus(t, rec, http.StatusNotFound)
+}
+
+func TestJSONFieldStyle(t *testing.T) {
+	body := map[string]interface{}{"content_length": 1234}
+	snakeKeys := []string{"pre_assigned_url", "expiration_time", "file_name", "required_headers"}
+	camelKeys := []string{"preAssignedURL", "expirationTime", "fileName", "requiredHeaders"}
+	expectKeys := func(t *testing.T, rec *httptest.ResponseRecorder, present []string, absent []string) {
+		t.Helper()
+		expectStatus(t, rec, http.StatusOK)
+		res := decodeJSON(t, rec)
+		data, _ := res["data"].(map[string]interface{})
+		for _, key := range present {
+			if _, ok := data[key]; !ok {
+				t.Errorf("data has no %q, got %v", key, sortedMapKeys(data))
+			}
+		}
+		for _, key := range absent {
+			if _, ok := data[key]; ok {
+				t.Errorf("data has %q, want the other style", key)
+			}
+		}
+		// Header values are data, not keys
+		if headers, _ := data[present[3]].(map[string]interface{}); headers["Content-Length"] != "1234" {
+			t.Errorf("required headers = %v, want Content-Length kept as is", headers)
+		}
+	}
+
+	t.Run("snake by default", func(t *testing.T) {
+		_, router := newTestRouter(t, nil)
+		expectKeys(t, doRequest(t, router, http.MethodPost, "/get-upload-url", body), snakeKeys, camelKeys)
+		expectKeys(t, doRequest(t, router, http.MethodPost, "/get-upload-url", body, "Accept", "application/json; field-style=camel"), camelKeys, snakeKeys)
+	})
+
+	t.Run("camel from JSON_FIELD_STYLE", func(t *testing.T) {
+		_, router := newTestRouter(t, map[string]string{"JSON_FIELD_STYLE": JSON_FIELD_STYLE_CAMEL})
+		expectKeys(t, doRequest(t, router, http.MethodPost, "/get-upload-url", body), camelKeys, snakeKeys)
+		expectKeys(t, doRequest(t, router, http.MethodPost, "/get-upload-url", body, "Accept", "application/json; field-style=snake"), snakeKeys, camelKeys)
+	})
+}
+
+// sortedMapKeys lists the keys of a decoded JSON object for failure messages
+func sortedMapKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestLoadEnvFileMissing(t *testing.T) {
+	setTestEnv(t, map[string]string{"AWS_BUCKET": "env-bucket"})
+	_, missing, err := loadEnvFile(t.TempDir() + "/.env")
+	if err != nil || !missing {
+		t.Fatalf("loadEnvFile = %v, %v, want a missing file and no error", missing, err)
+	}
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if config.Bucket != "env-bucket" {
+		t.Errorf("Bucket = %q, want the process environment value", config.Bucket)
+	}
+
+	// Required settings are still checked without the file
+	t.Setenv("AWS_BUCKET", "")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "AWS_BUCKET") {
+		t.Errorf("loadConfig error = %v, want AWS_BUCKET named as missing", err)
+	}
+
+	// A file that exists but cannot be parsed is still an error
+	path := t.TempDir() + "/.env"
+	if err := os.WriteFile(path, []byte("NOT VALID\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, missing, err := loadEnvFile(path); err == nil || missing {
+		t.Errorf("loadEnvFile = %v, %v, want a parse error", missing, err)
+	}
+}
+
+func TestLoadEnvFileFromFile(t *testing.T) {
+	setTestEnv(t, map[string]string{"AWS_BUCKET": "env-bucket"})
+	// Unset only through os, t.Setenv can't leave a variable unset
+	t.Cleanup(func() { os.Unsetenv("ENV_FILE_ONLY") })
+	path := t.TempDir() + "/.env"
+	if err := os.WriteFile(path, []byte("AWS_BUCKET=file-bucket\nENV_FILE_ONLY=from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fromFile, missing, err := loadEnvFile(path)
+	if err != nil || missing {
+		t.Fatalf("loadEnvFile = %v, %v, want the file loaded", missing, err)
+	}
+	// The process environment wins and is not counted as coming from the file
+	if os.Getenv("AWS_BUCKET") != "env-bucket" || os.Getenv("ENV_FILE_ONLY") != "from-file" {
+		t.Errorf("AWS_BUCKET, ENV_FILE_ONLY = %q, %q, want env-bucket, from-file", os.Getenv("AWS_BUCKET"), os.Getenv("ENV_FILE_ONLY"))
+	}
+	if len(fromFile) != 1 || !fromFile["ENV_FILE_ONLY"] {
+		t.Errorf("fromFile = %v, want only ENV_FILE_ONLY", fromFile)
+	}
+}
+
+func TestKeyStrategies(t *testing.T) {
+	hash := "9E107D9D372BB6826BD81D3542A419D6"
+	tests := []struct {
+		strategy string
+		pattern  string
+		// unique is false when the same file is meant to share a key
+		unique bool
+	}{
+		{"", `^\d{4}-\d{2}-\d{2}-\d{2}-\d{2}-\d{2}-[a-f0-9]{8}\.png$`, true},
+		{KEY_STRATEGY_TIMESTAMP, `^\d{4}-\d{2}-\d{2}-\d{2}-\d{2}-\d{2}-[a-f0-9]{8}\.png$`, true},
+		{KEY_STRATEGY_UUID, `^[a-f0-9]{8}-[a-f0-9]{4}-4[a-f0-9]{3}-[89ab][a-f0-9]{3}-[a-f0-9]{12}\.png$`, true},
+		{KEY_STRATEGY_HASH, `^9e107d9d372bb6826bd81d3542a419d6\.png$`, false},
+	}
+	for _, tt := range tests {
+		t.Run("strategy "+tt.strategy, func(t *testing.T) {
+			_, router := newTestRouter(t, map[string]string{"KEY_STRATEGY": tt.strategy})
+			pattern := regexp.MustCompile(tt.pattern)
+			body := map[string]interface{}{"content_length": 1234, "content_hash": hash}
+			seen := map[string]bool{}
+			for i := 0; i < 20; i++ {
+				res := presignUpload(t, router, body)
+				if !pattern.MatchString(res.FileName) {
+					t.Fatalf("FileName = %q, want it to match %s", res.FileName, tt.pattern)
+				}
+				seen[res.FileName] = true
+			}
+			if tt.unique && len(seen) != 20 {
+				t.Errorf("20 uploads got %d distinct keys, want 20", len(seen))
+			}
+			if !tt.unique && len(seen) != 1 {
+				t.Errorf("20 uploads of one file got %d keys, want 1", len(seen))
+			}
+		})
+	}
+
+	t.Run("hash required", func(t *testing.T) {
+		_, router := newTestRouter(t, map[string]string{"KEY_STRATEGY": KEY_STRATEGY_HASH})
+		for _, hash := range []string{"", "not-a-hash"} {
+			rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234, "content_hash": hash})
+			expectStatus(t, rec, http.StatusBadRequest)
+		}
+		// An explicit file_name doesn't need a hash
+		if res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "file_name": "cat.png"}); res.FileName != "cat.png" {
+			t.Errorf("FileName = %q, want cat.png", res.FileName)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		setTestEnv(t, map[string]string{"KEY_STRATEGY": "sequential"})
+		if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "KEY_STRATEGY") {
+			t.Errorf("loadConfig error = %v, want KEY_STRATEGY rejected", err)
+		}
+	})
+}
+
+func TestMaxURLLength(t *testing.T) {
+	body := map[string]interface{}{"content_length": 1234, "file_name": strings.Repeat("a", 200) + ".png"}
+	tests := []struct {
+		maxURLLength string
+		want         int
+		warned       bool
+	}{
+		{"", DEFAULT_MAX_URL_LENGTH, false},
+		{"100", 100, true},
+		// Zero turns the warning off
+		{"0", 0, false},
+		{"-1", DEFAULT_MAX_URL_LENGTH, false},
+	}
+	for _, tt := range tests {
+		t.Run("MAX_URL_LENGTH="+tt.maxURLLength, func(t *testing.T) {
+			server, router := newTestRouter(t, map[string]string{"MAX_URL_LENGTH": tt.maxURLLength})
+			if server.Config.MaxURLLength != tt.want {
+				t.Errorf("MaxURLLength = %d, want %d", server.Config.MaxURLLength, tt.want)
+			}
+			res := presignUpload(t, router, body)
+			if warned := len(res.Warnings) == 1 && strings.Contains(res.Warnings[0], "characters long"); warned != tt.warned {
+				t.Errorf("warnings = %v, want warned %v", res.Warnings, tt.warned)
+			}
+		})
+	}
+}
+
+func TestAllowedRegions(t *testing.T) {
+	env := map[string]string{
+		"ALLOWED_REGIONS": "us-east-1,eu-central-1=eu-bucket,ap-southeast-2",
+		"BUCKETS":         `{"sydney": {"bucket": "au-bucket", "region": "ap-southeast-2"}}`,
+	}
+	server, router := newTestRouter(t, env)
+	upload := map[string]interface{}{"content_length": 1234, "file_name": "photo.png"}
+	hosts := map[string]string{
+		"":               "test-bucket.s3.amazonaws.com",
+		"us-east-1":      "test-bucket.s3.amazonaws.com",
+		"eu-central-1":   "eu-bucket.s3.eu-central-1.amazonaws.com",
+		"ap-southeast-2": "au-bucket.s3.ap-southeast-2.amazonaws.com",
+	}
+	for region, host := range hosts {
+		upload["region"] = region
+		if res := presignUpload(t, router, upload); res.Host != host {
+			t.Errorf("upload in %q: Host = %q, want %q", region, res.Host, host)
+		}
+	}
+
+	// The routes for existing objects reach the same regional bucket, through the one eu-central-1 client
+	regionConfig := server.Config
+	regionConfig.Region = "eu-central-1"
+	euS3 := newFakeS3(t, regionConfig)
+	euS3.putObject("eu-bucket", "photo.png", 1234, "image/png")
+	server.Regions.clients["eu-central-1"] = euS3
+	routes := []struct {
+		method string
+		target string
+		body   map[string]interface{}
+	}{
+		{http.MethodPost, "/refresh-upload-url", map[string]interface{}{"file_name": "photo.png", "content_length": 1234, "region": "eu-central-1"}},
+		{http.MethodPost, "/get-download-url", map[string]interface{}{"file_name": "photo.png", "region": "eu-central-1"}},
+		{http.MethodPost, "/get-delete-url", map[string]interface{}{"file_name": "photo.png", "region": "eu-central-1"}},
+		{http.MethodPost, "/get-head-url", map[string]interface{}{"file_name": "photo.png", "region": "eu-central-1"}},
+		{http.MethodPost, "/get-copy-url", map[string]interface{}{"source_key": "photo.png", "destination_key": "copy.png", "region": "eu-central-1"}},
+		{http.MethodPost, "/confirm-upload", map[string]interface{}{"file_name": "photo.png", "region": "eu-central-1"}},
+		{http.MethodPost, "/multipart/create", map[string]interface{}{"file_name": "big.png", "region": "eu-central-1"}},
+		{http.MethodPost, "/multipart/part-url", map[string]interface{}{"file_name": "big.png", "upload_id": "upload-1", "part_number": 1, "region": "eu-central-1"}},
+		{http.MethodPost, "/multipart/complete", map[string]interface{}{"file_name": "big.png", "upload_id": "upload-1", "region": "eu-central-1"}},
+		{http.MethodGet, "/objects?region=eu-central-1", nil},
+	}
+	for _, route := range routes {
+		var body interface{}
+		if route.body != nil {
+			body = route.body
+		}
+		rec := doRequest(t, router, route.method, route.target, body)
+		expectStatus(t, rec, http.StatusOK)
+		// Multipart create and the listing answer without a URL
+		if route.target != "/multipart/create" && route.method == http.MethodPost && !strings.Contains(rec.Body.String(), hosts["eu-central-1"]) {
+			t.Errorf("%s = %s, want it in eu-bucket", route.target, rec.Body.String())
+		}
+		if route.method == http.MethodGet && !strings.Contains(rec.Body.String(), `"photo.png"`) {
+			t.Errorf("%s = %s, want the eu-bucket objects", route.target, rec.Body.String())
+		}
+	}
+	for _, operation := range []string{"HeadObject", "CreateMultipartUpload", "ListObjectsV2"} {
+		if euS3.callCount(operation) != 1 {
+			t.Errorf("eu-central-1 %s calls = %d, want 1", operation, euS3.callCount(operation))
+		}
+	}
+	if calls := testS3(server).callCount("ListObjectsV2"); calls != 0 {
+		t.Errorf("default client ListObjectsV2 calls = %d, want the regional client used", calls)
+	}
+
+	// A BUCKETS alias and the region field share the client of their region
+	sydney, err := server.Regions.Client("ap-southeast-2")
+	if err != nil {
+		t.Fatalf("Client: %v", err)
+	}
+	if server.Buckets["sydney"].S3 != sydney {
+		t.Error("the sydney alias has its own ap-southeast-2 client, want the shared one")
+	}
+	copied := presign(t, router, "/get-copy-url", map[string]interface{}{"source_key": "a.png", "destination_key": "b.png", "region": "ap-southeast-2"})
+	if copied.Host != hosts["ap-southeast-2"] {
+		t.Errorf("copy: Host = %q, want %q", copied.Host, hosts["ap-southeast-2"])
+	}
+
+	tests := []struct {
+		name string
+		body map[string]interface{}
+	}{
+		{"region not allowed", map[string]interface{}{"content_length": 1234, "region": "sa-east-1"}},
+		{"alias in another region", map[string]interface{}{"content_length": 1234, "bucket_alias": "sydney", "region": "eu-central-1"}},
+	}
+	for _, tt := range tests {
+		rec := doRequest(t, router, http.MethodPost, "/get-upload-url", tt.body)
+		expectStatus(t, rec, http.StatusBadRequest)
+		if res := decodeJSON(t, rec); !strings.Contains(fmt.Sprint(res["message"]), "region") {
+			t.Errorf("%s: message = %v, want the region named", tt.name, res["message"])
+		}
+	}
+
+	t.Run("region without a bucket", func(t *testing.T) {
+		setTestEnv(t, map[string]string{"ALLOWED_REGIONS": "eu-west-1"})
+		if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), `ALLOWED_REGIONS entry "eu-west-1" has no bucket`) {
+			t.Errorf("loadConfig error = %v, want eu-west-1 named as having no bucket", err)
+		}
+	})
+}
+
+func TestVerboseResponses(t *testing.T) {
+	_, router := newTestRouter(t, nil)
+	routes := map[string]map[string]interface{}{
+		"/get-upload-url":     {"content_length": 1234},
+		"/get-download-url":   {"file_name": "photo.png"},
+		"/refresh-upload-url": {"file_name": "photo.png", "content_length": 1234},
+		"/get-delete-url":     {"file_name": "photo.png"},
+		"/get-head-url":       {"file_name": "photo.png"},
+		"/get-copy-url":       {"source_key": "a.png", "destination_key": "b.png"},
+	}
+	for path, body := range routes {
+		for _, tt := range []struct {
+			name   string
+			target string
+			body   map[string]interface{}
+			full   bool
+		}{
+			{"default", path, body, true},
+			{"body false", path, withField(body, "verbose", false), false},
+			{"query false", path + "?verbose=false", body, false},
+			// The body wins over the query
+			{"body true", path + "?verbose=false", withField(body, "verbose", true), true},
+		} {
+			rec := doRequest(t, router, http.MethodPost, tt.target, tt.body)
+			expectStatus(t, rec, http.StatusOK)
+			data, _ := decodeJSON(t, rec)["data"].(map[string]interface{})
+			if data["pre_assigned_url"] == nil || data["expiration_time"] == nil {
+				t.Errorf("%s %s: data = %v, want the URL and expiry", path, tt.name, data)
+			}
+			if _, full := data["details"]; full != tt.full {
+				t.Errorf("%s %s: details present = %v, want %v", path, tt.name, full, tt.full)
+			}
+			if !tt.full {
+				for _, key := range []string{"host", "object_url", "required_headers", "file_name"} {
+					if _, ok := data[key]; ok {
+						t.Errorf("%s %s: %s present in the minimal response", path, tt.name, key)
+					}
+				}
+			}
+		}
+	}
+}
+
+// withField copies a request body with one more field
+func withField(body map[string]interface{}, name string, value interface{}) map[string]interface{} {
+	copied := map[string]interface{}{name: value}
+	for key, item := range body {
+		copied[key] = item
+	}
+	return copied
+}
+
+func TestContentTypeFromExtension(t *testing.T) {
+	tests := []struct {
+		extension   string
+		contentType string
+	}{
+		{".pdf", "application/pdf"},
+		{".PDF", "application/pdf"},
+		{".png", "image/png"},
+		// Parameters such as charset are dropped
+		{".txt", "text/plain"},
+		{".unknown-ext", FALLBACK_CONTENT_TYPE},
+		{"", FALLBACK_CONTENT_TYPE},
+	}
+	for _, tt := range tests {
+		if got := contentTypeForExtension(tt.extension); got != tt.contentType {
+			t.Errorf("contentTypeForExtension(%q) = %q, want %q", tt.extension, got, tt.contentType)
+		}
+	}
+
+	_, router := newTestRouter(t, map[string]string{"ALLOWED_CONTENT_TYPES": "image/png,application/pdf"})
+	for _, name := range []string{"report.pdf", "REPORT.PDF"} {
+		res := presignUpload(t, router, map[string]interface{}{"content_length": 1234, "file_name": name})
+		if res.RequiredHeaders["Content-Type"] != "application/pdf" {
+			t.Errorf("%s: Content-Type = %q, want application/pdf", name, res.RequiredHeaders["Content-Type"])
+		}
+	}
+	// The inferred type still has to be allowed
+	rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234, "file_name": "archive.unknown-ext"})
+	expectStatus(t, rec, http.StatusUnsupportedMediaType)
+}
+
+func TestStrictContentType(t *testing.T) {
+	env := map[string]string{"ALLOWED_CONTENT_TYPES": "image/png,image/jpeg,application/pdf,application/octet-stream"}
+	tests := []struct {
+		name        string
+		fileName    string
+		contentType string
+		strict      int
+		lenient     int
+	}{
+		{"matching", "report.pdf", "application/pdf", http.StatusOK, http.StatusOK},
+		{"matching uppercase", "PHOTO.PNG", "image/png", http.StatusOK, http.StatusOK},
+		{"mismatching", "report.pdf", "image/png", http.StatusBadRequest, http.StatusOK},
+		{"mismatching image", "photo.png", "image/jpeg", http.StatusBadRequest, http.StatusOK},
+		// Nothing to compare against
+		{"unknown extension", "blob.unknown-ext", "image/png", http.StatusOK, http.StatusOK},
+		{"no content type", "report.pdf", "", http.StatusOK, http.StatusOK},
+	}
+	strictEnv := withEnv(env, "STRICT_CONTENT_TYPE", "true")
+	_, strict := newTestRouter(t, strictEnv)
+	_, lenient := newTestRouter(t, env)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := map[string]interface{}{"content_length": 1234, "file_name": tt.fileName, "content_type": tt.contentType}
+			rec := doRequest(t, strict, http.MethodPost, "/get-upload-url", body)
+			expectStatus(t, rec, tt.strict)
+			if tt.strict != http.StatusOK {
+				if res := decodeJSON(t, rec); res["code"] != ERROR_CODE_CONTENT_TYPE_MISMATCH {
+					t.Errorf("code = %v, want %s", res["code"], ERROR_CODE_CONTENT_TYPE_MISMATCH)
+				}
+			}
+			// Off by default
+			expectStatus(t, doRequest(t, lenient, http.MethodPost, "/get-upload-url", body), tt.lenient)
+		})
+	}
+}
+
+// withEnv copies a test environment with one more variable
+func withEnv(env map[string]string, name string, value string) map[string]string {
+	copied := map[string]string{name: value}
+	for key, item := range env {
+		copied[key] = item
+	}
+	return copied
+}
+
+func TestStaticCredentialsProvider(t *testing.T) {
+	// No keys in the environment, only the injected provider can sign
+	config := newTestConfig(t, map[string]string{"AWS_ACCESS_KEY_ID": "", "AWS_SECRET_ACCESS_KEY": "", "AWS_REGION": "eu-west-1"})
+	config.CredentialsProvider = func(*session.Session) credentials.Provider {
+		return &credentials.StaticProvider{Value: credentials.Value{AccessKeyID: "AKIDSTATIC", SecretAccessKey: "static-secret"}}
+	}
+	svc, err := newS3Client(config)
+	if err != nil {
+		t.Fatalf("newS3Client: %v", err)
+	}
+	server := newTestServer(t, nil)
+	server.Config = config
+	server.S3 = svc
+	server.Storage = &S3Backend{S3: svc}
+	setClock(server, fixedClock(testNow))
+	res := presignUpload(t, newRouter(server, config), map[string]interface{}{"content_length": 1234, "file_name": "photo.png"})
+
+	u, err := url.Parse(res.PreAssignedURL)
+	if err != nil {
+		t.Fatalf("URL = %q: %v", res.PreAssignedURL, err)
+	}
+	if u.Host != "test-bucket.s3.eu-west-1.amazonaws.com" || u.Path != "/photo.png" {
+		t.Errorf("URL = %q, want photo.png in test-bucket", res.PreAssignedURL)
+	}
+	query := u.Query()
+	want := map[string]string{
+		"X-Amz-Algorithm":  "AWS4-HMAC-SHA256",
+		"X-Amz-Credential": "AKIDSTATIC/" + testNow.UTC().Format("20060102") + "/eu-west-1/s3/aws4_request",
+		"X-Amz-Date":       testNow.UTC().Format("20060102T150405Z"),
+		"X-Amz-Expires":    "600",
+	}
+	for name, value := range want {
+		if query.Get(name) != value {
+			t.Errorf("%s = %q, want %q", name, query.Get(name), value)
+		}
+	}
+	if signature := query.Get("X-Amz-Signature"); !regexp.MustCompile(`^[a-f0-9]{64}$`).MatchString(signature) {
+		t.Errorf("X-Amz-Signature = %q, want 64 hex characters", signature)
+	}
+
+	// The same request signed with other keys gets another signature
+	config.CredentialsProvider = func(*session.Session) credentials.Provider {
+		return &credentials.StaticProvider{Value: credentials.Value{AccessKeyID: "AKIDSTATIC", SecretAccessKey: "rotated-secret"}}
+	}
+	rotated, err := newS3Client(config)
+	if err != nil {
+		t.Fatalf("newS3Client: %v", err)
+	}
+	server.S3 = rotated
+	server.Storage = &S3Backend{S3: rotated}
+	again := presignUpload(t, newRouter(server, config), map[string]interface{}{"content_length": 1234, "file_name": "photo.png"})
+	if again.PreAssignedURL == res.PreAssignedURL {
+		t.Error("rotated secret signed the same URL")
+	}
+}
+
+func TestSigningRegion(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		region string
+	}{
+		{"aws", map[string]string{"AWS_REGION": "eu-west-1"}, "eu-west-1"},
+		{"custom endpoint", map[string]string{"AWS_REGION": "garage", "AWS_ENDPOINT": "http://localhost:3900", "AWS_S3_FORCE_PATH_STYLE": "true"}, "garage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, router := newTestRouter(t, tt.env)
+			upload := presignUpload(t, router, map[string]interface{}{"content_length": 1234})
+			if upload.SigningRegion != tt.region {
+				t.Errorf("upload signing_region = %q, want %q", upload.SigningRegion, tt.region)
+			}
+			if !strings.Contains(upload.PreAssignedURL, "%2F"+tt.region+"%2Fs3%2F") {
+				t.Errorf("URL = %q, want %s in the credential scope", upload.PreAssignedURL, tt.region)
+			}
+			download := presign(t, router, "/get-download-url", map[string]interface{}{"file_name": "photo.png"})
+			if download.SigningRegion != tt.region {
+				t.Errorf("download signing_region = %q, want %q", download.SigningRegion, tt.region)
+			}
+
+			rec := doRequest(t, router, http.MethodPost, "/get-upload-post", map[string]interface{}{"content_length": 1234})
+			expectStatus(t, rec, http.StatusOK)
+			var post GeneratePresignedPostResponse
+			decodeData(t, rec, &post)
+			if post.SigningRegion != tt.region || !strings.Contains(post.Fields["x-amz-credential"], "/"+tt.region+"/s3/") {
+				t.Errorf("POST signing_region = %q, credential = %q, want %s", post.SigningRegion, post.Fields["x-amz-credential"], tt.region)
+			}
+		})
+	}
+
+	t.Run("SigV2", func(t *testing.T) {
+		_, router := newTestRouter(t, map[string]string{"AWS_SIGNATURE_VERSION": SIGNATURE_VERSION_2})
+		rec := doRequest(t, router, http.MethodPost, "/get-upload-url", map[string]interface{}{"content_length": 1234})
+		expectStatus(t, rec, http.StatusOK)
+		data, _ := decodeJSON(t, rec)["data"].(map[string]interface{})
+		// SigV2 signs no region
+		if region, ok := data["signing_region"]; ok {
+			t.Errorf("signing_region = %v, want it omitted", region)
+		}
+	})
+}